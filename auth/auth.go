@@ -0,0 +1,171 @@
+// Package auth authenticates requests to the server, and identifies the user
+// and groups that made them.
+//
+// Requests can be authenticated with hashed static API tokens, OpenID Connect
+// tokens verified against a JWKS file, client certificates, or any
+// go_middlewares.Authorizer such as the Google authorizer. An Authorizer tries
+// each of its Authenticators in turn, and lets a request through if any of
+// them identify its user.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/skuid/go-middlewares"
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/spec/middlewares"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ErrNoCredentials is returned by an Authenticator for a request that has none
+// of the credentials it checks
+var ErrNoCredentials = errors.New("no credentials")
+
+// An Authenticator identifies the user that made a request
+type Authenticator interface {
+	// Name names the authentication method in logs
+	Name() string
+	// Authenticate returns the user that made a request, or
+	// ErrNoCredentials if the request has no credentials for this
+	// Authenticator
+	Authenticate(r *http.Request) (policy.Identity, error)
+}
+
+// authenticated is a request's identity, and the method that authenticated it
+type authenticated struct {
+	identity policy.Identity
+	method   string
+}
+
+type contextKey struct{}
+
+// Authorizer is a go_middlewares.Authorizer that lets a request through if any
+// of its Authenticators identify its user
+type Authorizer struct {
+	authenticators []Authenticator
+}
+
+// New returns an Authorizer that tries each authenticator in order
+func New(authenticators ...Authenticator) *Authorizer {
+	return &Authorizer{authenticators: authenticators}
+}
+
+// authenticate returns the identity from the first authenticator that
+// identifies the request's user
+func (a *Authorizer) authenticate(r *http.Request) (authenticated, error) {
+	if auth, ok := r.Context().Value(contextKey{}).(authenticated); ok {
+		return auth, nil
+	}
+
+	failures := []string{}
+	for _, authenticator := range a.authenticators {
+		id, err := authenticator.Authenticate(r)
+		if err == nil {
+			return authenticated{identity: id, method: authenticator.Name()}, nil
+		}
+		if err != ErrNoCredentials {
+			failures = append(failures, fmt.Sprintf("%s: %s", authenticator.Name(), err))
+		}
+	}
+	if len(failures) == 0 {
+		return authenticated{}, ErrNoCredentials
+	}
+	return authenticated{}, errors.New(strings.Join(failures, "; "))
+}
+
+// Identity returns the user that made a request, if it is authenticated
+func (a *Authorizer) Identity(r *http.Request) (policy.Identity, bool) {
+	auth, err := a.authenticate(r)
+	if err != nil {
+		return policy.Identity{}, false
+	}
+	return auth.identity, true
+}
+
+// LoggingClosure adds "user" and "auth_method" fields for an authenticated
+// user
+func (a *Authorizer) LoggingClosure(r *http.Request) []zapcore.Field {
+	auth, err := a.authenticate(r)
+	if err != nil {
+		return []zapcore.Field{}
+	}
+	return []zapcore.Field{
+		zap.String("user", auth.identity.User),
+		zap.String("auth_method", auth.method),
+	}
+}
+
+// Authorize is a middleware that rejects requests that aren't authenticated
+func (a *Authorizer) Authorize() middlewares.Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth, err := a.authenticate(r)
+			if err != nil {
+				zap.L().Info("Not authenticated", zap.Error(err))
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+			zap.L().Debug("Successfully authenticated", zap.String("user", auth.identity.User), zap.String("auth_method", auth.method))
+
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, auth)))
+		})
+	}
+}
+
+// bearerToken returns the token in a request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || len(parts[1]) == 0 {
+		return "", false
+	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// authorizerAuthenticator authenticates requests with a
+// go_middlewares.Authorizer
+type authorizerAuthenticator struct {
+	name       string
+	authorizer go_middlewares.Authorizer
+}
+
+// FromAuthorizer returns an Authenticator that lets a go_middlewares.Authorizer,
+// such as the Google authorizer, decide whether a request is authenticated.
+// The user is the "user" field the authorizer logs, and has no groups.
+func FromAuthorizer(name string, authorizer go_middlewares.Authorizer) Authenticator {
+	return authorizerAuthenticator{name: name, authorizer: authorizer}
+}
+
+func (a authorizerAuthenticator) Name() string { return a.name }
+
+// discardWriter is a ResponseWriter that drops the response an authorizer
+// writes when it rejects a request
+type discardWriter struct{ header http.Header }
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+func (a authorizerAuthenticator) Authenticate(r *http.Request) (policy.Identity, error) {
+	if len(r.Header.Get("Authorization")) == 0 {
+		return policy.Identity{}, ErrNoCredentials
+	}
+	authorized := false
+	a.authorizer.Authorize()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized = true
+	})).ServeHTTP(discardWriter{header: http.Header{}}, r)
+	if !authorized {
+		return policy.Identity{}, errors.New("not authorized")
+	}
+
+	for _, field := range a.authorizer.LoggingClosure(r) {
+		if field.Key == "user" && field.Type == zapcore.StringType {
+			return policy.Identity{User: field.String}, nil
+		}
+	}
+	return policy.Identity{}, errors.New("authorized without a user")
+}
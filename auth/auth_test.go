@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/spec/middlewares"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// fakeAuthenticator authenticates requests with its header
+type fakeAuthenticator struct {
+	name   string
+	header string
+	calls  int
+}
+
+func (a *fakeAuthenticator) Name() string { return a.name }
+
+func (a *fakeAuthenticator) Authenticate(r *http.Request) (policy.Identity, error) {
+	a.calls++
+	switch value := r.Header.Get(a.header); value {
+	case "":
+		return policy.Identity{}, ErrNoCredentials
+	case "invalid":
+		return policy.Identity{}, errors.New("invalid")
+	default:
+		return policy.Identity{User: value}, nil
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	cases := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+		wantFields []zapcore.Field
+	}{
+		{"first", map[string]string{"X-First": "alice"}, http.StatusOK,
+			[]zapcore.Field{zap.String("user", "alice"), zap.String("auth_method", "first")}},
+		{"second", map[string]string{"X-Second": "bob"}, http.StatusOK,
+			[]zapcore.Field{zap.String("user", "bob"), zap.String("auth_method", "second")}},
+		{"first fails", map[string]string{"X-First": "invalid", "X-Second": "bob"}, http.StatusOK,
+			[]zapcore.Field{zap.String("user", "bob"), zap.String("auth_method", "second")}},
+		{"none", nil, http.StatusUnauthorized, []zapcore.Field{}},
+		{"invalid", map[string]string{"X-First": "invalid"}, http.StatusUnauthorized, []zapcore.Field{}},
+	}
+
+	for _, c := range cases {
+		first := &fakeAuthenticator{name: "first", header: "X-First"}
+		a := New(first, &fakeAuthenticator{name: "second", header: "X-Second"})
+
+		r := httptest.NewRequest("GET", "/releases", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		var fields []zapcore.Field
+		w := httptest.NewRecorder()
+		middlewares.Apply(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fields = a.LoggingClosure(r)
+		}), a.Authorize()).ServeHTTP(w, r)
+
+		if w.Code != c.wantStatus {
+			t.Errorf("Test '%s': Expected status %d, got %d", c.name, c.wantStatus, w.Code)
+		}
+		if c.wantStatus != http.StatusOK {
+			continue
+		}
+		if !reflect.DeepEqual(fields, c.wantFields) {
+			t.Errorf("Test '%s': Expected fields %v, got %v", c.name, c.wantFields, fields)
+		}
+		// The handler reuses the identity the middleware found
+		if first.calls != 1 {
+			t.Errorf("Test '%s': Expected 1 authentication, got %d", c.name, first.calls)
+		}
+	}
+}
+
+// fakeAuthorizer authorizes requests with the token "Bearer ok"
+type fakeAuthorizer struct{}
+
+func (fakeAuthorizer) Authorize() middlewares.Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer ok" {
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (fakeAuthorizer) LoggingClosure(r *http.Request) []zapcore.Field {
+	return []zapcore.Field{zap.String("user", "dave@example.com")}
+}
+
+func TestFromAuthorizer(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   policy.Identity
+		err    bool
+		noCred bool
+	}{
+		{"authorized", "Bearer ok", policy.Identity{User: "dave@example.com"}, false, false},
+		{"not authorized", "Bearer nope", policy.Identity{}, true, false},
+		{"no header", "", policy.Identity{}, true, true},
+	}
+
+	a := FromAuthorizer("google", fakeAuthorizer{})
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/releases", nil)
+		if len(c.header) > 0 {
+			r.Header.Set("Authorization", c.header)
+		}
+		id, err := a.Authenticate(r)
+		if (err != nil) != c.err || (c.noCred && err != ErrNoCredentials) {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.err, err)
+		}
+		if !reflect.DeepEqual(id, c.want) {
+			t.Errorf("Test '%s': Expected identity %+v, got %+v", c.name, c.want, id)
+		}
+	}
+}
+
+func TestCertificateAuthenticate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner", Organization: []string{"ci", "deployers"}}}
+	cases := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  policy.Identity
+		err   error
+	}{
+		{"verified", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			policy.Identity{User: "ci-runner", Groups: []string{"ci", "deployers"}}, nil},
+		{"no certificate", &tls.ConnectionState{}, policy.Identity{}, ErrNoCredentials},
+		{"plain HTTP", nil, policy.Identity{}, ErrNoCredentials},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/releases", nil)
+		r.TLS = c.state
+		id, err := CertificateAuthenticator{}.Authenticate(r)
+		if err != c.err {
+			t.Errorf("Test '%s': Expected error %v, got %v", c.name, c.err, err)
+		}
+		if !reflect.DeepEqual(id, c.want) {
+			t.Errorf("Test '%s': Expected identity %+v, got %+v", c.name, c.want, id)
+		}
+	}
+}
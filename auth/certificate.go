@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/skuid/helm-value-store/policy"
+)
+
+// CertificateAuthenticator authenticates requests with a client certificate
+// verified when serving TLS. The user is the certificate's common name, and
+// its organizations are the user's groups.
+type CertificateAuthenticator struct{}
+
+// Name returns "mtls"
+func (CertificateAuthenticator) Name() string { return "mtls" }
+
+// Authenticate returns the user of the request's verified client certificate
+func (CertificateAuthenticator) Authenticate(r *http.Request) (policy.Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return policy.Identity{}, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(cert.Subject.CommonName) == 0 {
+		return policy.Identity{}, errors.New("client certificate has no common name")
+	}
+	return policy.Identity{
+		User:   cert.Subject.CommonName,
+		Groups: append([]string{}, cert.Subject.Organization...),
+	}, nil
+}
+
+// ServerTLSConfig returns the TLS config for a server that verifies client
+// certificates signed by the CAs in caFile. Clients without a certificate can
+// still connect, and authenticate some other way.
+func ServerTLSConfig(caFile string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client CA file: %q", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in client CA file %s", caFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}, nil
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	// Register the hashes used by the supported signing algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/skuid/helm-value-store/policy"
+)
+
+// clockSkew is how far a token's expiry and not-before times may be off
+const clockSkew = time.Minute
+
+// OIDCConfig configures how OpenID Connect ID tokens are verified
+type OIDCConfig struct {
+	// Issuer must match the token's "iss" claim
+	Issuer string
+	// Audience must be in the token's "aud" claim, and is usually the
+	// client ID
+	Audience string
+	// JWKSFile is a JSON Web Key Set file with the issuer's signing keys.
+	// It is read again when a token is signed with a key it doesn't have.
+	JWKSFile string
+	// UserClaim is the claim the user is read from, and defaults to "email".
+	// An email is only accepted if the email_verified claim is true.
+	UserClaim string
+	// GroupsClaim is the claim the user's groups are read from, and defaults
+	// to "groups"
+	GroupsClaim string
+}
+
+// OIDCAuthenticator authenticates requests with an OpenID Connect ID token in
+// the Authorization header, as "Bearer <token>". Tokens must be signed with
+// RS256, RS384, RS512, ES256, ES384 or ES512.
+type OIDCAuthenticator struct {
+	config OIDCConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	keys    []jwk
+	modTime time.Time
+}
+
+// NewOIDCAuthenticator returns an OIDCAuthenticator that verifies tokens with
+// the keys in config.JWKSFile
+func NewOIDCAuthenticator(config OIDCConfig) (*OIDCAuthenticator, error) {
+	if len(config.Issuer) == 0 || len(config.Audience) == 0 || len(config.JWKSFile) == 0 {
+		return nil, errors.New("OIDC authentication needs an issuer, audience and JWKS file")
+	}
+	if len(config.UserClaim) == 0 {
+		config.UserClaim = "email"
+	}
+	if len(config.GroupsClaim) == 0 {
+		config.GroupsClaim = "groups"
+	}
+	a := &OIDCAuthenticator{config: config, now: time.Now}
+	if err := a.loadKeys(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Name returns "oidc"
+func (a *OIDCAuthenticator) Name() string { return "oidc" }
+
+// jwk is a public key from a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// parse sets the key's public key
+func (k *jwk) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus: %s", err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return errors.New("invalid exponent")
+		}
+		if n.BitLen() < minRSABits {
+			return fmt.Errorf("RSA keys must be at least %d bits", minRSABits)
+		}
+		k.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return fmt.Errorf("invalid x: %s", err)
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return fmt.Errorf("invalid y: %s", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return errors.New("point is not on the curve")
+		}
+		k.key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	return nil
+}
+
+// loadKeys reads the signing keys from the JWKS file, if it has changed since
+// it was last read. Keys that aren't for signing, or have an unsupported
+// type, are skipped.
+func (a *OIDCAuthenticator) loadKeys() error {
+	info, err := os.Stat(a.config.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("Error reading JWKS file: %q", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if info.ModTime().Equal(a.modTime) && len(a.keys) > 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(a.config.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("Error reading JWKS file: %q", err)
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("Error parsing JWKS file %s: %q", a.config.JWKSFile, err)
+	}
+	keys := []jwk{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" || k.parse() != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS file %s has no supported signing keys", a.config.JWKSFile)
+	}
+	a.keys = keys
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// keysFor returns the keys that may have signed a token with a key ID
+func (a *OIDCAuthenticator) keysFor(kid string) []jwk {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	response := []jwk{}
+	for _, k := range a.keys {
+		if len(kid) == 0 || k.Kid == kid {
+			response = append(response, k)
+		}
+	}
+	return response
+}
+
+// minRSABits is the smallest RSA key that signatures are accepted from
+const minRSABits = 2048
+
+// algorithm is a supported JWS signing algorithm
+type algorithm struct {
+	hash crypto.Hash
+	// curve is the curve of an ECDSA algorithm's keys, and nil for RSA
+	// PKCS #1 v1.5
+	curve elliptic.Curve
+}
+
+var algorithms = map[string]algorithm{
+	"RS256": {crypto.SHA256, nil},
+	"RS384": {crypto.SHA384, nil},
+	"RS512": {crypto.SHA512, nil},
+	"ES256": {crypto.SHA256, elliptic.P256()},
+	"ES384": {crypto.SHA384, elliptic.P384()},
+	"ES512": {crypto.SHA512, elliptic.P521()},
+}
+
+// verify checks a signature over signed with a key. RSA keys must be at
+// least minRSABits, and ECDSA keys must be on the algorithm's curve.
+func (alg algorithm) verify(key crypto.PublicKey, signed string, signature []byte) bool {
+	h := alg.hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg.curve != nil || key.N.BitLen() < minRSABits {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(key, alg.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg.curve != key.Curve || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// audience is an "aud" claim, which may be a string or a list of strings
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+// claims are the registered claims that are checked
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	Expires   *int64   `json:"exp"`
+	NotBefore *int64   `json:"nbf"`
+}
+
+// Authenticate verifies the request's ID token, and returns the user and
+// groups in its claims. Bearer tokens that aren't JWTs are left for other
+// authenticators.
+func (a *OIDCAuthenticator) Authenticate(r *http.Request) (policy.Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return policy.Identity{}, ErrNoCredentials
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return policy.Identity{}, ErrNoCredentials
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return policy.Identity{}, ErrNoCredentials
+	}
+
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		return policy.Identity{}, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return policy.Identity{}, errors.New("malformed signature")
+	}
+	keys := a.keysFor(header.Kid)
+	if len(keys) == 0 {
+		// The issuer may have rotated its keys
+		if err := a.loadKeys(); err != nil {
+			return policy.Identity{}, err
+		}
+		keys = a.keysFor(header.Kid)
+	}
+	verified := false
+	for _, k := range keys {
+		if alg.verify(k.key, parts[0]+"."+parts[1], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return policy.Identity{}, errors.New("invalid signature")
+	}
+
+	c := claims{}
+	all := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return policy.Identity{}, errors.New("malformed claims")
+	}
+	if err := decodeSegment(parts[1], &all); err != nil {
+		return policy.Identity{}, errors.New("malformed claims")
+	}
+	if err := a.check(c); err != nil {
+		return policy.Identity{}, err
+	}
+
+	user, _ := all[a.config.UserClaim].(string)
+	if len(user) == 0 {
+		return policy.Identity{}, fmt.Errorf("token has no %q claim", a.config.UserClaim)
+	}
+	// Anyone can claim an address they haven't verified with a shared issuer
+	if verified, _ := all["email_verified"].(bool); a.config.UserClaim == "email" && !verified {
+		return policy.Identity{}, errors.New("token's email is not verified")
+	}
+	return policy.Identity{User: user, Groups: stringsClaim(all[a.config.GroupsClaim])}, nil
+}
+
+// check checks a token's issuer, audience, and that it is current
+func (a *OIDCAuthenticator) check(c claims) error {
+	if c.Issuer != a.config.Issuer {
+		return fmt.Errorf("token issued by %q", c.Issuer)
+	}
+	found := false
+	for _, aud := range c.Audience {
+		if aud == a.config.Audience {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("token is not for audience %q", a.config.Audience)
+	}
+	now := a.now()
+	if c.Expires == nil || now.Add(-clockSkew).After(time.Unix(*c.Expires, 0)) {
+		return errors.New("token has expired")
+	}
+	if c.NotBefore != nil && now.Add(clockSkew).Before(time.Unix(*c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringsClaim returns a claim that is a string or a list of strings
+func stringsClaim(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		response := []string{}
+		for _, v := range claim {
+			if s, ok := v.(string); ok {
+				response = append(response, s)
+			}
+		}
+		return response
+	}
+	return nil
+}
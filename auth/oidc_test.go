@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken returns a JWT with claims, signed by key
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeSegment(claims)
+	h := algorithms[alg].hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, key, algorithms[alg].hash, digest)
+		if err != nil {
+			t.Fatalf("Error signing token: %s", err)
+		}
+		signature = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatalf("Error signing token: %s", err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(padded(r, size), padded(s, size)...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// padded returns i as big-endian bytes, left padded to size
+func padded(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// writeJWKS writes the public keys of keys to a JWKS file
+func writeJWKS(t *testing.T, path string, keys map[string]crypto.Signer) {
+	set := map[string][]map[string]string{"keys": {}}
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			set["keys"] = append(set["keys"], map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": encodeInt(key.N), "e": encodeInt(big.NewInt(int64(key.E))),
+			})
+		case *ecdsa.PrivateKey:
+			set["keys"] = append(set["keys"], map[string]string{
+				"kty": "EC", "kid": kid, "crv": key.Curve.Params().Name,
+				"x": encodeInt(key.X), "y": encodeInt(key.Y),
+			})
+		}
+	}
+	data, _ := json.Marshal(set)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Error writing JWKS file: %s", err)
+	}
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oidc")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	weakKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwksFile, map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey, "ec521": ec521Key, "weak": weakKey})
+
+	a, err := NewOIDCAuthenticator(OIDCConfig{Issuer: "https://sso.example.com", Audience: "hvs", JWKSFile: jwksFile})
+	if err != nil {
+		t.Fatalf("Error creating authenticator: %s", err)
+	}
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":            "https://sso.example.com",
+			"aud":            []string{"hvs", "other"},
+			"exp":            now.Add(time.Hour).Unix(),
+			"email":          "carol@example.com",
+			"email_verified": true,
+			"groups":         []string{"sre", "dev"},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	cases := []struct {
+		name       string
+		token      string
+		want       []string
+		wantErr    bool
+		wantNoCred bool
+	}{
+		{"RS256", signToken(t, "RS256", "rsa", rsaKey, claims(nil)), []string{"carol@example.com", "sre", "dev"}, false, false},
+		{"ES256", signToken(t, "ES256", "ec", ecKey, claims(nil)), []string{"carol@example.com", "sre", "dev"}, false, false},
+		{"no key ID", signToken(t, "RS512", "", rsaKey, claims(nil)), []string{"carol@example.com", "sre", "dev"}, false, false},
+		{"string audience and group", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "hvs", "groups": "sre"})), []string{"carol@example.com", "sre"}, false, false},
+		{"unknown key", signToken(t, "RS256", "rsa", otherKey, claims(nil)), nil, true, false},
+		{"ES512", signToken(t, "ES512", "ec521", ec521Key, claims(nil)), []string{"carol@example.com", "sre", "dev"}, false, false},
+		{"wrong algorithm for key", signToken(t, "RS256", "ec", rsaKey, claims(nil)), nil, true, false},
+		{"ES256 with a P-521 key", signToken(t, "ES256", "ec521", ec521Key, claims(nil)), nil, true, false},
+		{"ES512 with a P-256 key", signToken(t, "ES512", "ec", ecKey, claims(nil)), nil, true, false},
+		{"RSA key under 2048 bits", signToken(t, "RS256", "weak", weakKey, claims(nil)), nil, true, false},
+		{"wrong issuer", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), nil, true, false},
+		{"wrong audience", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})), nil, true, false},
+		{"expired", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), nil, true, false},
+		{"no expiry", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})), nil, true, false},
+		{"not valid yet", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), nil, true, false},
+		{"unverified email", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"email_verified": false})), nil, true, false},
+		{"no email verification", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"email_verified": nil})), nil, true, false},
+		{"email verified as a string", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"email_verified": "true"})), nil, true, false},
+		{"no user", signToken(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"email": nil})), nil, true, false},
+		{"unsigned", encodeSegment(map[string]string{"alg": "none"}) + "." + encodeSegment(claims(nil)) + ".", nil, true, false},
+		{"not a JWT", "abc123", nil, false, true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/releases", nil)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		id, err := a.Authenticate(r)
+		if c.wantNoCred {
+			if err != ErrNoCredentials {
+				t.Errorf("Test '%s': Expected no credentials, got %v", c.name, err)
+			}
+			continue
+		}
+		if (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.wantErr, err)
+			continue
+		}
+		if err == nil {
+			if got := append([]string{id.User}, id.Groups...); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Test '%s': Expected user and groups %v, got %v", c.name, c.want, got)
+			}
+		}
+	}
+}
+
+func TestOIDCReloadsKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oidc")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwksFile, map[string]crypto.Signer{"old": oldKey})
+
+	a, err := NewOIDCAuthenticator(OIDCConfig{Issuer: "https://sso.example.com", Audience: "hvs", JWKSFile: jwksFile, UserClaim: "sub"})
+	if err != nil {
+		t.Fatalf("Error creating authenticator: %s", err)
+	}
+
+	// The issuer rotates its keys
+	writeJWKS(t, jwksFile, map[string]crypto.Signer{"old": oldKey, "new": newKey})
+	os.Chtimes(jwksFile, time.Now(), time.Now().Add(time.Minute))
+
+	token := signToken(t, "RS256", "new", newKey, map[string]interface{}{
+		"iss": "https://sso.example.com",
+		"aud": "hvs",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"sub": "ci-runner",
+	})
+	r := httptest.NewRequest("GET", "/releases", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	id, err := a.Authenticate(r)
+	if err != nil {
+		t.Fatalf("Expected a token signed with a new key to be verified, got %s", err)
+	}
+	if id.User != "ci-runner" || len(id.Groups) != 0 {
+		t.Errorf("Expected user ci-runner with no groups, got %+v", id)
+	}
+}
+
+func TestNewOIDCAuthenticator(t *testing.T) {
+	if _, err := NewOIDCAuthenticator(OIDCConfig{Issuer: "https://sso.example.com", JWKSFile: "jwks.json"}); err == nil {
+		t.Errorf("Expected an error without an audience")
+	}
+	_, err := NewOIDCAuthenticator(OIDCConfig{Issuer: "https://sso.example.com", Audience: "hvs", JWKSFile: "does-not-exist.json"})
+	if err == nil || !strings.Contains(err.Error(), "JWKS") {
+		t.Errorf("Expected an error reading the JWKS file, got %v", err)
+	}
+}
+
+func TestAlgorithmVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	weakKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+
+	cases := []struct {
+		alg  string
+		name string
+		key  crypto.Signer
+		want bool
+	}{
+		{"RS256", "RSA 2048", rsaKey, true},
+		{"RS256", "RSA 1024", weakKey, false},
+		{"ES256", "P-256", p256Key, true},
+		{"ES384", "P-384", p384Key, true},
+		{"ES512", "P-521", p521Key, true},
+		{"ES256", "P-521", p521Key, false},
+		{"ES384", "P-256", p256Key, false},
+		{"ES512", "P-256", p256Key, false},
+		{"ES256", "RSA 2048", rsaKey, false},
+	}
+
+	for _, c := range cases {
+		parts := strings.Split(signToken(t, c.alg, "", c.key, map[string]interface{}{}), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		got := algorithms[c.alg].verify(c.key.Public(), parts[0]+"."+parts[1], signature)
+		if got != c.want {
+			t.Errorf("Test '%s with %s': Expected %t, got %t", c.alg, c.name, c.want, got)
+		}
+	}
+}
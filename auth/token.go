@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/skuid/helm-value-store/policy"
+)
+
+// hashPrefix marks a token hash as a hex SHA-256 digest
+const hashPrefix = "sha256:"
+
+// A Token is a static API token, such as one used by CI. Only the token's
+// hash is kept.
+type Token struct {
+	// Name is the user the token authenticates as
+	Name string `json:"name"`
+	// Hash is "sha256:" followed by the hex SHA-256 digest of the token
+	Hash   string   `json:"hash"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// HashToken returns the Hash of a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// TokenAuthenticator authenticates requests with a static API token in the
+// Authorization header, as "Bearer <token>"
+type TokenAuthenticator struct {
+	tokens []Token
+	// digests are the decoded hashes of tokens
+	digests [][]byte
+}
+
+type tokenFile struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// NewTokenAuthenticator returns a TokenAuthenticator that accepts tokens
+func NewTokenAuthenticator(tokens []Token) (*TokenAuthenticator, error) {
+	a := &TokenAuthenticator{tokens: tokens}
+	for _, t := range tokens {
+		if len(t.Name) == 0 {
+			return nil, errors.New("token has no name")
+		}
+		if !strings.HasPrefix(t.Hash, hashPrefix) {
+			return nil, fmt.Errorf("token %s has a hash that doesn't start with %q", t.Name, hashPrefix)
+		}
+		digest, err := hex.DecodeString(strings.TrimPrefix(t.Hash, hashPrefix))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("token %s has an invalid SHA-256 hash", t.Name)
+		}
+		a.digests = append(a.digests, digest)
+	}
+	return a, nil
+}
+
+// LoadTokenFile reads tokens from a YAML file:
+//
+//	tokens:
+//	- name: ci
+//	  hash: sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	  groups: [ci]
+func LoadTokenFile(path string) (*TokenAuthenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading token file: %q", err)
+	}
+	file := &tokenFile{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("Error parsing token file %s: %q", path, err)
+	}
+	a, err := NewTokenAuthenticator(file.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token file %s: %s", path, err)
+	}
+	return a, nil
+}
+
+// Name returns "token"
+func (a *TokenAuthenticator) Name() string { return "token" }
+
+// Authenticate returns the user of the request's token. Bearer tokens that
+// aren't known are left for other authenticators.
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (policy.Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return policy.Identity{}, ErrNoCredentials
+	}
+	sum := sha256.Sum256([]byte(token))
+	for i, digest := range a.digests {
+		if subtle.ConstantTimeCompare(sum[:], digest) == 1 {
+			return policy.Identity{User: a.tokens[i].Name, Groups: a.tokens[i].Groups}, nil
+		}
+	}
+	return policy.Identity{}, ErrNoCredentials
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/policy"
+)
+
+func TestTokenAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.yaml")
+	file := "tokens:\n- name: ci\n  hash: " + HashToken("s3cret") + "\n  groups: [ci]\n- name: deployer\n  hash: " + HashToken("other") + "\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatalf("Error writing token file: %s", err)
+	}
+	a, err := LoadTokenFile(path)
+	if err != nil {
+		t.Fatalf("Error loading token file: %s", err)
+	}
+
+	cases := []struct {
+		name   string
+		header string
+		want   policy.Identity
+		err    error
+	}{
+		{"token", "Bearer s3cret", policy.Identity{User: "ci", Groups: []string{"ci"}}, nil},
+		{"scheme is case-insensitive", "bearer other", policy.Identity{User: "deployer"}, nil},
+		{"unknown token", "Bearer wrong", policy.Identity{}, ErrNoCredentials},
+		{"no token", "", policy.Identity{}, ErrNoCredentials},
+		{"basic auth", "Basic czNjcmV0", policy.Identity{}, ErrNoCredentials},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/releases", nil)
+		if len(c.header) > 0 {
+			r.Header.Set("Authorization", c.header)
+		}
+		id, err := a.Authenticate(r)
+		if err != c.err {
+			t.Errorf("Test '%s': Expected error %v, got %v", c.name, c.err, err)
+		}
+		if !reflect.DeepEqual(id, c.want) {
+			t.Errorf("Test '%s': Expected identity %+v, got %+v", c.name, c.want, id)
+		}
+	}
+}
+
+func TestNewTokenAuthenticator(t *testing.T) {
+	cases := []struct {
+		name    string
+		tokens  []Token
+		wantErr bool
+	}{
+		{"valid", []Token{{Name: "ci", Hash: HashToken("s3cret")}}, false},
+		{"no name", []Token{{Hash: HashToken("s3cret")}}, true},
+		{"plain text", []Token{{Name: "ci", Hash: "s3cret"}}, true},
+		{"short hash", []Token{{Name: "ci", Hash: "sha256:abcd"}}, true},
+	}
+
+	for _, c := range cases {
+		if _, err := NewTokenAuthenticator(c.tokens); (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.wantErr, err)
+		}
+	}
+}
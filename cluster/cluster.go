@@ -0,0 +1,319 @@
+// Package cluster picks the cluster a release is deployed to from its labels.
+//
+// A cluster file lists clusters, each with a label selector and a way to reach
+// its Tiller:
+//
+//	clusters:
+//	- name: prod-us
+//	  selector:
+//	    environment: prod
+//	    region: us-west-2
+//	  tillerHost: tiller.prod-us.example.com:44134
+//	- name: test
+//	  selector:
+//	    environment: test
+//	  kubeContext: test-cluster
+//	  tls:
+//	    verify: true
+//	    caCert: test-ca.pem
+//	    serverName: tiller-deploy
+//
+// A release is deployed to the cluster whose selector matches its labels.
+// When several selectors match, the one with the most labels wins.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/store"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// A Cluster is a cluster releases can be deployed to
+type Cluster struct {
+	Name string `json:"name"`
+	// Selector matches the labels of releases deployed to this cluster
+	Selector map[string]string `json:"selector"`
+	// TillerHost is the address of the cluster's Tiller
+	TillerHost string `json:"tillerHost,omitempty"`
+	// KubeContext is the kubeconfig context used to port-forward to Tiller
+	// when TillerHost isn't set
+	KubeContext string `json:"kubeContext,omitempty"`
+	// TillerNamespace is the namespace Tiller runs in, and defaults to
+	// kube-system
+	TillerNamespace string `json:"tillerNamespace,omitempty"`
+	// TLS configures the connection to Tiller, and overrides the registry's
+	// default TLS options
+	TLS *deploy.TLSOptions `json:"tls,omitempty"`
+}
+
+// A Connector returns a Deployer for a cluster
+type Connector func(c Cluster) (deploy.Deployer, error)
+
+// RegistryOpt is a function that sets optional values on a Registry
+type RegistryOpt func(*Registry)
+
+// WithConnector sets how the registry connects to clusters. By default,
+// clusters are connected to with their TillerHost, or through a kubectl
+// port-forward to Tiller in their KubeContext.
+func WithConnector(connect Connector) RegistryOpt {
+	return func(reg *Registry) {
+		reg.connect = connect
+	}
+}
+
+// WithTLS sets the TLS options for clusters that don't set their own
+func WithTLS(tlsOpts deploy.TLSOptions) RegistryOpt {
+	return func(reg *Registry) {
+		reg.tls = tlsOpts
+	}
+}
+
+// Registry is a deploy.Deployer that deploys each release to the cluster
+// matching its labels. It is safe for concurrent use.
+type Registry struct {
+	clusters []Cluster
+	connect  Connector
+	tls      deploy.TLSOptions
+
+	mu        sync.Mutex
+	deployers map[string]deploy.Deployer
+	tunnels   []*tunnel
+	// connecting holds a lock per cluster, so that a slow connection to one
+	// cluster doesn't hold up the others
+	connecting map[string]*sync.Mutex
+}
+
+type clusterFile struct {
+	Clusters []Cluster `json:"clusters"`
+}
+
+// NewRegistry creates a Registry of clusters
+func NewRegistry(clusters []Cluster, opts ...RegistryOpt) (*Registry, error) {
+	names := map[string]bool{}
+	for _, c := range clusters {
+		if len(c.Name) == 0 {
+			return nil, errors.New("Every cluster must have a name")
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Cluster %s is defined more than once", c.Name)
+		}
+		names[c.Name] = true
+		if len(c.TillerHost) == 0 && len(c.KubeContext) == 0 {
+			return nil, fmt.Errorf("Cluster %s must have a tillerHost or a kubeContext", c.Name)
+		}
+	}
+
+	reg := &Registry{
+		clusters:   clusters,
+		deployers:  map[string]deploy.Deployer{},
+		connecting: map[string]*sync.Mutex{},
+	}
+	reg.connect = reg.connectTiller
+	for _, opt := range opts {
+		opt(reg)
+	}
+	return reg, nil
+}
+
+// LoadFile creates a Registry from a cluster file
+func LoadFile(path string, opts ...RegistryOpt) (*Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading cluster file: %q", err)
+	}
+	file := &clusterFile{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("Error parsing cluster file %s: %q", path, err)
+	}
+	return NewRegistry(file.Clusters, opts...)
+}
+
+// Clusters returns the clusters in the registry
+func (reg *Registry) Clusters() []Cluster {
+	return append([]Cluster{}, reg.clusters...)
+}
+
+// ClusterFor returns the cluster a release is deployed to
+func (reg *Registry) ClusterFor(r store.Release) (*Cluster, error) {
+	var match *Cluster
+	ambiguous := false
+	for i, c := range reg.clusters {
+		if !r.MatchesSelector(c.Selector) {
+			continue
+		}
+		switch {
+		case match == nil || len(c.Selector) > len(match.Selector):
+			match = &reg.clusters[i]
+			ambiguous = false
+		case len(c.Selector) == len(match.Selector):
+			ambiguous = true
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("No cluster matches the labels %v of release %s", r.Labels, r.Name)
+	}
+	if ambiguous {
+		return nil, fmt.Errorf("More than one cluster matches the labels %v of release %s", r.Labels, r.Name)
+	}
+	return match, nil
+}
+
+// DeployerFor returns the Deployer for the cluster a release is deployed to
+func (reg *Registry) DeployerFor(r store.Release) (deploy.Deployer, error) {
+	c, err := reg.ClusterFor(r)
+	if err != nil {
+		return nil, err
+	}
+	return reg.deployer(c)
+}
+
+// Cluster returns the cluster with a name
+func (reg *Registry) Cluster(name string) (*Cluster, error) {
+	for i, c := range reg.clusters {
+		if c.Name == name {
+			return &reg.clusters[i], nil
+		}
+	}
+	return nil, fmt.Errorf("No cluster is named %s", name)
+}
+
+// DeployerNamed returns the Deployer for the cluster with a name
+func (reg *Registry) DeployerNamed(name string) (deploy.Deployer, error) {
+	c, err := reg.Cluster(name)
+	if err != nil {
+		return nil, err
+	}
+	return reg.deployer(c)
+}
+
+// deployer returns the Deployer for a cluster, connecting to it the first
+// time it is used. Only one connection to a cluster is made at a time, and
+// the registry isn't locked while connecting.
+func (reg *Registry) deployer(c *Cluster) (deploy.Deployer, error) {
+	reg.mu.Lock()
+	if d, ok := reg.deployers[c.Name]; ok {
+		reg.mu.Unlock()
+		return d, nil
+	}
+	connecting, ok := reg.connecting[c.Name]
+	if !ok {
+		connecting = &sync.Mutex{}
+		reg.connecting[c.Name] = connecting
+	}
+	reg.mu.Unlock()
+
+	connecting.Lock()
+	defer connecting.Unlock()
+
+	// Another caller may have connected while this one waited
+	reg.mu.Lock()
+	d, ok := reg.deployers[c.Name]
+	reg.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	d, err := reg.connect(*c)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to cluster %s: %s", c.Name, err)
+	}
+	reg.mu.Lock()
+	reg.deployers[c.Name] = d
+	reg.mu.Unlock()
+	return d, nil
+}
+
+// connectTiller connects to a cluster's Tiller
+func (reg *Registry) connectTiller(c Cluster) (deploy.Deployer, error) {
+	tlsOpts := reg.tls
+	if c.TLS != nil {
+		tlsOpts = *c.TLS
+	}
+	if len(c.TillerHost) > 0 {
+		return deploy.NewTillerTLS(c.TillerHost, tlsOpts)
+	}
+	namespace := c.TillerNamespace
+	if len(namespace) == 0 {
+		namespace = "kube-system"
+	}
+	t, err := openTunnel(c.KubeContext, namespace)
+	if err != nil {
+		return nil, err
+	}
+	d, err := deploy.NewTillerTLS(t.host, tlsOpts)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	reg.mu.Lock()
+	reg.tunnels = append(reg.tunnels, t)
+	reg.mu.Unlock()
+	return d, nil
+}
+
+// Close closes any tunnels opened to clusters
+func (reg *Registry) Close() error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	var err error
+	for _, t := range reg.tunnels {
+		if closeErr := t.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	reg.tunnels = nil
+	reg.deployers = map[string]deploy.Deployer{}
+	return err
+}
+
+// Get returns the release deployed in its cluster
+func (reg *Registry) Get(r store.Release) (*hapi_release.Release, error) {
+	d, err := reg.DeployerFor(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.Get(r)
+}
+
+// Install creates a new release in its cluster
+func (reg *Registry) Install(r store.Release, chartLocation string, opts deploy.Options) (*hapi_release.Release, error) {
+	d, err := reg.DeployerFor(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.Install(r, chartLocation, opts)
+}
+
+// Upgrade updates a release in its cluster
+func (reg *Registry) Upgrade(r store.Release, chartLocation string, opts deploy.Options) (*hapi_release.Release, error) {
+	d, err := reg.DeployerFor(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.Upgrade(r, chartLocation, opts)
+}
+
+// History returns revisions of the release in its cluster
+func (reg *Registry) History(r store.Release, max int32) ([]*hapi_release.Release, error) {
+	d, err := reg.DeployerFor(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.History(r, max)
+}
+
+// Rollback rolls the release in its cluster back to a previous revision
+func (reg *Registry) Rollback(r store.Release, version int32, opts deploy.Options) (*hapi_release.Release, error) {
+	d, err := reg.DeployerFor(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.Rollback(r, version, opts)
+}
@@ -0,0 +1,221 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/store"
+)
+
+var testClusters = []Cluster{
+	{Name: "prod", Selector: map[string]string{"environment": "prod"}, TillerHost: "prod:44134"},
+	{Name: "prod-us", Selector: map[string]string{"environment": "prod", "region": "us-west-2"}, TillerHost: "prod-us:44134"},
+	{Name: "test", Selector: map[string]string{"environment": "test"}, KubeContext: "test"},
+	{Name: "test-2", Selector: map[string]string{"environment": "test"}, KubeContext: "test-2"},
+}
+
+func TestClusterFor(t *testing.T) {
+	reg, err := NewRegistry(testClusters)
+	if err != nil {
+		t.Fatalf("Error creating registry: %s", err)
+	}
+
+	cases := []struct {
+		name    string
+		labels  map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"single match", map[string]string{"environment": "prod", "region": "eu-west-1"}, "prod", false},
+		{"most specific", map[string]string{"environment": "prod", "region": "us-west-2"}, "prod-us", false},
+		{"ambiguous", map[string]string{"environment": "test"}, "", true},
+		{"no match", map[string]string{"environment": "dev"}, "", true},
+		{"no labels", nil, "", true},
+	}
+
+	for _, c := range cases {
+		got, err := reg.ClusterFor(store.Release{Name: "prom", Labels: c.labels})
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Test '%s': Expected an error, got cluster %v", c.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%s': Unexpected error: %s", c.name, err)
+			continue
+		}
+		if got.Name != c.want {
+			t.Errorf("Test '%s': Expected cluster %s, got %s", c.name, c.want, got.Name)
+		}
+	}
+}
+
+func TestNewRegistryValidation(t *testing.T) {
+	cases := []struct {
+		name     string
+		clusters []Cluster
+	}{
+		{"no name", []Cluster{{TillerHost: "a:44134"}}},
+		{"duplicate name", []Cluster{{Name: "a", TillerHost: "a:44134"}, {Name: "a", TillerHost: "b:44134"}}},
+		{"no tiller", []Cluster{{Name: "a"}}},
+	}
+	for _, c := range cases {
+		if _, err := NewRegistry(c.clusters); err == nil {
+			t.Errorf("Test '%s': Expected an error, got nil", c.name)
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	fakes := map[string]*deploy.Fake{}
+	connects := 0
+	reg, err := NewRegistry(testClusters[:2], WithConnector(func(c Cluster) (deploy.Deployer, error) {
+		connects++
+		fakes[c.Name] = deploy.NewFake()
+		return fakes[c.Name], nil
+	}))
+	if err != nil {
+		t.Fatalf("Error creating registry: %s", err)
+	}
+
+	prod := store.Release{Name: "prom", Labels: map[string]string{"environment": "prod"}}
+	prodUS := store.Release{Name: "prom", Labels: map[string]string{"environment": "prod", "region": "us-west-2"}}
+
+	for _, r := range []store.Release{prod, prodUS, prod} {
+		if _, _, err := deploy.Upsert(reg, r, "prometheus.tgz", deploy.Options{}); err != nil {
+			t.Fatalf("Error deploying %v: %s", r.Labels, err)
+		}
+	}
+
+	if connects != 2 {
+		t.Errorf("Expected each cluster to be connected to once, got %d connections", connects)
+	}
+	if calls := len(fakes["prod"].Calls()); calls != 2 {
+		t.Errorf("Expected 2 calls to the prod cluster, got %d", calls)
+	}
+	if calls := len(fakes["prod-us"].Calls()); calls != 1 {
+		t.Errorf("Expected 1 call to the prod-us cluster, got %d", calls)
+	}
+
+	if _, err := reg.Get(store.Release{Name: "prom", Labels: map[string]string{"environment": "dev"}}); err == nil {
+		t.Errorf("Expected an error for a release matching no cluster")
+	}
+
+	if d, err := reg.DeployerNamed("prod-us"); err != nil || d != fakes["prod-us"] {
+		t.Errorf("Expected the prod-us deployer by name, got %v, %v", d, err)
+	}
+	if _, err := reg.DeployerNamed("dev"); err == nil {
+		t.Errorf("Expected an error for a missing cluster")
+	}
+}
+
+func TestConnectConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	mu := sync.Mutex{}
+	connects := map[string]int{}
+	reg, err := NewRegistry(testClusters[:2], WithConnector(func(c Cluster) (deploy.Deployer, error) {
+		mu.Lock()
+		connects[c.Name]++
+		mu.Unlock()
+		if c.Name == "prod" {
+			<-release
+		}
+		return deploy.NewFake(), nil
+	}))
+	if err != nil {
+		t.Fatalf("Error creating registry: %s", err)
+	}
+
+	prod := make(chan deploy.Deployer, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			d, _ := reg.DeployerNamed("prod")
+			prod <- d
+		}()
+	}
+
+	// A slow connection to one cluster doesn't hold up another
+	done := make(chan error, 1)
+	go func() {
+		_, err := reg.DeployerNamed("prod-us")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Error connecting to prod-us: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected prod-us to connect while prod is connecting")
+	}
+
+	close(release)
+	first, second := <-prod, <-prod
+	if first == nil || first != second {
+		t.Errorf("Expected concurrent callers to share the prod deployer, got %v and %v", first, second)
+	}
+	if connects["prod"] != 1 || connects["prod-us"] != 1 {
+		t.Errorf("Expected each cluster to be connected to once, got %v", connects)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "clusters.yaml")
+	config := `clusters:
+- name: prod-us
+  selector:
+    environment: prod
+    region: us-west-2
+  tillerHost: tiller.prod-us:44134
+- name: test
+  selector:
+    environment: test
+  kubeContext: test-cluster
+  tillerNamespace: tiller
+  tls:
+    verify: true
+    caCert: ca.pem
+    serverName: tiller-deploy
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("Error loading cluster file: %s", err)
+	}
+	clusters := reg.Clusters()
+	if len(clusters) != 2 {
+		t.Fatalf("Expected 2 clusters, got %d", len(clusters))
+	}
+	if c := clusters[0]; c.Name != "prod-us" || c.TillerHost != "tiller.prod-us:44134" || c.Selector["region"] != "us-west-2" {
+		t.Errorf("Unexpected first cluster %v", c)
+	}
+	if c := clusters[0]; c.TLS != nil {
+		t.Errorf("Expected the first cluster to use the default TLS options, got %v", c.TLS)
+	}
+	if c := clusters[1]; c.KubeContext != "test-cluster" || c.TillerNamespace != "tiller" {
+		t.Errorf("Unexpected second cluster %v", c)
+	}
+	want := deploy.TLSOptions{Verify: true, CACertFile: "ca.pem", ServerName: "tiller-deploy"}
+	if c := clusters[1]; c.TLS == nil || *c.TLS != want {
+		t.Errorf("Expected the second cluster's TLS options to be %v, got %v", want, c.TLS)
+	}
+
+	if _, err := LoadFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("Expected an error loading a missing file")
+	}
+}
@@ -0,0 +1,80 @@
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tunnelTimeout is how long to wait for kubectl to start forwarding
+const tunnelTimeout = 30 * time.Second
+
+// forwardingPattern matches kubectl's "Forwarding from 127.0.0.1:34567 -> 44134"
+var forwardingPattern = regexp.MustCompile(`Forwarding from (127\.0\.0\.1:\d+)`)
+
+// A tunnel is a kubectl port-forward to Tiller
+type tunnel struct {
+	cmd  *exec.Cmd
+	host string
+}
+
+// openTunnel port-forwards a random local port to the tiller-deploy service in
+// a kube context, and waits until the tunnel is ready
+func openTunnel(kubeContext, namespace string) (*tunnel, error) {
+	cmd := exec.Command("kubectl",
+		"--context", kubeContext,
+		"--namespace", namespace,
+		"port-forward", "service/tiller-deploy", ":44134",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Error starting kubectl port-forward: %s", err)
+	}
+
+	hosts := make(chan string, 1)
+	go func() {
+		// Keep draining stdout so kubectl never blocks logging connections
+		found := false
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if m := forwardingPattern.FindStringSubmatch(scanner.Text()); m != nil && !found {
+				found = true
+				hosts <- m[1]
+			}
+		}
+		if !found {
+			close(hosts)
+		}
+	}()
+
+	select {
+	case host, ok := <-hosts:
+		if ok {
+			return &tunnel{cmd: cmd, host: host}, nil
+		}
+		cmd.Wait()
+		return nil, fmt.Errorf("kubectl port-forward to Tiller in context %s failed: %s", kubeContext, strings.TrimSpace(stderr.String()))
+	case <-time.After(tunnelTimeout):
+		// Reap kubectl so it doesn't linger as a zombie
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("Timed out waiting for kubectl port-forward to Tiller in context %s", kubeContext)
+	}
+}
+
+// Close stops the port-forward
+func (t *tunnel) Close() error {
+	if err := t.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	t.cmd.Wait()
+	return nil
+}
@@ -20,6 +20,7 @@ type createCmdArgs struct {
 	chart     string
 	namespace string
 	version   string
+	dependsOn []string
 }
 
 var createArgs = &createCmdArgs{}
@@ -40,6 +41,8 @@ func init() {
 	f.StringVar(&createArgs.chart, "chart", "", "Chart of the release")
 	f.StringVar(&createArgs.namespace, "namespace", "default", "Namespace of the release")
 	f.StringVar(&createArgs.version, "version", "", "Version of the release")
+	f.StringArrayVar(&createArgs.dependsOn, "depends-on", []string{}, `A release this release depends on, and is installed after. Either "uuid=<id>", or "name=<name>"
+    	optionally followed by labels, like "name=alertmanager,region=us". Can be specified multiple times.`)
 
 	err := createCmd.MarkFlagRequired("chart")
 	if err != nil {
@@ -68,12 +71,17 @@ func create(cmd *cobra.Command, args []string) {
 		exitOnErr(err)
 		r.Values = string(values)
 	}
+	dependencies, err := store.ParseDependencies(createArgs.dependsOn)
+	exitOnErr(err)
+	if len(dependencies) > 0 {
+		r.Dependencies = dependencies
+	}
 	if len(createArgs.chart) == 0 {
 		exitOnErr(errors.New("No chart provided"))
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
 	defer cancel()
-	err := releaseStore.Put(ctx, r)
+	err = releaseStore.Put(ctx, r)
 	exitOnErr(err)
 	fmt.Println("Created release in release store!")
 }
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/skuid/helm-value-store/diff"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/spec"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type diffCmdArgs struct {
+	labels  spec.SelectorSet
+	name    string
+	uuid    string
+	noColor bool
+}
+
+var diffArgs = &diffCmdArgs{}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "show the differences between stored and deployed releases",
+	Long: `Compare the chart, version and values of releases in the store with the releases deployed in Tiller.
+Lines starting with "-" are deployed, and lines starting with "+" are what an install would deploy.
+Values that are secret references are not compared.`,
+	Run: diffReleases,
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+	f := diffCmd.Flags()
+	f.StringVar(&diffArgs.uuid, "uuid", "", "The UUID to diff.")
+	f.VarP(&diffArgs.labels, "label", "l", `The labels to filter by. Each label should have the format "k=v".
+    	Can be specified multiple times, or a comma-separated list.`)
+	f.StringVar(&diffArgs.name, "name", "", "The name of the release")
+	f.BoolVar(&diffArgs.noColor, "no-color", false, "Don't color the output")
+}
+
+// isTerminal reports whether f is a terminal, rather than a file or a pipe
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// diffRelease compares a stored release with the one deployed in Tiller
+func diffRelease(release store.Release) (*diff.ReleaseDiff, error) {
+	deployed, err := deployer.Get(release)
+	if store.IsNotFound(err) {
+		return diff.Missing(release), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return diff.Release(release, deployed)
+}
+
+func diffReleases(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	releases, err := findReleases(ctx, diffArgs.uuid, diffArgs.name, diffArgs.labels)
+	exitOnErr(err)
+
+	color := !diffArgs.noColor && isTerminal(os.Stdout)
+	for i, release := range releases {
+		if i > 0 {
+			fmt.Println()
+		}
+		d, err := diffRelease(release)
+		exitOnErr(err)
+		d.Fprint(os.Stdout, color)
+	}
+}
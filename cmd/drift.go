@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/skuid/helm-value-store/diff"
+	"github.com/skuid/spec"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type driftCmdArgs struct {
+	labels spec.SelectorSet
+	name   string
+	output string
+}
+
+var driftArgs = &driftCmdArgs{}
+
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "report releases that differ from what is deployed",
+	Long: `Compare every release matching the labels with the release deployed in Tiller, and report releases
+that are missing, or have a different chart, chart version or values. A release that can't be compared
+is reported with its error, and the rest are still compared. Exits with a status of 1 if any release
+has drifted, and 2 if any release couldn't be compared or the releases couldn't be listed.`,
+	// Failing to set up the store or deployer must not be reported as drift
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		errExitCode = driftErrorExitCode
+		RootCmd.PersistentPreRun(cmd, args)
+	},
+	Run: drift,
+}
+
+func init() {
+	RootCmd.AddCommand(driftCmd)
+	f := driftCmd.Flags()
+	f.VarP(&driftArgs.labels, "label", "l", `The labels to filter by. Each label should have the format "k=v".
+    	Can be specified multiple times, or a comma-separated list.`)
+	f.StringVar(&driftArgs.name, "name", "", "Filter by release name")
+	f.StringVarP(&driftArgs.output, "output", "o", "table", "The output format. Must be one of [table json]")
+}
+
+const (
+	// driftExitCode is the exit status when a release has drifted
+	driftExitCode = 1
+	// driftErrorExitCode is the exit status when a release couldn't be
+	// compared, which takes precedence over drift
+	driftErrorExitCode = 2
+)
+
+// driftResult is the comparison of one release, or the error comparing it
+type driftResult struct {
+	*diff.ReleaseDiff
+	Error string `json:"error,omitempty"`
+}
+
+func printDriftTable(results []driftResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	columns := []string{
+		"UniqueId", "Name", "Status", "Deployed Version", "Stored Version", "Changed Values", "Error",
+	}
+
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+
+	for _, d := range results {
+		status := "ok"
+		if len(d.Error) > 0 {
+			status = "error"
+		} else if !d.Empty() {
+			status = strings.Join(d.Reasons(), ",")
+		}
+		deployedVersion, storedVersion := "", ""
+		if d.Version != nil {
+			deployedVersion, storedVersion = fmt.Sprint(d.Version.Old), fmt.Sprint(d.Version.New)
+		}
+		changedValues := ""
+		if len(d.Error) == 0 {
+			changedValues = strconv.Itoa(len(d.Values))
+		}
+		columns := []string{
+			d.UniqueID,
+			d.Name,
+			status,
+			deployedVersion,
+			storedVersion,
+			changedValues,
+			d.Error,
+		}
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+	}
+	w.Flush()
+}
+
+// redactValues removes the old and new values from d's value changes, leaving
+// their paths and kinds. Deployed values include resolved secrets, and drift
+// reports are meant for CI logs.
+func redactValues(d *diff.ReleaseDiff) *diff.ReleaseDiff {
+	for i := range d.Values {
+		d.Values[i].Old, d.Values[i].New = nil, nil
+	}
+	return d
+}
+
+// exitDriftErr exits with driftErrorExitCode if err isn't nil
+func exitDriftErr(err error) {
+	if err != nil {
+		fmt.Println(err.Error())
+		exit(driftErrorExitCode)
+	}
+}
+
+func drift(cmd *cobra.Command, args []string) {
+	if driftArgs.output != "table" && driftArgs.output != "json" {
+		exitDriftErr(fmt.Errorf("Invalid output format %q. Must be one of [table json]", driftArgs.output))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	releases, err := releaseStore.List(ctx, driftArgs.labels.ToMap())
+	exitDriftErr(err)
+	if len(driftArgs.name) > 0 {
+		releases = filterByName(releases, driftArgs.name)
+	}
+
+	results := []driftResult{}
+	drifted, failed := 0, 0
+	for _, release := range releases {
+		d, err := diffRelease(release)
+		if err != nil {
+			failed++
+			d = &diff.ReleaseDiff{UniqueID: release.UniqueID, Name: release.Name, Values: []diff.Change{}}
+			results = append(results, driftResult{ReleaseDiff: d, Error: err.Error()})
+			continue
+		}
+		if !d.Empty() {
+			drifted++
+		}
+		results = append(results, driftResult{ReleaseDiff: redactValues(d)})
+	}
+
+	if driftArgs.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		exitDriftErr(enc.Encode(results))
+	} else {
+		printDriftTable(results)
+		fmt.Printf("\n%d of %d releases have drifted", drifted, len(results))
+		if failed > 0 {
+			fmt.Printf(", and %d couldn't be compared", failed)
+		}
+		fmt.Println()
+	}
+
+	switch {
+	case failed > 0:
+		exit(driftErrorExitCode)
+	case drifted > 0:
+		exit(driftExitCode)
+	}
+}
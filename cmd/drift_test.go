@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/diff"
+	"github.com/spf13/viper"
+)
+
+func TestDriftSetupErrorExitCode(t *testing.T) {
+	oldExit, oldCode, oldBackend := exit, errExitCode, viper.Get("backend")
+	defer func() {
+		exit, errExitCode = oldExit, oldCode
+		viper.Set("backend", oldBackend)
+	}()
+
+	// A store that can't be set up is an error, not drift
+	viper.Set("backend", "missing")
+	code := 0
+	exit = func(c int) {
+		code = c
+		panic("exit")
+	}
+	func() {
+		defer func() { recover() }()
+		driftCmd.PersistentPreRun(driftCmd, nil)
+	}()
+
+	if code != driftErrorExitCode {
+		t.Errorf("Expected drift to exit with %d when setup fails, got %d", driftErrorExitCode, code)
+	}
+}
+
+func TestRedactValues(t *testing.T) {
+	d := &diff.ReleaseDiff{
+		Version: &diff.Change{Path: "version", Kind: diff.Changed, Old: "0.1.0", New: "0.1.1"},
+		Values: []diff.Change{
+			{Path: "password", Kind: diff.Removed, Old: "hunter2"},
+			{Path: "db.password", Kind: diff.Changed, Old: "old-secret", New: "new-secret"},
+		},
+	}
+	redactValues(d)
+
+	want := []diff.Change{{Path: "password", Kind: diff.Removed}, {Path: "db.password", Kind: diff.Changed}}
+	if !reflect.DeepEqual(d.Values, want) {
+		t.Errorf("Expected only the paths and kinds of values, got %v", d.Values)
+	}
+	if d.Version.Old != "0.1.0" || d.Version.New != "0.1.1" {
+		t.Errorf("Expected the chart version to be kept, got %v", d.Version)
+	}
+}
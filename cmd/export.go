@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/skuid/helm-value-store/tree"
+	"github.com/skuid/spec"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type exportCmdArgs struct {
+	dir    string
+	labels spec.SelectorSet
+}
+
+var exportArgs = exportCmdArgs{}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export releases to a directory of values files",
+	Long: `Write each release to <dir>/<labels>/<name>, as a release.yaml with its unique ID, chart, version,
+labels and dependencies and a values.yaml with its values. Releases in the directory that match --label
+but are no longer in the store are removed. Use "import --dir" to load the directory back into the store.`,
+	Run: export,
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+	f := exportCmd.Flags()
+	f.StringVar(&exportArgs.dir, "dir", "", "The directory to export releases to")
+	f.VarP(&exportArgs.labels, "label", "l", `The labels to filter by. Each label should have the format "k=v".
+		Can be specified multiple times, or a comma-separated list.`)
+}
+
+func export(cmd *cobra.Command, args []string) {
+	if len(exportArgs.dir) == 0 {
+		exitOnErr(errors.New("Must supply --dir"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	selector := exportArgs.labels.ToMap()
+	releases, err := releaseStore.List(ctx, selector)
+	exitOnErr(err)
+
+	exitOnErr(tree.Write(exportArgs.dir, releases, selector))
+	fmt.Printf("Exported %d releases to %s\n", len(releases), exportArgs.dir)
+}
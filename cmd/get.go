@@ -40,32 +40,42 @@ func hasReleases(releases store.Releases, message string) {
 	}
 }
 
-func get(cmd *cobra.Command, args []string) {
-	var err error
-	releases := store.Releases{}
+// findReleases returns the release with a UUID, or the releases matching a
+// name and labels
+func findReleases(ctx context.Context, uuid, name string, labels spec.SelectorSet) (store.Releases, error) {
+	if len(uuid) > 0 {
+		release, err := releaseStore.Get(ctx, uuid)
+		if err != nil {
+			return nil, err
+		}
+		return store.Releases{*release}, nil
+	}
+	if len(name) == 0 && len(labels) == 0 {
+		return nil, errors.New("Must supply a UUID, release name, or labels")
+	}
 
+	releases, err := releaseStore.List(ctx, labels.ToMap())
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		return nil, errors.New("No releases match those labels!")
+	}
+	if len(name) > 0 {
+		releases = filterByName(releases, name)
+	}
+	if len(releases) == 0 {
+		return nil, errors.New("No releases match that name and those labels")
+	}
+	return releases, nil
+}
+
+func get(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
 	defer cancel()
 
-	if len(getArgs.uuid) > 0 {
-		release, err := releaseStore.Get(ctx, getArgs.uuid)
-		exitOnErr(err)
-		releases = append(releases, *release)
-
-	} else if len(getArgs.name) > 0 || len(getArgs.labels) > 0 {
-		releases, err = releaseStore.List(ctx, getArgs.labels.ToMap())
-		exitOnErr(err)
-
-		hasReleases(releases, "No releases match those labels!")
-
-		if len(getArgs.name) > 0 {
-			releases = filterByName(releases, getArgs.name)
-		}
-		hasReleases(releases, "No releases match that name and those labels")
-
-	} else {
-		exitOnErr(errors.New("Must supply a UUID, release name, or labels"))
-	}
+	releases, err := findReleases(ctx, getArgs.uuid, getArgs.name, getArgs.labels)
+	exitOnErr(err)
 
 	for i, release := range releases {
 		if i > 0 && i <= len(releases)-1 {
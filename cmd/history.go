@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type historyCmdArgs struct {
+	uuid     string
+	revision int64
+}
+
+var historyArgs = &historyCmdArgs{}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "list the stored revisions of a release",
+	Long:  "List every stored revision of a release, or print the values of a single revision.",
+	Run:   history,
+}
+
+func init() {
+	RootCmd.AddCommand(historyCmd)
+	f := historyCmd.Flags()
+	f.StringVar(&historyArgs.uuid, "uuid", "", "The UUID of the release")
+	f.Int64Var(&historyArgs.revision, "revision", 0, "Print the values of this revision instead of listing all revisions")
+
+	historyCmd.MarkFlagRequired("uuid")
+}
+
+// findRevision returns the revision of a release from its history
+func findRevision(history store.Releases, uniqueID string, revision int64) (*store.Release, error) {
+	for _, r := range history {
+		if r.Revision == revision {
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("Release %s has no revision %d", uniqueID, revision)
+}
+
+func history(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	if len(historyArgs.uuid) == 0 {
+		exitOnErr(errors.New("Must supply a UUID"))
+	}
+	releases, err := releaseStore.History(ctx, historyArgs.uuid)
+	exitOnErr(err)
+	hasReleases(releases, fmt.Sprintf("No history for release %s", historyArgs.uuid))
+
+	if historyArgs.revision > 0 {
+		release, err := findRevision(releases, historyArgs.uuid, historyArgs.revision)
+		exitOnErr(err)
+		fmt.Printf("# %s: %s, revision %d, %s\n", release.Name, release.UniqueID, release.Revision, release.Labels)
+		fmt.Print(release.Values)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	columns := []string{
+		"Revision", "Name", "Namespace", "Chart", "Version", "Labels", "Values",
+	}
+
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+
+	for _, release := range releases {
+		columns := []string{
+			strconv.FormatInt(release.Revision, 10),
+			release.Name,
+			release.Namespace,
+			release.Chart,
+			release.Version,
+			fmt.Sprintf("%s", release.Labels),
+			bytefmt.ByteSize(uint64(len(release.Values))),
+		}
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+	}
+	w.Flush()
+}
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+	"github.com/skuid/helm-value-store/cluster"
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/helm-value-store/tree"
+	"github.com/skuid/spec"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type importCmdArgs struct {
+	labels    spec.SelectorSet
+	cluster   string
+	repo      string
+	namespace string
+	dryRun    bool
+	dir       string
+	prune     bool
+}
+
+var importArgs = importCmdArgs{}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import releases deployed by Tiller, or exported to a directory, into the release store",
+	Long: `Create a release in the release store for every release deployed by Tiller, with its chart,
+version, namespace and the values it was deployed with, and the labels given with --label.
+Releases already in the store with the same name and namespace, in the same cluster, are skipped.
+With --cluster-file, --cluster picks the cluster to import from, and its selector is added to the labels.
+
+With --dir, the store is instead made to match a directory written by "export": releases in the
+directory are created or updated, and with --prune, stored releases that aren't in the directory are
+deleted. Only releases matching --label, in the store or in the directory, are changed.`,
+	Run: importReleases,
+}
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+	f := importCmd.Flags()
+	f.VarP(&importArgs.labels, "label", "l", `The labels to apply to imported releases. Each label should have the format "k=v".
+		Can be specified multiple times, or a comma-separated list.`)
+	f.StringVar(&importArgs.cluster, "cluster", "", "The cluster in --cluster-file to import releases from")
+	f.StringVar(&importArgs.repo, "repo", "stable", "The chart repository to prefix chart names with, since Tiller doesn't record it")
+	f.StringVar(&importArgs.namespace, "namespace", "", "Only import releases in this namespace")
+	f.BoolVar(&importArgs.dryRun, "dry-run", false, "Show what would be imported without changing the release store")
+	f.StringVar(&importArgs.dir, "dir", "", "Import the releases in a directory written by export, instead of from Tiller")
+	f.BoolVar(&importArgs.prune, "prune", false, "With --dir, delete stored releases matching --label that aren't in the directory")
+}
+
+// importLister returns the Tiller to import releases from, and the labels to
+// apply to them
+func importLister() (deploy.Lister, map[string]string, error) {
+	labels := importArgs.labels.ToMap()
+	d := deployer
+
+	if registry, ok := deployer.(*cluster.Registry); ok {
+		if len(importArgs.cluster) == 0 {
+			return nil, nil, errors.New("Must supply --cluster to import from when using a cluster file")
+		}
+		c, err := registry.Cluster(importArgs.cluster)
+		if err != nil {
+			return nil, nil, err
+		}
+		if d, err = registry.DeployerNamed(c.Name); err != nil {
+			return nil, nil, err
+		}
+		// Imported releases must be routed back to the cluster they came from
+		merged := map[string]string{}
+		for k, v := range c.Selector {
+			merged[k] = v
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		labels = merged
+	} else if len(importArgs.cluster) > 0 {
+		return nil, nil, errors.New("--cluster requires --cluster-file")
+	}
+
+	lister, ok := d.(deploy.Lister)
+	if !ok {
+		return nil, nil, errors.New("The deployer can't list releases")
+	}
+	return lister, labels, nil
+}
+
+func importReleases(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	if len(importArgs.dir) > 0 {
+		importDir(ctx)
+		return
+	}
+
+	lister, labels, err := importLister()
+	exitOnErr(err)
+
+	deployed, err := lister.List()
+	exitOnErr(err)
+
+	// A release is already stored if any release with its name and namespace
+	// is routed to the same cluster, whatever its other labels
+	stored, err := releaseStore.List(ctx, nil)
+	exitOnErr(err)
+	existing := map[string]string{}
+	for _, r := range stored {
+		existing[importKey(r)] = r.UniqueID
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join([]string{"UniqueId", "Name", "Namespace", "Chart", "Version", "Result"}, "\t"))
+
+	imported := 0
+	for _, rel := range deployed {
+		if len(importArgs.namespace) > 0 && rel.Namespace != importArgs.namespace {
+			continue
+		}
+
+		// Each release gets its own labels, so changing one can't change
+		// the others
+		releaseLabels := map[string]string{}
+		for k, v := range labels {
+			releaseLabels[k] = v
+		}
+		r := deploy.Imported(rel, importArgs.repo, releaseLabels)
+		result := "skipped"
+		if id, ok := existing[importKey(r)]; ok {
+			r.UniqueID = id
+		} else {
+			r.UniqueID = uuid.New().String()
+			result = "imported"
+			if !importArgs.dryRun {
+				exitOnErr(releaseStore.Put(ctx, r))
+			}
+			existing[importKey(r)] = r.UniqueID
+			imported++
+		}
+		fmt.Fprintln(w, strings.Join([]string{r.UniqueID, r.Name, r.Namespace, r.Chart, r.Version, result}, "\t"))
+	}
+	w.Flush()
+
+	if importArgs.dryRun {
+		fmt.Printf("\nWould import %d releases\n", imported)
+		return
+	}
+	fmt.Printf("\nImported %d releases\n", imported)
+}
+
+// importKey identifies a release by its cluster, namespace and name. Without a
+// cluster file, every release is in the same cluster.
+func importKey(r store.Release) string {
+	clusterName := ""
+	if registry, ok := deployer.(*cluster.Registry); ok {
+		if c, err := registry.ClusterFor(r); err == nil {
+			clusterName = c.Name
+		}
+	}
+	return clusterName + "/" + r.Namespace + "/" + r.Name
+}
+
+// importDir makes the releases in the store that match the labels the same as
+// the ones in the directory
+func importDir(ctx context.Context) {
+	selector := importArgs.labels.ToMap()
+
+	desired, err := tree.Read(importArgs.dir)
+	exitOnErr(err)
+	// The whole store is compared, so releases moved in or out of the
+	// selector are matched by their unique ID
+	stored, err := releaseStore.List(ctx, nil)
+	exitOnErr(err)
+	plan := tree.NewPlan(stored, desired, selector)
+
+	deleteAction := "delete"
+	if !importArgs.prune {
+		deleteAction = "not in directory"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join([]string{"UniqueId", "Name", "Chart", "Version", "Action"}, "\t"))
+	for _, change := range []struct {
+		action   string
+		releases store.Releases
+	}{{"create", plan.Create}, {"update", plan.Update}, {deleteAction, plan.Delete}} {
+		for _, r := range change.releases {
+			fmt.Fprintln(w, strings.Join([]string{r.UniqueID, r.Name, r.Chart, r.Version, change.action}, "\t"))
+		}
+	}
+	w.Flush()
+
+	summary := fmt.Sprintf("%d to create, %d to update and %d to delete", len(plan.Create), len(plan.Update), len(plan.Delete))
+	if !importArgs.prune {
+		summary = fmt.Sprintf("%d to create and %d to update. %d stored releases aren't in the directory, use --prune to delete them",
+			len(plan.Create), len(plan.Update), len(plan.Delete))
+		plan.Delete = nil
+	}
+	if importArgs.dryRun || plan.Empty() {
+		fmt.Printf("\n%s\n", summary)
+		return
+	}
+
+	for _, r := range plan.Create {
+		// A Revision of 0 fails if the release was created in the meantime
+		exitOnErr(releaseStore.ConditionalPut(ctx, r))
+	}
+	for _, r := range plan.Update {
+		err := releaseStore.ConditionalPut(ctx, r)
+		if store.IsConflict(err) {
+			exitOnErr(fmt.Errorf("Release %s was changed by someone else during the import, retry the import", r.UniqueID))
+		}
+		exitOnErr(err)
+	}
+	for _, r := range plan.Delete {
+		exitOnErr(releaseStore.Delete(ctx, r.UniqueID))
+	}
+	fmt.Printf("\nCreated %d, updated %d and deleted %d releases\n", len(plan.Create), len(plan.Update), len(plan.Delete))
+}
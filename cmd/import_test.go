@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/skuid/helm-value-store/cluster"
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/memory"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/spf13/viper"
+)
+
+func TestImportSkipsStoredReleases(t *testing.T) {
+	clusters := []cluster.Cluster{
+		{Name: "prod", Selector: map[string]string{"environment": "prod"}, TillerHost: "prod:44134"},
+		{Name: "test", Selector: map[string]string{"environment": "test"}, TillerHost: "test:44134"},
+	}
+
+	cases := []struct {
+		name    string
+		cluster string
+		stored  store.Release
+		want    []string
+	}{
+		{
+			"stored with other labels",
+			"",
+			store.Release{UniqueID: "1", Name: "a", Namespace: "default", Chart: "stable/a", Labels: map[string]string{"team": "web"}},
+			[]string{"a", "b"},
+		},
+		{
+			"stored in another namespace",
+			"",
+			store.Release{UniqueID: "1", Name: "a", Namespace: "kube-system", Chart: "stable/a"},
+			[]string{"a", "a", "b"},
+		},
+		{
+			"stored in the same cluster",
+			"prod",
+			store.Release{UniqueID: "1", Name: "a", Namespace: "default", Chart: "stable/a", Labels: map[string]string{"environment": "prod", "team": "web"}},
+			[]string{"a", "b"},
+		},
+		{
+			"stored in another cluster",
+			"prod",
+			store.Release{UniqueID: "1", Name: "a", Namespace: "default", Chart: "stable/a", Labels: map[string]string{"environment": "test"}},
+			[]string{"a", "a", "b"},
+		},
+	}
+
+	oldStore, oldDeployer, oldArgs := releaseStore, deployer, importArgs
+	defer func() {
+		releaseStore, deployer, importArgs = oldStore, oldDeployer, oldArgs
+	}()
+	viper.Set("timeout", time.Minute)
+
+	for _, c := range cases {
+		fake := deploy.NewFake()
+		for _, name := range []string{"a", "b"} {
+			r := store.Release{Name: name, Namespace: "default", Chart: "stable/" + name}
+			if _, err := fake.Install(r, name+".tgz", deploy.Options{}); err != nil {
+				t.Fatalf("Test '%s': Error deploying %s: %s", c.name, name, err)
+			}
+		}
+		deployer = fake
+		if len(c.cluster) > 0 {
+			registry, err := cluster.NewRegistry(clusters, cluster.WithConnector(func(cluster.Cluster) (deploy.Deployer, error) {
+				return fake, nil
+			}))
+			if err != nil {
+				t.Fatalf("Test '%s': Error creating registry: %s", c.name, err)
+			}
+			deployer = registry
+		}
+
+		releaseStore = memory.NewReleaseStore()
+		if err := releaseStore.Put(context.Background(), c.stored); err != nil {
+			t.Fatalf("Test '%s': Error storing release: %s", c.name, err)
+		}
+		importArgs = importCmdArgs{repo: "stable", cluster: c.cluster}
+		importArgs.labels.Set("owner=platform")
+
+		importReleases(nil, nil)
+
+		releases, err := releaseStore.List(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("Test '%s': Error listing releases: %s", c.name, err)
+		}
+		names := []string{}
+		for _, r := range releases {
+			names = append(names, r.Name)
+			if r.UniqueID != c.stored.UniqueID && r.Labels["owner"] != "platform" {
+				t.Errorf("Test '%s': Expected imported release %s to have the import labels, got %v", c.name, r.Name, r.Labels)
+			}
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, c.want) {
+			t.Errorf("Test '%s': Expected releases %v, got %v", c.name, c.want, names)
+		}
+	}
+}
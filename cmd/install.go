@@ -1,10 +1,20 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/refs"
 	"github.com/skuid/helm-value-store/store"
 	"github.com/skuid/spec"
 	"github.com/spf13/cobra"
@@ -19,6 +29,10 @@ type installCmdArgs struct {
 
 	uuid string
 	name string
+
+	parallelism      int
+	continueOnError  bool
+	skipDependencies bool
 }
 
 var installArgs = installCmdArgs{}
@@ -26,8 +40,12 @@ var installArgs = installCmdArgs{}
 var installCmd = &cobra.Command{
 	Use:   "install",
 	Short: "install or upgrade a release",
-	Long:  "Install a release in the cluster and use the values from the value store",
-	Run:   install,
+	Long: `Install a release in the cluster and use the values from the value store.
+With only --label, every release matching the labels is installed or upgraded.
+Releases are installed after the releases they depend on, and a release's dependencies are
+installed along with it unless --skip-dependencies is set.
+A release that is being installed or applied by someone else fails to install.`,
+	Run: install,
 }
 
 func init() {
@@ -40,7 +58,12 @@ func init() {
 	f.StringVar(&installArgs.uuid, "uuid", "", "The UUID to install. Takes precedence over --name")
 	f.StringVar(&installArgs.name, "name", "", `The name of the release to install. If multiple releases of the same name are found,
 		the install will fail. Use selectors to pair down releases`)
-	f.StringArrayVar(&installArgs.values, "set", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	f.StringArrayVar(&installArgs.values, "set", []string{}, `set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2).
+		Only applied to the release installed with --uuid or --name, not to its dependencies`)
+	f.IntVar(&installArgs.parallelism, "parallelism", 1, "The number of releases to install at once when installing all releases matching --label")
+	f.BoolVar(&installArgs.continueOnError, "continue-on-error", false, `Keep installing the remaining releases matching --label after one fails.
+		By default no more releases are started after the first failure`)
+	f.BoolVar(&installArgs.skipDependencies, "skip-dependencies", false, "Don't install the releases that a release installed with --uuid or --name depends on")
 }
 
 func releasesByName(name string, releases store.Releases) (release store.Releases) {
@@ -53,6 +76,205 @@ func releasesByName(name string, releases store.Releases) (release store.Release
 	return response
 }
 
+// installResult is the outcome of installing one release
+type installResult struct {
+	release store.Release
+	// action is "installed", "upgraded", "failed" or "skipped"
+	action string
+	err    error
+}
+
+// downloadChart downloads a release's chart, writing any messages about the
+// download to out
+var downloadChart = func(r store.Release, out io.Writer) (string, error) {
+	return r.DownloadWithOutput(out)
+}
+
+// installRelease installs a release if it isn't deployed, and upgrades it
+// otherwise. Unless it's a dry run, a lease is held on the release while it
+// is installed, so that it can't be installed by anyone else at the same time.
+// Progress is written to out.
+func installRelease(ctx context.Context, release store.Release, out io.Writer) installResult {
+	result := installResult{release: release, action: "failed"}
+
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("timeout"))
+	defer cancel()
+
+	if !installArgs.dryRun {
+		ttl := time.Duration(installArgs.timeout)*time.Second + store.LockMargin
+		lease, err := releaseStore.Lock(ctx, release.UniqueID, store.LockOwner(), ttl)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		defer func() {
+			// A lease that isn't released only blocks others until it expires
+			if err := releaseStore.Unlock(context.Background(), *lease); err != nil {
+				fmt.Fprintf(os.Stderr, "Error unlocking release %s: %s\n", release.UniqueID, err)
+			}
+		}()
+	}
+
+	_, getErr := deployer.Get(release)
+	if getErr != nil && !store.IsNotFound(getErr) {
+		result.err = getErr
+		return result
+	}
+
+	// References are only resolved for the install itself, and never written
+	// back to the store
+	values, err := refs.DefaultRegistry().ResolveValues(ctx, release.Values)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	release.Values = values
+
+	dlLocation, err := downloadChart(release, out)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	fmt.Fprintf(out, "Fetched chart %s to %s\n", release.Chart, dlLocation)
+
+	opts := deploy.Options{DryRun: installArgs.dryRun, Timeout: installArgs.timeout}
+	if store.IsNotFound(getErr) {
+		// Install
+		fmt.Fprintf(out, "Installing Release %s\n", release)
+
+		if _, err := deployer.Install(release, dlLocation, opts); err != nil {
+			result.err = err
+			return result
+		}
+		fmt.Fprintf(out, "Successfully installed release %s!\n", release.Name)
+		result.action = "installed"
+	} else {
+		// Update
+		fmt.Fprintf(out, "Updating Release %s\n", release)
+		if _, err := deployer.Upgrade(release, dlLocation, opts); err != nil {
+			result.err = err
+			return result
+		}
+		fmt.Fprintf(out, "Successfully upgraded release %s!\n", release.Name)
+		result.action = "upgraded"
+	}
+	return result
+}
+
+// prefixWriter writes whole lines to w, each with a prefix, holding mu while
+// it writes. Releases installed at the same time share mu, so their output
+// doesn't interleave.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes any partial line left over
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append(p.buf, '\n')
+	p.buf = nil
+	return p.writeLine(line)
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s%s", p.prefix, line)
+	return err
+}
+
+// installAll installs releases with up to parallelism installs at once. Unless
+// continueOnError is set, releases that haven't started when an install fails
+// are skipped. Results are returned in the same order as releases, and
+// progress is called as each release finishes. Each release's output is
+// written to out a line at a time, prefixed with its name.
+func installAll(ctx context.Context, releases store.Releases, parallelism int, continueOnError bool, out io.Writer, progress func(installResult)) []installResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results := make([]installResult, len(releases))
+	sem := make(chan struct{}, parallelism)
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	failed := false
+
+	for i, release := range releases {
+		sem <- struct{}{}
+
+		mu.Lock()
+		skip := failed && !continueOnError
+		mu.Unlock()
+		if skip {
+			<-sem
+			results[i] = installResult{release: release, action: "skipped"}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, release store.Release) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			w := &prefixWriter{mu: &mu, w: out, prefix: fmt.Sprintf("[%s] ", release.Name)}
+			result := installRelease(ctx, release, w)
+			w.Flush()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if result.err != nil {
+				failed = true
+			}
+			results[i] = result
+			progress(result)
+		}(i, release)
+	}
+	wg.Wait()
+	return results
+}
+
+func printInstallSummary(results []installResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	columns := []string{
+		"UniqueId", "Name", "Result", "Error",
+	}
+
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+
+	for _, result := range results {
+		errMsg := ""
+		if result.err != nil {
+			errMsg = result.err.Error()
+		}
+		columns := []string{
+			result.release.UniqueID,
+			result.release.Name,
+			result.action,
+			errMsg,
+		}
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+	}
+	w.Flush()
+}
+
 func install(cmd *cobra.Command, args []string) {
 	var err error
 	release := &store.Release{}
@@ -74,37 +296,117 @@ func install(cmd *cobra.Command, args []string) {
 			exitOnErr(fmt.Errorf("No releases by the name: %s", installArgs.name))
 		}
 		release = &matches[0]
+	} else if len(installArgs.labels) > 0 {
+		if len(installArgs.values) > 0 {
+			exitOnErr(errors.New("--set can only be used to install a single release with --uuid or --name"))
+		}
+		releases, err := releaseStore.List(ctx, installArgs.labels.ToMap())
+		exitOnErr(err)
+		hasReleases(releases, "No releases match those labels!")
+		all, err := releaseStore.List(ctx, map[string]string{})
+		exitOnErr(err)
+		exitOnErr(store.CheckDependencies(all, releases))
+		// Each release gets its own timeout, rather than sharing this one
+		installBulk(context.Background(), releases)
+		return
 	} else {
-		exitOnErr(fmt.Errorf("No release specified! Use %s or %s", "--name", "--uuid"))
+		exitOnErr(fmt.Errorf("No release specified! Use %s, %s or %s", "--name", "--uuid", "--label"))
 	}
-	_, getErr := release.Get()
 
-	if getErr != nil && !strings.Contains(getErr.Error(), "not found") {
-		exitOnErr(err)
+	// Values set on the command line are only for the requested release, not
+	// the releases it depends on
+	if len(installArgs.values) > 0 {
+		exitOnErr(release.MergeValues(installArgs.values))
 	}
 
-	if len(installArgs.values) > 0 {
-		err := release.MergeValues(installArgs.values)
+	if !installArgs.skipDependencies {
+		all, err := releaseStore.List(ctx, map[string]string{})
 		exitOnErr(err)
+		upstream := store.Upstream(all, *release)
+		exitOnErr(store.CheckDependencies(all, append(upstream, *release)))
+		if len(upstream) > 0 {
+			fmt.Printf("Release %s depends on %d other releases, installing them first\n", release.Name, len(upstream))
+			installBulk(context.Background(), append(upstream, *release))
+			return
+		}
 	}
 
-	dlLocation, err := release.Download()
-	exitOnErr(err)
-	fmt.Printf("Fetched chart %s to %s\n", release.Chart, dlLocation)
+	result := installRelease(ctx, *release, os.Stdout)
+	exitOnErr(result.err)
+}
 
-	if getErr != nil && strings.Contains(getErr.Error(), "not found") {
-		// Install
-		fmt.Printf("Installing Release %s\n", release)
+// dependsOnFailed reports whether r depends on a release in releases that
+// failed or was skipped
+func dependsOnFailed(r store.Release, releases store.Releases, failed map[string]bool) bool {
+	for _, upstream := range releases {
+		if failed[upstream.UniqueID] && r.DependsOn(upstream) {
+			return true
+		}
+	}
+	return false
+}
 
-		response, err := release.Install(dlLocation, installArgs.dryRun, installArgs.timeout)
-		exitOnErr(err)
-		fmt.Printf("Successfully installed release %s!\n", response.Release.Name)
-	} else if getErr == nil {
-		// Update
-		fmt.Printf("Updating Release %s\n", release)
-		response, err := release.Upgrade(dlLocation, installArgs.dryRun, installArgs.timeout)
-		exitOnErr(err)
-		fmt.Printf("Successfully upgraded release %s!\n", response.Release.Name)
+// installLevels installs each level of releases in turn with installAll, only
+// starting a level once the one before it is done. Releases that depend on a
+// release that failed or was skipped are skipped too, and unless
+// continueOnError is set, so is every release after the first failure.
+func installLevels(ctx context.Context, releases store.Releases, levels []store.Releases, parallelism int, continueOnError bool, out io.Writer, progress func(installResult)) []installResult {
+	results := []installResult{}
+	failed := map[string]bool{}
+	for _, level := range levels {
+		ready := store.Releases{}
+		for _, r := range level {
+			if (len(failed) > 0 && !continueOnError) || dependsOnFailed(r, releases, failed) {
+				failed[r.UniqueID] = true
+				results = append(results, installResult{release: r, action: "skipped"})
+				continue
+			}
+			ready = append(ready, r)
+		}
+
+		for _, result := range installAll(ctx, ready, parallelism, continueOnError, out, progress) {
+			if result.err != nil || result.action == "skipped" {
+				failed[result.release.UniqueID] = true
+			}
+			results = append(results, result)
+		}
 	}
+	return results
+}
 
+func installBulk(ctx context.Context, releases store.Releases) {
+	// Install in a stable order, so that runs are repeatable
+	sort.SliceStable(releases, func(i, j int) bool {
+		if releases[i].Name != releases[j].Name {
+			return releases[i].Name < releases[j].Name
+		}
+		return releases[i].UniqueID < releases[j].UniqueID
+	})
+
+	levels, err := store.Levels(releases)
+	exitOnErr(err)
+
+	fmt.Printf("Installing %d releases in %d stages, %d at a time\n", len(releases), len(levels), installArgs.parallelism)
+	done := 0
+	progress := func(result installResult) {
+		done++
+		if result.err != nil {
+			fmt.Printf("[%d/%d] Failed to install %s (%s): %s\n", done, len(releases), result.release.Name, result.release.UniqueID, result.err)
+			return
+		}
+		fmt.Printf("[%d/%d] %s %s (%s)\n", done, len(releases), strings.Title(result.action), result.release.Name, result.release.UniqueID)
+	}
+	results := installLevels(ctx, releases, levels, installArgs.parallelism, installArgs.continueOnError, os.Stdout, progress)
+
+	fmt.Println()
+	printInstallSummary(results)
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.action]++
+	}
+	fmt.Printf("\n%d installed, %d upgraded, %d failed, %d skipped\n", counts["installed"], counts["upgraded"], counts["failed"], counts["skipped"])
+	if counts["failed"] > 0 {
+		exitOnErr(errors.New("Some releases failed to install"))
+	}
 }
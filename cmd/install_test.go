@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/memory"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/spf13/viper"
+)
+
+// fakeInstalls replaces the release store, deployer and chart downloads used
+// by installRelease. Downloads wait until `concurrent` of them are running
+// at once, or a short time has passed, and the most seen at once is recorded.
+type fakeInstalls struct {
+	deployer *deploy.Fake
+
+	mu         sync.Mutex
+	concurrent int
+	running    int
+	maxRunning int
+	arrived    chan struct{}
+	once       sync.Once
+}
+
+func newFakeInstalls(concurrent int) (*fakeInstalls, func()) {
+	f := &fakeInstalls{deployer: deploy.NewFake(), concurrent: concurrent, arrived: make(chan struct{})}
+
+	oldStore, oldDeployer, oldDownload, oldArgs := releaseStore, deployer, downloadChart, installArgs
+	releaseStore = memory.NewReleaseStore()
+	deployer = f.deployer
+	downloadChart = f.download
+	installArgs = installCmdArgs{timeout: 300}
+	viper.Set("timeout", time.Minute)
+
+	return f, func() {
+		releaseStore, deployer, downloadChart, installArgs = oldStore, oldDeployer, oldDownload, oldArgs
+	}
+}
+
+func (f *fakeInstalls) download(r store.Release, out io.Writer) (string, error) {
+	f.mu.Lock()
+	f.running++
+	if f.running > f.maxRunning {
+		f.maxRunning = f.running
+	}
+	if f.running == f.concurrent {
+		f.once.Do(func() { close(f.arrived) })
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-f.arrived:
+	case <-time.After(100 * time.Millisecond):
+	}
+	fmt.Fprintf(out, "downloading %s\n", r.Chart)
+
+	f.mu.Lock()
+	f.running--
+	f.mu.Unlock()
+	return r.Chart + ".tgz", nil
+}
+
+func installActions(results []installResult) []string {
+	actions := []string{}
+	for _, result := range results {
+		actions = append(actions, result.release.Name+":"+result.action)
+	}
+	return actions
+}
+
+func TestInstallLevels(t *testing.T) {
+	independent := store.Releases{
+		{UniqueID: "a", Name: "a", Chart: "stable/a"},
+		{UniqueID: "b", Name: "b", Chart: "stable/b"},
+		{UniqueID: "c", Name: "c", Chart: "stable/c"},
+	}
+	dependent := store.Releases{
+		{UniqueID: "a", Name: "a", Chart: "stable/a"},
+		{UniqueID: "b", Name: "b", Chart: "stable/b", Dependencies: []store.Dependency{{UniqueID: "a"}}},
+		{UniqueID: "c", Name: "c", Chart: "stable/c"},
+	}
+
+	cases := []struct {
+		name            string
+		releases        store.Releases
+		parallelism     int
+		continueOnError bool
+		failing         []string
+		want            []string
+		wantMaxRunning  int
+	}{
+		{"one at a time", independent, 1, false, nil, []string{"a:installed", "b:installed", "c:installed"}, 1},
+		{"in parallel", independent, 3, false, nil, []string{"a:installed", "b:installed", "c:installed"}, 3},
+		{"fail fast", independent, 1, false, []string{"b"}, []string{"a:installed", "b:failed", "c:skipped"}, 1},
+		{"continue on error", independent, 1, true, []string{"b"}, []string{"a:installed", "b:failed", "c:installed"}, 1},
+		{"dependencies first", dependent, 3, false, nil, []string{"a:installed", "c:installed", "b:installed"}, 2},
+		{"skips dependents of failures", dependent, 3, true, []string{"a"}, []string{"a:failed", "c:installed", "b:skipped"}, 2},
+		{"fail fast skips later levels", dependent, 3, false, []string{"c"}, []string{"a:installed", "c:failed", "b:skipped"}, 2},
+	}
+
+	for _, c := range cases {
+		f, restore := newFakeInstalls(c.wantMaxRunning)
+		for _, name := range c.failing {
+			f.deployer.Errors[name] = errors.New("boom")
+		}
+
+		levels, err := store.Levels(c.releases)
+		if err != nil {
+			t.Fatalf("Test '%s': Error ordering releases: %s", c.name, err)
+		}
+		progressed := 0
+		results := installLevels(context.Background(), c.releases, levels, c.parallelism, c.continueOnError, &bytes.Buffer{}, func(installResult) {
+			progressed++
+		})
+		rs := releaseStore
+		restore()
+
+		if got := installActions(results); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Test '%s': Expected %v, got %v", c.name, c.want, got)
+		}
+		if f.maxRunning != c.wantMaxRunning {
+			t.Errorf("Test '%s': Expected at most %d installs at once, got %d", c.name, c.wantMaxRunning, f.maxRunning)
+		}
+		ran := 0
+		for _, result := range results {
+			if result.action != "skipped" {
+				ran++
+			}
+		}
+		if progressed != ran {
+			t.Errorf("Test '%s': Expected progress for the %d releases that ran, got %d", c.name, ran, progressed)
+		}
+		if calls := len(f.deployer.Calls()); calls != ran {
+			t.Errorf("Test '%s': Expected %d deploys, got %d", c.name, ran, calls)
+		}
+		// Leases are released once each install is done
+		for _, r := range c.releases {
+			if _, err := rs.Lock(context.Background(), r.UniqueID, "someone-else", time.Minute); err != nil {
+				t.Errorf("Test '%s': Expected %s to be unlocked, got %s", c.name, r.Name, err)
+			}
+		}
+	}
+}
+
+func TestInstallAllOutput(t *testing.T) {
+	releases := store.Releases{
+		{UniqueID: "a", Name: "alpha", Chart: "stable/a"},
+		{UniqueID: "b", Name: "beta", Chart: "stable/b"},
+	}
+	_, restore := newFakeInstalls(2)
+	defer restore()
+
+	out := &bytes.Buffer{}
+	installAll(context.Background(), releases, 2, false, out, func(installResult) {})
+
+	// Every line is whole and belongs to one release
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "[alpha] ") && !strings.HasPrefix(line, "[beta] ") {
+			t.Errorf("Expected each line to be prefixed with its release, got %q", line)
+		}
+	}
+	for _, want := range []string{"[alpha] downloading stable/a", "[beta] downloading stable/b", "[alpha] Successfully installed release alpha!"} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("Expected the output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &prefixWriter{mu: &sync.Mutex{}, w: out, prefix: "[a] "}
+	fmt.Fprint(w, "one\ntw")
+	fmt.Fprint(w, "o\nthree")
+	if got := out.String(); got != "[a] one\n[a] two\n" {
+		t.Errorf("Expected only whole lines to be written, got %q", got)
+	}
+	w.Flush()
+	if got := out.String(); got != "[a] one\n[a] two\n[a] three\n" {
+		t.Errorf("Expected Flush to write the partial line, got %q", got)
+	}
+}
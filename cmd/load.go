@@ -55,7 +55,17 @@ func load(cmd *cobra.Command, args []string) {
 		exitOnErr(err)
 	}
 
-	err = releaseStore.Load(ctx, releases)
+	loaded := 0
+	failed := 0
+	err = store.LoadWithProgress(ctx, releaseStore, releases, func(result store.LoadResult) {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("[%d/%d] Failed to load %s (%s): %s\n", loaded+failed, len(releases), result.Release.UniqueID, result.Release.Name, result.Err)
+			return
+		}
+		loaded++
+		fmt.Printf("[%d/%d] Loaded %s (%s)\n", loaded+failed, len(releases), result.Release.UniqueID, result.Release.Name)
+	})
+	fmt.Printf("Loaded %d of %d resources into %s, %d failed\n", loaded, len(releases), viper.GetString("backend"), failed)
 	exitOnErr(err)
-	fmt.Printf("Loaded %d resources into %s\n", len(releases), viper.GetString("backend"))
 }
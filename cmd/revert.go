@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/skuid/helm-value-store/store"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type revertCmdArgs struct {
+	uuid     string
+	revision int64
+}
+
+var revertArgs = &revertCmdArgs{}
+
+var revertCmd = &cobra.Command{
+	Use:   "revert",
+	Short: "revert a release in the release store to a previous revision",
+	Long: `Revert a release to a previous revision. The name, namespace, chart, version, labels, values and
+dependencies of that revision are written to the store as a new revision, so the revert itself can be reverted.
+This only changes the release store, run install to deploy the reverted release.`,
+	Run: revert,
+}
+
+func init() {
+	RootCmd.AddCommand(revertCmd)
+	f := revertCmd.Flags()
+	f.StringVar(&revertArgs.uuid, "uuid", "", "The UUID of the release")
+	f.Int64Var(&revertArgs.revision, "revision", 0, "The revision to revert to")
+
+	revertCmd.MarkFlagRequired("uuid")
+	revertCmd.MarkFlagRequired("revision")
+}
+
+func revert(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	if len(revertArgs.uuid) == 0 {
+		exitOnErr(errors.New("Must supply a UUID"))
+	}
+	if revertArgs.revision < 1 {
+		exitOnErr(errors.New("Must supply a revision"))
+	}
+
+	release, err := releaseStore.Get(ctx, revertArgs.uuid)
+	exitOnErr(err)
+	releases, err := releaseStore.History(ctx, revertArgs.uuid)
+	exitOnErr(err)
+	previous, err := findRevision(releases, revertArgs.uuid, revertArgs.revision)
+	exitOnErr(err)
+
+	release.Name = previous.Name
+	release.Namespace = previous.Namespace
+	release.Chart = previous.Chart
+	release.Version = previous.Version
+	release.Labels = previous.Labels
+	release.Values = previous.Values
+	release.Dependencies = previous.Dependencies
+
+	err = releaseStore.ConditionalPut(ctx, *release)
+	if store.IsConflict(err) {
+		exitOnErr(fmt.Errorf("Release %s was changed by someone else during the revert, retry the revert", release.UniqueID))
+	}
+	exitOnErr(err)
+	fmt.Printf("Reverted release %s to revision %d, stored as revision %d!\n", release.Name, revertArgs.revision, release.Revision+1)
+}
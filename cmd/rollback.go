@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/diff"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// maxRollbackHistory is the most Tiller revisions looked at in a rollback
+const maxRollbackHistory = 256
+
+type rollbackCmdArgs struct {
+	uuid          string
+	revision      int32
+	restoreValues bool
+	dryRun        bool
+	timeout       int64
+}
+
+var rollbackArgs = &rollbackCmdArgs{}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "roll a deployed release back to a previous revision",
+	Long: `Roll the release deployed in the cluster back to a previous Tiller revision, using Tiller's release history.
+With --restore-values, the release in the store is also updated with the chart version and values of the newest
+stored revision that matches the Tiller revision, so the next install doesn't undo the rollback.`,
+	Run: rollback,
+}
+
+func init() {
+	RootCmd.AddCommand(rollbackCmd)
+	f := rollbackCmd.Flags()
+	f.StringVar(&rollbackArgs.uuid, "uuid", "", "The UUID of the release")
+	f.Int32Var(&rollbackArgs.revision, "revision", 0, "The Tiller revision to roll back to. Defaults to the newest earlier revision that deployed successfully")
+	f.BoolVar(&rollbackArgs.restoreValues, "restore-values", false, "Update the release in the store to the stored revision that matches the Tiller revision")
+	f.BoolVar(&rollbackArgs.dryRun, "dry-run", false, "simulate a rollback")
+	f.Int64Var(&rollbackArgs.timeout, "timeout", 300, "time in seconds to wait for any individual kubernetes operation (like Jobs for hooks)")
+
+	rollbackCmd.MarkFlagRequired("uuid")
+}
+
+// findDeployedRevision returns the Tiller revision to roll back to. A
+// revision of 0 is the newest revision before the current one that was
+// successfully deployed.
+func findDeployedRevision(history []*hapi_release.Release, revision int32) (*hapi_release.Release, error) {
+	if revision == 0 {
+		current := int32(0)
+		for _, r := range history {
+			if r.Version > current {
+				current = r.Version
+			}
+		}
+		var previous *hapi_release.Release
+		for _, r := range history {
+			if r.Version >= current || (previous != nil && r.Version <= previous.Version) {
+				continue
+			}
+			switch r.GetInfo().GetStatus().GetCode() {
+			case hapi_release.Status_DEPLOYED, hapi_release.Status_SUPERSEDED:
+				previous = r
+			}
+		}
+		if previous == nil {
+			return nil, errors.New("The release has no previously deployed revision to roll back to")
+		}
+		return previous, nil
+	}
+	for _, r := range history {
+		if r.Version == revision {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("Tiller has no revision %d of the release", revision)
+}
+
+func rollback(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	if len(rollbackArgs.uuid) == 0 {
+		exitOnErr(errors.New("Must supply a UUID"))
+	}
+	release, err := releaseStore.Get(ctx, rollbackArgs.uuid)
+	exitOnErr(err)
+
+	history, err := deployer.History(*release, maxRollbackHistory)
+	if store.IsNotFound(err) {
+		exitOnErr(fmt.Errorf("Release %s is not deployed", release.Name))
+	}
+	exitOnErr(err)
+	target, err := findDeployedRevision(history, rollbackArgs.revision)
+	exitOnErr(err)
+
+	// Find the stored revision before rolling back, so nothing is rolled
+	// back if the values can't be restored
+	var match *store.Release
+	if rollbackArgs.restoreValues {
+		storeHistory, err := releaseStore.History(ctx, release.UniqueID)
+		exitOnErr(err)
+		match, err = diff.MatchingRevision(storeHistory, target)
+		exitOnErr(err)
+		if match == nil {
+			exitOnErr(fmt.Errorf("No stored revision of release %s matches Tiller revision %d, not rolling back", release.Name, target.Version))
+		}
+	}
+
+	_, err = deployer.Rollback(*release, target.Version, deploy.Options{DryRun: rollbackArgs.dryRun, Timeout: rollbackArgs.timeout})
+	exitOnErr(err)
+	fmt.Printf("Rolled back release %s to Tiller revision %d!\n", release.Name, target.Version)
+
+	if match == nil {
+		return
+	}
+	if rollbackArgs.dryRun {
+		fmt.Printf("Would restore release %s in the store to revision %d\n", release.Name, match.Revision)
+		return
+	}
+	release.Chart = match.Chart
+	release.Version = match.Version
+	release.Values = match.Values
+	err = releaseStore.ConditionalPut(ctx, *release)
+	if store.IsConflict(err) {
+		exitOnErr(fmt.Errorf("Release %s was changed by someone else during the rollback, restore its values with revert --revision %d", release.UniqueID, match.Revision))
+	}
+	exitOnErr(err)
+	fmt.Printf("Restored release %s in the store to revision %d, stored as revision %d!\n", release.Name, match.Revision, release.Revision+1)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"testing"
+
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func revision(version int32, status hapi_release.Status_Code) *hapi_release.Release {
+	return &hapi_release.Release{
+		Name:    "prom",
+		Version: version,
+		Info:    &hapi_release.Info{Status: &hapi_release.Status{Code: status}},
+	}
+}
+
+func TestFindDeployedRevision(t *testing.T) {
+	cases := []struct {
+		name     string
+		history  []*hapi_release.Release
+		revision int32
+		want     int32
+		wantErr  bool
+	}{
+		{
+			"previous revision",
+			[]*hapi_release.Release{revision(3, hapi_release.Status_DEPLOYED), revision(2, hapi_release.Status_SUPERSEDED), revision(1, hapi_release.Status_SUPERSEDED)},
+			0, 2, false,
+		},
+		{
+			"skips failed revisions",
+			[]*hapi_release.Release{revision(4, hapi_release.Status_DEPLOYED), revision(3, hapi_release.Status_FAILED), revision(2, hapi_release.Status_SUPERSEDED), revision(1, hapi_release.Status_SUPERSEDED)},
+			0, 2, false,
+		},
+		{
+			"after a failed upgrade",
+			[]*hapi_release.Release{revision(1, hapi_release.Status_SUPERSEDED), revision(3, hapi_release.Status_FAILED), revision(2, hapi_release.Status_DEPLOYED)},
+			0, 2, false,
+		},
+		{
+			"no earlier deployed revision",
+			[]*hapi_release.Release{revision(2, hapi_release.Status_DEPLOYED), revision(1, hapi_release.Status_FAILED)},
+			0, 0, true,
+		},
+		{
+			"only one revision",
+			[]*hapi_release.Release{revision(1, hapi_release.Status_DEPLOYED)},
+			0, 0, true,
+		},
+		{
+			"explicit revision",
+			[]*hapi_release.Release{revision(3, hapi_release.Status_DEPLOYED), revision(2, hapi_release.Status_FAILED), revision(1, hapi_release.Status_SUPERSEDED)},
+			2, 2, false,
+		},
+		{
+			"missing revision",
+			[]*hapi_release.Release{revision(2, hapi_release.Status_DEPLOYED), revision(1, hapi_release.Status_SUPERSEDED)},
+			5, 0, true,
+		},
+	}
+
+	for _, c := range cases {
+		got, err := findDeployedRevision(c.history, c.revision)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.wantErr, err)
+			continue
+		}
+		if err == nil && got.Version != c.want {
+			t.Errorf("Test '%s': Expected revision %d, got %d", c.name, c.want, got.Version)
+		}
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/skuid/helm-value-store/cluster"
+	"github.com/skuid/helm-value-store/crypt"
 	"github.com/skuid/helm-value-store/datastore"
+	"github.com/skuid/helm-value-store/deploy"
 	"github.com/skuid/helm-value-store/dynamo"
+	"github.com/skuid/helm-value-store/local"
 	"github.com/skuid/helm-value-store/store"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -15,7 +19,12 @@ import (
 
 var releaseStore store.ReleaseStore
 
-var storeTypes = []string{"dynamodb", "datastore"}
+var deployer deploy.Deployer
+
+// closeDeployer releases any connections the deployer holds open
+var closeDeployer = func() {}
+
+var storeTypes = []string{"dynamodb", "datastore", "local"}
 
 // RootCmd is the root command
 var RootCmd = &cobra.Command{
@@ -25,23 +34,70 @@ var RootCmd = &cobra.Command{
 		var err error
 		switch backend := viper.GetString("backend"); backend {
 		case "dynamodb":
-			releaseStore, err = dynamo.NewReleaseStore(viper.GetString("dynamodb-table"))
+			releaseStore, err = dynamo.NewReleaseStore(
+				viper.GetString("dynamodb-table"),
+				dynamo.WithScanSegments(viper.GetInt("dynamodb-scan-segments")),
+			)
 		case "datastore":
 			releaseStore, err = datastore.NewReleaseStore(viper.GetString("service-account"))
+		case "local":
+			releaseStore, err = local.NewReleaseStore(viper.GetString("local-file"))
 		default:
 			err = fmt.Errorf("No valid value store specified: %s. Must be one of %v", backend, storeTypes)
 		}
 		exitOnErr(err)
+
+		if keyFile := viper.GetString("encryption-key-file"); len(keyFile) > 0 {
+			provider, err := crypt.NewFileKeyProvider(keyFile)
+			exitOnErr(err)
+			releaseStore = crypt.NewReleaseStore(releaseStore, provider)
+		}
+
+		tlsOpts := tillerTLSOptions()
+		if clusterFile := viper.GetString("cluster-file"); len(clusterFile) > 0 {
+			registry, err := cluster.LoadFile(clusterFile, cluster.WithTLS(tlsOpts))
+			exitOnErr(err)
+			deployer = registry
+			closeDeployer = func() { registry.Close() }
+		} else {
+			deployer, err = deploy.NewTillerTLS(viper.GetString("tiller-host"), tlsOpts)
+			exitOnErr(err)
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		closeDeployer()
 	},
 }
 
 func exitOnErr(err error) {
 	if err != nil {
 		fmt.Println(err.Error())
-		os.Exit(1)
+		exit(errExitCode)
+	}
+}
+
+// tillerTLSOptions returns the TLS options for connecting to Tiller
+func tillerTLSOptions() deploy.TLSOptions {
+	return deploy.TLSOptions{
+		Enable:     viper.GetBool("tls"),
+		Verify:     viper.GetBool("tls-verify"),
+		CACertFile: viper.GetString("tls-ca-cert"),
+		CertFile:   viper.GetString("tls-cert"),
+		KeyFile:    viper.GetString("tls-key"),
+		ServerName: viper.GetString("tls-server-name"),
 	}
 }
 
+// errExitCode is the exit status of exitOnErr. Commands whose exit status
+// means something other than an error, like drift, set their own.
+var errExitCode = 1
+
+// exit closes the deployer before exiting with code
+var exit = func(code int) {
+	closeDeployer()
+	os.Exit(code)
+}
+
 func init() {
 	err := os.Setenv("AWS_SDK_LOAD_CONFIG", "true")
 	if err != nil {
@@ -55,7 +111,18 @@ func init() {
 
 	// DynamoDB flags
 	RootCmd.PersistentFlags().String("dynamodb-table", "helm-charts", "Name of the dynamodb table")
+	RootCmd.PersistentFlags().Int("dynamodb-scan-segments", 1, "Number of parallel segments to scan the dynamodb table with when listing releases")
 	RootCmd.PersistentFlags().String("service-account", "sa.json", "The Google Service Account JSON file")
+	RootCmd.PersistentFlags().String("local-file", "helm-value-store.db", "The database file for the local backend")
+	RootCmd.PersistentFlags().String("encryption-key-file", "", "A file with a 32 byte key to encrypt release values with. Values are stored in plaintext if not set")
+	RootCmd.PersistentFlags().String("tiller-host", os.Getenv("TILLER_HOST"), "The Tiller server to install releases with. Defaults to $TILLER_HOST")
+	RootCmd.PersistentFlags().Bool("tls", false, "Connect to Tiller over TLS")
+	RootCmd.PersistentFlags().Bool("tls-verify", false, "Connect to Tiller over TLS and verify its certificate")
+	RootCmd.PersistentFlags().String("tls-ca-cert", "", "The CA certificate to verify Tiller's certificate with")
+	RootCmd.PersistentFlags().String("tls-cert", "", "The client certificate to present to Tiller")
+	RootCmd.PersistentFlags().String("tls-key", "", "The key for the client certificate")
+	RootCmd.PersistentFlags().String("tls-server-name", "", "The server name to verify Tiller's certificate against")
+	RootCmd.PersistentFlags().String("cluster-file", "", "A file mapping release labels to clusters. Releases are installed to the cluster matching their labels instead of --tiller-host")
 	RootCmd.PersistentFlags().Duration("timeout", time.Duration(30)*time.Second, "The timeout for a given command")
 }
 
@@ -1,11 +1,20 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/skuid/go-middlewares/authn/google"
+	"github.com/skuid/helm-value-store/auth"
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/helm-value-store/refs"
 	"github.com/skuid/helm-value-store/server"
 	"github.com/skuid/spec"
 	"github.com/skuid/spec/lifecycle"
@@ -22,7 +31,7 @@ var level = zapcore.InfoLevel
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
-	Short: "A brief description of your command",
+	Short: "serve the release store and apply releases over HTTP",
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		l, err := spec.NewStandardLevelLogger(level)
 		if err != nil {
@@ -34,39 +43,156 @@ var serveCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		middlewareList := []middlewares.Middleware{middlewares.InstrumentRoute()}
 		loggingClosures := []func(*http.Request) []zapcore.Field{}
-		serverOpts := []server.ControllerOpt{}
+		if viper.GetInt("job-workers") < 1 {
+			zap.L().Fatal("--job-workers must be at least 1", zap.Int("job-workers", viper.GetInt("job-workers")))
+		}
+		resolver := refs.DefaultRegistry().Restrict(viper.GetStringSlice("ref-schemes")...)
+		if vaultPaths := viper.GetStringSlice("vault-paths"); len(vaultPaths) > 0 {
+			resolver.AllowPaths("vault", vaultPaths...)
+		}
+		serverOpts := []server.ControllerOpt{
+			server.WithDeployer(deployer),
+			server.WithJobs(viper.GetInt("job-workers"), 1000),
+			server.WithResolver(resolver),
+		}
 
 		if viper.GetBool("auth-enabled") {
-			authorizer := google.New(google.WithAuthorizedDomains(viper.GetString("email-domain")))
+			authorizer, err := newAuthorizer(viper.GetStringSlice("auth-methods"))
+			if err != nil {
+				zap.L().Fatal("Error configuring authentication", zap.Error(err))
+			}
 			serverOpts = append(serverOpts, server.WithAuthorizers(authorizer))
 			middlewareList = append([]middlewares.Middleware{authorizer.Authorize()}, middlewareList...)
 			loggingClosures = append(loggingClosures, authorizer.LoggingClosure)
 		}
 
+		if policyFile := viper.GetString("policy-file"); len(policyFile) > 0 {
+			p, err := policy.LoadFile(policyFile)
+			if err != nil {
+				zap.L().Fatal("Error loading policy", zap.Error(err))
+			}
+			serverOpts = append(serverOpts, server.WithPolicy(p))
+		}
+
 		apiController := server.NewApiController(releaseStore, serverOpts...)
 		middlewareList = append(middlewareList, middlewares.Logging(loggingClosures...))
 
-		authMux := http.NewServeMux()
-		authMux.HandleFunc("/apply", apiController.ApplyChart)
-
 		mux := http.NewServeMux()
-		mux.Handle("/", middlewares.Apply(authMux, middlewareList...))
+		mux.Handle("/", apiController.Handler(middlewareList...))
 
 		go spec.MetricsServer(viper.GetInt("metrics-port"))
 
 		hostPort := fmt.Sprintf(":%d", viper.GetInt("port"))
 		httpServer := &http.Server{Addr: hostPort, Handler: mux}
-		lifecycle.ShutdownOnTerm(httpServer)
+		if caFile := viper.GetString("client-ca-file"); len(caFile) > 0 {
+			tlsConfig, err := auth.ServerTLSConfig(caFile)
+			if err != nil {
+				zap.L().Fatal("Error configuring TLS", zap.Error(err))
+			}
+			httpServer.TLSConfig = tlsConfig
+		}
+		stopped := shutdownOnTerm(httpServer, apiController, viper.GetDuration("shutdown-timeout"))
+
+		certFile, keyFile := viper.GetString("cert-file"), viper.GetString("key-file")
+		serveTLS := len(certFile) > 0 || len(keyFile) > 0
+		if httpServer.TLSConfig != nil && !serveTLS {
+			zap.L().Fatal("--client-ca-file needs --cert-file and --key-file")
+		}
 
-		zap.L().Info("Starting helm-value-store server 🃏 ", zap.Int("port", viper.GetInt("port")))
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		zap.L().Info("Starting helm-value-store server 🃏 ", zap.Int("port", viper.GetInt("port")), zap.Bool("tls", serveTLS))
+		var err error
+		if serveTLS {
+			err = httpServer.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			zap.L().Fatal("Error listening", zap.Error(err))
 		}
+		<-stopped
 		zap.L().Info("Server gracefully stopped")
 
 	},
 }
 
+// shutdownOnTerm shuts srv down gracefully when a SIGTERM is received, the
+// same way as lifecycle.ShutdownOnTerm, and then gives c's running jobs up to
+// drainTimeout to finish. The returned channel is closed once they have.
+func shutdownOnTerm(srv *http.Server, c *server.ApiController, drainTimeout time.Duration) <-chan struct{} {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+
+	stopped := make(chan struct{})
+	go func() {
+		<-term
+		lifecycle.Ready = false
+		lifecycle.Shutdown = true
+
+		zap.L().Info("Received SIGTERM! Beginning shutdown", zap.Int64("timeout", lifecycle.ShutdownTimer))
+		time.Sleep(time.Duration(lifecycle.ShutdownTimer) * time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := srv.Shutdown(ctx); err != nil {
+			zap.L().Error("Error shutting down", zap.Error(err))
+			srv.Close()
+		}
+		cancel()
+
+		ctx, cancel = context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := c.Shutdown(ctx); err != nil {
+			zap.L().Error("Jobs were still running at the shutdown timeout, and were canceled", zap.Error(err))
+		}
+		close(stopped)
+	}()
+	return stopped
+}
+
+// newAuthorizer returns an authorizer that authenticates requests with each
+// method in turn
+func newAuthorizer(methods []string) (*auth.Authorizer, error) {
+	authenticators := []auth.Authenticator{}
+	for _, method := range methods {
+		switch method {
+		case "google":
+			authorizer := google.New(google.WithAuthorizedDomains(viper.GetString("email-domain")))
+			authenticators = append(authenticators, auth.FromAuthorizer("google", authorizer))
+		case "token":
+			if len(viper.GetString("token-file")) == 0 {
+				return nil, errors.New("token authentication needs --token-file")
+			}
+			a, err := auth.LoadTokenFile(viper.GetString("token-file"))
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, a)
+		case "oidc":
+			a, err := auth.NewOIDCAuthenticator(auth.OIDCConfig{
+				Issuer:      viper.GetString("oidc-issuer"),
+				Audience:    viper.GetString("oidc-audience"),
+				JWKSFile:    viper.GetString("oidc-jwks-file"),
+				UserClaim:   viper.GetString("oidc-user-claim"),
+				GroupsClaim: viper.GetString("oidc-groups-claim"),
+			})
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, a)
+		case "mtls":
+			if len(viper.GetString("client-ca-file")) == 0 {
+				return nil, errors.New("mtls authentication needs --client-ca-file")
+			}
+			authenticators = append(authenticators, auth.CertificateAuthenticator{})
+		default:
+			return nil, fmt.Errorf("Unknown authentication method %q", method)
+		}
+	}
+	if len(authenticators) == 0 {
+		return nil, errors.New("No authentication methods. Use --auth-enabled=false to disable authentication")
+	}
+	return auth.New(authenticators...), nil
+}
+
 func init() {
 	RootCmd.AddCommand(serveCmd)
 
@@ -83,6 +209,21 @@ func init() {
 	localFlagSet.Int("metrics-port", 3001, "The port to listen on for metrics/health checks")
 	localFlagSet.String("email-domain", "", "The email domain to filter on")
 	localFlagSet.Bool("auth-enabled", true, "Enable authentication/authorization")
+	localFlagSet.StringSlice("auth-methods", []string{"google"}, `The ways requests can be authenticated, tried in order. Any of "google", "token", "oidc" and "mtls"`)
+	localFlagSet.String("token-file", "", "A YAML file of hashed static API tokens, for the token method")
+	localFlagSet.String("oidc-issuer", "", "The issuer of OpenID Connect tokens, for the oidc method")
+	localFlagSet.String("oidc-audience", "", "The audience OpenID Connect tokens must be issued for, usually the client ID")
+	localFlagSet.String("oidc-jwks-file", "", "A JSON Web Key Set file with the OpenID Connect issuer's signing keys")
+	localFlagSet.String("oidc-user-claim", "email", "The OpenID Connect token claim with the user's name. An email is only accepted if email_verified is true")
+	localFlagSet.String("oidc-groups-claim", "groups", "The OpenID Connect token claim with the user's groups")
+	localFlagSet.String("cert-file", "", "A certificate file to serve TLS with")
+	localFlagSet.String("key-file", "", "The private key file of --cert-file")
+	localFlagSet.String("client-ca-file", "", "A file of CA certificates that sign client certificates, for the mtls method")
+	localFlagSet.String("policy-file", "", "A YAML file of rules allowing users and groups to read, write or apply releases matching label selectors. Everyone may do everything without one")
+	localFlagSet.StringSlice("ref-schemes", server.ServerSchemes, `The secret reference schemes resolved when releases are applied, none by default. Adding "file" or "env" lets anyone who can write releases read the server's files or environment, and "vault" any secret the server's VAULT_TOKEN can read, unless --vault-paths is set`)
+	localFlagSet.StringSlice("vault-paths", []string{}, "The Vault secret paths, and the paths under them, that vault references may read when applied by the server. Any path the server's VAULT_TOKEN can read if empty")
+	localFlagSet.Int("job-workers", 4, "The number of releases applied at once in the background by async /apply requests. Must be at least 1")
+	localFlagSet.Duration("shutdown-timeout", 10*time.Minute, "How long running async /apply jobs are given to finish when the server is shut down, before they are canceled")
 
 	viper.BindPFlags(localFlagSet)
 }
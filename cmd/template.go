@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/skuid/helm-value-store/refs"
+	"github.com/skuid/helm-value-store/render"
+	"github.com/skuid/spec"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type templateCmdArgs struct {
+	labels spec.SelectorSet
+	name   string
+	uuid   string
+	values []string
+
+	outputDir   string
+	resolveRefs bool
+}
+
+var templateArgs = templateCmdArgs{}
+
+var templateCmd = &cobra.Command{
+	Use:   "template",
+	Short: "render the manifests of releases locally",
+	Long: `Render the Kubernetes manifests of releases with their stored values, without a cluster.
+Charts are downloaded and rendered locally with their default values merged with the release's values.
+Manifests are written to stdout, or to a directory per release under --output-dir.
+Secret references are left as-is unless --resolve-refs is set.`,
+	Run: template,
+}
+
+func init() {
+	RootCmd.AddCommand(templateCmd)
+	f := templateCmd.Flags()
+	f.StringVar(&templateArgs.uuid, "uuid", "", "The UUID of the release to render. Takes precedence over --name and --label")
+	f.StringVar(&templateArgs.name, "name", "", "The name of the releases to render")
+	f.VarP(&templateArgs.labels, "label", "l", `The labels to filter by. Each label should have the format "k=v".
+		Can be specified multiple times, or a comma-separated list.`)
+	f.StringArrayVar(&templateArgs.values, "set", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	f.StringVar(&templateArgs.outputDir, "output-dir", "", "Write manifests to files under this directory instead of stdout")
+	f.BoolVar(&templateArgs.resolveRefs, "resolve-refs", false, "Resolve secret references in values before rendering")
+}
+
+func template(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+	defer cancel()
+
+	releases, err := findReleases(ctx, templateArgs.uuid, templateArgs.name, templateArgs.labels)
+	exitOnErr(err)
+
+	if len(templateArgs.outputDir) > 0 {
+		// Each release is written to a directory named after it
+		names := map[string]bool{}
+		for _, release := range releases {
+			if names[release.Name] {
+				exitOnErr(fmt.Errorf("More than one release is named %s. Use --uuid or --label to render only one", release.Name))
+			}
+			names[release.Name] = true
+		}
+	}
+
+	for _, release := range releases {
+		if len(templateArgs.values) > 0 {
+			exitOnErr(release.MergeValues(templateArgs.values))
+		}
+		if templateArgs.resolveRefs {
+			release.Values, err = refs.DefaultRegistry().ResolveValues(ctx, release.Values)
+			exitOnErr(err)
+		}
+
+		location, err := release.Download()
+		exitOnErr(err)
+		c, err := render.Chart(location)
+		exitOnErr(err)
+		manifests, err := render.Release(release, c)
+		exitOnErr(err)
+
+		if len(templateArgs.outputDir) > 0 {
+			exitOnErr(render.WriteDir(templateArgs.outputDir, release, manifests))
+			fmt.Fprintf(os.Stderr, "Wrote %d manifests for release %s to %s\n", len(manifests), release.Name, templateArgs.outputDir)
+			continue
+		}
+		exitOnErr(render.Fprint(os.Stdout, manifests))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	"github.com/skuid/helm-value-store/store"
 	"github.com/skuid/spec"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -14,10 +15,13 @@ import (
 type updateCmdArgs struct {
 	uuid string
 
-	file    string
-	values  []string
-	labels  spec.SelectorSet
-	version string
+	file     string
+	values   []string
+	labels   spec.SelectorSet
+	version  string
+	revision int64
+
+	dependsOn []string
 }
 
 var updateArgs = &updateCmdArgs{}
@@ -39,6 +43,10 @@ func init() {
 	f.VarP(&updateArgs.labels, "labels", "l", `The labels to apply. Each label should have the format "k=v".
     	Can be specified multiple times, or a comma-separated list.`)
 	f.StringVar(&updateArgs.version, "version", "", "Version of the release")
+	f.StringArrayVar(&updateArgs.dependsOn, "depends-on", []string{}, `A release this release depends on, and is installed after. Either "uuid=<id>", or "name=<name>"
+    	optionally followed by labels, like "name=alertmanager,region=us". Can be specified multiple times. Replaces the existing dependencies.`)
+	f.Int64Var(&updateArgs.revision, "revision", 0, `The revision of the release the update is based on. If the release in the store has
+    	a different revision, the update fails. Defaults to the revision read at the start of the update.`)
 
 	updateCmd.MarkFlagRequired("uuid")
 	err := updateCmd.MarkFlagFilename("file", valueExtensions...)
@@ -56,6 +64,9 @@ func update(cmd *cobra.Command, args []string) {
 	}
 	release, err := releaseStore.Get(ctx, updateArgs.uuid)
 	exitOnErr(err)
+	if updateArgs.revision > 0 {
+		release.Revision = updateArgs.revision
+	}
 
 	if len(updateArgs.file) > 0 {
 		values, err := ioutil.ReadFile(updateArgs.file)
@@ -74,8 +85,15 @@ func update(cmd *cobra.Command, args []string) {
 	if len(updateArgs.version) > 0 {
 		release.Version = updateArgs.version
 	}
+	if len(updateArgs.dependsOn) > 0 {
+		release.Dependencies, err = store.ParseDependencies(updateArgs.dependsOn)
+		exitOnErr(err)
+	}
 
-	err = releaseStore.Put(ctx, *release)
+	err = releaseStore.ConditionalPut(ctx, *release)
+	if store.IsConflict(err) {
+		exitOnErr(fmt.Errorf("Release %s was changed by someone else since revision %d, get it again and retry the update", release.UniqueID, release.Revision))
+	}
 	exitOnErr(err)
-	fmt.Printf("Updated release %s in release store!\n", release.Name)
+	fmt.Printf("Updated release %s in release store to revision %d!\n", release.Name, release.Revision+1)
 }
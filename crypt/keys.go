@@ -0,0 +1,104 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// keySize is the size of AES-256 keys, used for both master and data keys
+const keySize = 32
+
+// A KeyProvider wraps and unwraps the data keys that release values are
+// encrypted with. A provider backed by a key management service would send
+// the data key to the service, so the master key never leaves it.
+type KeyProvider interface {
+	// Name identifies the provider in stored values, so a value can only
+	// be unwrapped by the kind of provider that wrapped it
+	Name() string
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// FileKeyProvider wraps data keys with a local AES-256 master key. It is
+// meant for tests and offline use.
+type FileKeyProvider struct {
+	aead cipher.AEAD
+}
+
+// NewFileKeyProvider creates a FileKeyProvider from a key file. The file must
+// hold a 32 byte key, either raw or base64 encoded. One can be made with
+// `head -c 32 /dev/urandom | base64 > key`.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading encryption key file: %q", err)
+	}
+	key := data
+	if len(key) != keySize {
+		key, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("Encryption key file %s must contain a %d byte key, raw or base64 encoded", path, keySize)
+		}
+	}
+	return NewKeyProvider(key)
+}
+
+// NewKeyProvider creates a FileKeyProvider from a 32 byte master key
+func NewKeyProvider(key []byte) (*FileKeyProvider, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeyProvider{aead: aead}, nil
+}
+
+// Name returns "file"
+func (p *FileKeyProvider) Name() string { return "file" }
+
+// WrapKey encrypts a data key with the master key
+func (p *FileKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	return seal(p.aead, key, nil)
+}
+
+// UnwrapKey decrypts a data key with the master key
+func (p *FileKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return open(p.aead, wrapped, nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("Encryption keys must be %d bytes, got %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the
+// ciphertext. The ciphertext can only be opened with the same additionalData.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts ciphertext produced by seal with the same additionalData
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, data := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, additionalData)
+}
@@ -0,0 +1,255 @@
+// Package crypt encrypts release values before they are written to a
+// ReleaseStore, and decrypts them when they are read.
+//
+// Values are encrypted with envelope encryption: each value is encrypted with
+// AES-256-GCM under its own random data key, with the release's UniqueID as
+// additional data so that it can't be copied to another release, and the data
+// key is wrapped by a KeyProvider and stored alongside the value. Values
+// written before
+// encryption was enabled are read back unchanged, and are encrypted the next
+// time they are written.
+package crypt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/skuid/helm-value-store/store"
+)
+
+// prefix marks an encrypted value. The full format is
+// enc:v1:<provider>:<base64 wrapped data key>:<base64 nonce and ciphertext>
+const prefix = "enc:v1:"
+
+// ReleaseStore is a store.ReleaseStore that encrypts release values in
+// another ReleaseStore
+type ReleaseStore struct {
+	rs       store.ReleaseStore
+	provider KeyProvider
+}
+
+// NewReleaseStore creates a ReleaseStore that encrypts values written to rs
+// with keys wrapped by provider
+func NewReleaseStore(rs store.ReleaseStore, provider KeyProvider) *ReleaseStore {
+	return &ReleaseStore{rs: rs, provider: provider}
+}
+
+// IsEncrypted reports whether a stored value is encrypted
+func IsEncrypted(values string) bool {
+	return strings.HasPrefix(values, prefix)
+}
+
+// encrypt encrypts a release's values. Values that are already encrypted are
+// only written as they are if they decrypt for the release, so that nobody
+// can store plaintext, or values that can't be read back, as encrypted.
+func (rs *ReleaseStore) encrypt(ctx context.Context, r store.Release) (store.Release, error) {
+	if IsEncrypted(r.Values) {
+		if _, err := rs.decrypt(ctx, r); err != nil {
+			return r, store.NewError("encrypt", r.UniqueID, store.ErrInvalidRelease, err)
+		}
+		return r, nil
+	}
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return r, fmt.Errorf("Error generating data key for release %s: %q", r.UniqueID, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return r, err
+	}
+	ciphertext, err := seal(aead, []byte(r.Values), []byte(r.UniqueID))
+	if err != nil {
+		return r, fmt.Errorf("Error encrypting values of release %s: %q", r.UniqueID, err)
+	}
+	wrapped, err := rs.provider.WrapKey(ctx, key)
+	if err != nil {
+		return r, fmt.Errorf("Error wrapping data key for release %s: %q", r.UniqueID, err)
+	}
+	r.Values = prefix + strings.Join([]string{
+		rs.provider.Name(),
+		base64.StdEncoding.EncodeToString(wrapped),
+		base64.StdEncoding.EncodeToString(ciphertext),
+	}, ":")
+	return r, nil
+}
+
+func (rs *ReleaseStore) decrypt(ctx context.Context, r store.Release) (store.Release, error) {
+	if !IsEncrypted(r.Values) {
+		return r, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(r.Values, prefix), ":")
+	if len(parts) != 3 {
+		return r, fmt.Errorf("Error decrypting values of release %s: malformed encrypted value", r.UniqueID)
+	}
+	if parts[0] != rs.provider.Name() {
+		return r, fmt.Errorf("Error decrypting values of release %s: encrypted with the %q key provider, not %q", r.UniqueID, parts[0], rs.provider.Name())
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return r, fmt.Errorf("Error decrypting values of release %s: %q", r.UniqueID, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return r, fmt.Errorf("Error decrypting values of release %s: %q", r.UniqueID, err)
+	}
+	key, err := rs.provider.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return r, fmt.Errorf("Error unwrapping data key for release %s: %q", r.UniqueID, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return r, err
+	}
+	plaintext, err := open(aead, ciphertext, []byte(r.UniqueID))
+	if err != nil {
+		return r, fmt.Errorf("Error decrypting values of release %s: %q", r.UniqueID, err)
+	}
+	r.Values = string(plaintext)
+	return r, nil
+}
+
+func (rs *ReleaseStore) decryptAll(ctx context.Context, releases store.Releases) (store.Releases, error) {
+	response := store.Releases{}
+	for _, r := range releases {
+		plain, err := rs.decrypt(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, plain)
+	}
+	return response, nil
+}
+
+func (rs *ReleaseStore) encryptAll(ctx context.Context, releases store.Releases) (store.Releases, error) {
+	response := store.Releases{}
+	for _, r := range releases {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		encrypted, err := rs.encrypt(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, encrypted)
+	}
+	return response, nil
+}
+
+// Get gets a release by it's UniqueID and decrypts its values
+func (rs *ReleaseStore) Get(ctx context.Context, uniqueID string) (*store.Release, error) {
+	r, err := rs.rs.Get(ctx, uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := rs.decrypt(ctx, *r)
+	if err != nil {
+		return nil, err
+	}
+	return &plain, nil
+}
+
+// Put encrypts a release's values and creates or updates it
+func (rs *ReleaseStore) Put(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	encrypted, err := rs.encrypt(ctx, r)
+	if err != nil {
+		return err
+	}
+	return rs.rs.Put(ctx, encrypted)
+}
+
+// ConditionalPut encrypts a release's values and creates or updates it if
+// the stored release has the same Revision
+func (rs *ReleaseStore) ConditionalPut(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	encrypted, err := rs.encrypt(ctx, r)
+	if err != nil {
+		return err
+	}
+	return rs.rs.ConditionalPut(ctx, encrypted)
+}
+
+// Delete deletes a release by it's UniqueID
+func (rs *ReleaseStore) Delete(ctx context.Context, uniqueID string) error {
+	return rs.rs.Delete(ctx, uniqueID)
+}
+
+// History returns every stored revision of a release with decrypted values
+func (rs *ReleaseStore) History(ctx context.Context, uniqueID string) (store.Releases, error) {
+	releases, err := rs.rs.History(ctx, uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	return rs.decryptAll(ctx, releases)
+}
+
+// List returns releases with decrypted values
+func (rs *ReleaseStore) List(ctx context.Context, selector map[string]string) (store.Releases, error) {
+	releases, err := rs.rs.List(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+	return rs.decryptAll(ctx, releases)
+}
+
+// Load encrypts and bulk-writes releases
+func (rs *ReleaseStore) Load(ctx context.Context, releases store.Releases) error {
+	return rs.LoadWithProgress(ctx, releases, nil)
+}
+
+// LoadWithProgress encrypts and bulk-writes releases, reporting progress with
+// the releases as they were passed in
+func (rs *ReleaseStore) LoadWithProgress(ctx context.Context, releases store.Releases, progress store.LoadProgressFunc) error {
+	encrypted, err := rs.encryptAll(ctx, releases)
+	if err != nil {
+		return err
+	}
+	plain := map[string]store.Release{}
+	for _, r := range releases {
+		plain[r.UniqueID] = r
+	}
+	restore := func(result store.LoadResult) store.LoadResult {
+		if r, ok := plain[result.Release.UniqueID]; ok {
+			result.Release.Values = r.Values
+		}
+		return result
+	}
+
+	var report store.LoadProgressFunc
+	if progress != nil {
+		report = func(result store.LoadResult) {
+			progress(restore(result))
+		}
+	}
+	err = store.LoadWithProgress(ctx, rs.rs, encrypted, report)
+	if loadErr, ok := err.(*store.LoadError); ok {
+		for i, result := range loadErr.Failed {
+			loadErr.Failed[i] = restore(result)
+		}
+	}
+	return err
+}
+
+// Lock takes a lease on a release in the underlying ReleaseStore
+func (rs *ReleaseStore) Lock(ctx context.Context, uniqueID, owner string, ttl time.Duration) (*store.Lease, error) {
+	return rs.rs.Lock(ctx, uniqueID, owner, ttl)
+}
+
+// Unlock releases a lease in the underlying ReleaseStore
+func (rs *ReleaseStore) Unlock(ctx context.Context, lease store.Lease) error {
+	return rs.rs.Unlock(ctx, lease)
+}
+
+// Setup sets up the underlying ReleaseStore
+func (rs *ReleaseStore) Setup(ctx context.Context) error {
+	return rs.rs.Setup(ctx)
+}
@@ -0,0 +1,162 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skuid/helm-value-store/memory"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/helm-value-store/store/storetest"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func newTestStore(t *testing.T, key []byte) (*ReleaseStore, *memory.ReleaseStore) {
+	provider, err := NewKeyProvider(key)
+	if err != nil {
+		t.Fatalf("Error creating key provider: %s", err)
+	}
+	backend := memory.NewReleaseStore()
+	return NewReleaseStore(backend, provider), backend
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ReleaseStore, func()) {
+		rs, _ := newTestStore(t, testKey(1))
+		return rs, func() {}
+	})
+}
+
+func TestValuesEncryptedAtRest(t *testing.T) {
+	ctx := context.Background()
+	rs, backend := newTestStore(t, testKey(1))
+
+	values := "password: hunter2\n"
+	if err := rs.Put(ctx, store.Release{UniqueID: "abc123", Values: values}); err != nil {
+		t.Fatalf("Error putting release: %s", err)
+	}
+	if err := rs.Load(ctx, store.Releases{{UniqueID: "def456", Values: values}}); err != nil {
+		t.Fatalf("Error loading release: %s", err)
+	}
+
+	for _, id := range []string{"abc123", "def456"} {
+		stored, err := backend.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Error getting stored release %s: %s", id, err)
+		}
+		if !IsEncrypted(stored.Values) || strings.Contains(stored.Values, "hunter2") {
+			t.Errorf("Expected release %s to be stored encrypted, got %q", id, stored.Values)
+		}
+		got, err := rs.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Error getting release %s: %s", id, err)
+		}
+		if got.Values != values {
+			t.Errorf("Expected release %s to decrypt to %q, got %q", id, values, got.Values)
+		}
+	}
+}
+
+func TestPlaintextPassesThrough(t *testing.T) {
+	ctx := context.Background()
+	rs, backend := newTestStore(t, testKey(1))
+
+	values := "replicas: 2\n"
+	backend.Put(ctx, store.Release{UniqueID: "abc123", Values: values})
+
+	got, err := rs.Get(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("Error getting release: %s", err)
+	}
+	if got.Values != values {
+		t.Errorf("Expected plaintext values %q, got %q", values, got.Values)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	ctx := context.Background()
+	rs, backend := newTestStore(t, testKey(1))
+	rs.Put(ctx, store.Release{UniqueID: "abc123", Values: "password: hunter2\n"})
+
+	other, _ := NewKeyProvider(testKey(2))
+	if _, err := NewReleaseStore(backend, other).Get(ctx, "abc123"); err == nil {
+		t.Errorf("Expected an error decrypting with the wrong key")
+	}
+}
+
+func TestEncryptedValuesVerified(t *testing.T) {
+	ctx := context.Background()
+	rs, backend := newTestStore(t, testKey(1))
+	if err := rs.Put(ctx, store.Release{UniqueID: "abc123", Values: "password: hunter2\n"}); err != nil {
+		t.Fatalf("Error putting release: %s", err)
+	}
+	stored, _ := backend.Get(ctx, "abc123")
+	otherRS, otherBackend := newTestStore(t, testKey(2))
+	otherRS.Put(ctx, store.Release{UniqueID: "abc123", Values: "password: hunter2\n"})
+	otherKey, _ := otherBackend.Get(ctx, "abc123")
+
+	cases := []struct {
+		name    string
+		release store.Release
+		wantErr bool
+	}{
+		{"same release", store.Release{UniqueID: "abc123", Values: stored.Values}, false},
+		{"copied to another release", store.Release{UniqueID: "def456", Values: stored.Values}, true},
+		{"another key", store.Release{UniqueID: "abc123", Values: otherKey.Values}, true},
+		{"plaintext", store.Release{UniqueID: "abc123", Values: prefix + "password: hunter2"}, true},
+		{"forged", store.Release{UniqueID: "abc123", Values: prefix + "file:aGVsbG8=:d29ybGQ="}, true},
+	}
+
+	for _, c := range cases {
+		err := rs.Put(ctx, c.release)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.wantErr, err)
+		}
+		if err != nil && !store.IsInvalidRelease(err) {
+			t.Errorf("Test '%s': Expected an invalid release error, got %v", c.name, err)
+		}
+	}
+
+	// Values copied to another release in the backend don't decrypt
+	backend.Put(ctx, store.Release{UniqueID: "def456", Values: stored.Values})
+	if _, err := rs.Get(ctx, "def456"); err == nil {
+		t.Errorf("Expected values copied from another release not to decrypt")
+	}
+}
+
+func TestNewFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hvs-crypt")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"raw", testKey(1), false},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(testKey(1)) + "\n"), false},
+		{"short", []byte("abc"), true},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(path, c.content, 0600); err != nil {
+			t.Fatalf("Test '%s': error writing key file: %s", c.name, err)
+		}
+		_, err := NewFileKeyProvider(path)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.wantErr, err)
+		}
+	}
+}
@@ -5,13 +5,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sort"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/skuid/helm-value-store/store"
 	"google.golang.org/api/option"
 )
 
-const kind = "hvsRelease"
+const (
+	kind         = "hvsRelease"
+	revisionKind = "hvsReleaseRevision"
+	leaseKind    = "hvsReleaseLease"
+)
+
+// revisionKey returns the key of a release's revision in the history. Each
+// revision is a child of the release's key, so a release's history can be
+// read with an ancestor query
+func revisionKey(r store.Release) *datastore.Key {
+	return datastore.IDKey(revisionKind, r.Revision, datastore.NameKey(kind, r.UniqueID, nil))
+}
 
 // ReleaseStore stores and retrieves releases from a GCP Datastore table
 type ReleaseStore struct {
@@ -48,7 +61,7 @@ func (rs ReleaseStore) Get(ctx context.Context, uniqueID string) (*store.Release
 	response := &store.Release{}
 	key := datastore.NameKey(kind, uniqueID, nil)
 	if err := rs.client.Get(ctx, key, response); err != nil {
-		return nil, fmt.Errorf("Error getting release: %q", err)
+		return nil, wrapError("get", uniqueID, err)
 	}
 	return response, nil
 }
@@ -57,18 +70,59 @@ func (rs ReleaseStore) Get(ctx context.Context, uniqueID string) (*store.Release
 func (rs ReleaseStore) Delete(ctx context.Context, uniqueID string) error {
 	key := datastore.NameKey(kind, uniqueID, nil)
 	if err := rs.client.Delete(ctx, key); err != nil {
-		return fmt.Errorf("Error deleting release: %q", err)
+		return wrapError("delete", uniqueID, err)
 	}
 	return nil
 }
 
 // Put creates or updates a release
 func (rs ReleaseStore) Put(ctx context.Context, r store.Release) error {
-	key := datastore.NameKey(kind, r.UniqueID, nil)
-	if _, err := rs.client.Put(ctx, key, &r); err != nil {
-		return fmt.Errorf("Error putting release: %q", err)
+	if err := r.Validate(); err != nil {
+		return err
 	}
-	return nil
+	return wrapError("put", r.UniqueID, rs.put(ctx, r, false))
+}
+
+// ConditionalPut creates or updates a release if the stored release has the
+// same Revision
+func (rs ReleaseStore) ConditionalPut(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	return wrapError("put", r.UniqueID, rs.put(ctx, r, true))
+}
+
+// put writes r in a transaction with a Revision one higher than any the
+// release has had, and records it in the release's history. If conditional,
+// the stored release must have the same Revision as r.
+func (rs ReleaseStore) put(ctx context.Context, r store.Release, conditional bool) error {
+	key := datastore.NameKey(kind, r.UniqueID, nil)
+	_, err := rs.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		current := &store.Release{}
+		if err := tx.Get(key, current); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if conditional && current.Revision != r.Revision {
+			return store.ErrConflict
+		}
+
+		// The history keeps the revisions of deleted releases too
+		query := datastore.NewQuery(revisionKind).Ancestor(key).KeysOnly().Transaction(tx)
+		revisions, err := rs.client.GetAll(ctx, query, nil)
+		if err != nil {
+			return err
+		}
+		next := r
+		next.Revision = current.Revision + 1
+		for _, k := range revisions {
+			if k.ID >= next.Revision {
+				next.Revision = k.ID + 1
+			}
+		}
+		_, err = tx.PutMulti([]*datastore.Key{key, revisionKey(next)}, []*store.Release{&next, &next})
+		return err
+	})
+	return err
 }
 
 // List returns releases
@@ -78,7 +132,7 @@ func (rs ReleaseStore) List(ctx context.Context, selector map[string]string) (st
 	query := datastore.NewQuery(kind)
 	_, err := rs.client.GetAll(ctx, query, releases)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting releases: %q", err)
+		return nil, wrapError("list", "", err)
 	}
 
 	response := store.Releases{}
@@ -90,17 +144,81 @@ func (rs ReleaseStore) List(ctx context.Context, selector map[string]string) (st
 	return response, nil
 }
 
-// Load bulk-writes releases to datastore
+// Load bulk-writes releases to datastore, each in its own transaction
 func (rs ReleaseStore) Load(ctx context.Context, releases store.Releases) error {
-	keys := []*datastore.Key{}
-	input := []*store.Release{}
-	for i, r := range releases {
-		keys = append(keys, datastore.NameKey(kind, r.UniqueID, nil))
-		input = append(input, &releases[i])
+	for _, r := range releases {
+		if err := r.Validate(); err != nil {
+			return err
+		}
 	}
+	for _, r := range releases {
+		if err := rs.put(ctx, r, false); err != nil {
+			return wrapError("load", r.UniqueID, err)
+		}
+	}
+	return nil
+}
 
-	if _, err := rs.client.PutMulti(context.Background(), keys, input); err != nil {
-		return fmt.Errorf("Error loading releases: %q", err)
+// History returns every stored revision of a release, oldest first
+func (rs ReleaseStore) History(ctx context.Context, uniqueID string) (store.Releases, error) {
+	releases := store.Releases{}
+	query := datastore.NewQuery(revisionKind).Ancestor(datastore.NameKey(kind, uniqueID, nil))
+	if _, err := rs.client.GetAll(ctx, query, &releases); err != nil {
+		return nil, wrapError("history", uniqueID, err)
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Revision < releases[j].Revision
+	})
+	return releases, nil
+}
+
+// Lock takes a lease on a release in a transaction, unless someone else holds
+// one that hasn't expired
+func (rs ReleaseStore) Lock(ctx context.Context, uniqueID, owner string, ttl time.Duration) (*store.Lease, error) {
+	lease := store.NewLease(uniqueID, owner, ttl)
+	key := datastore.NameKey(leaseKind, uniqueID, nil)
+	var held *store.Lease
+	_, err := rs.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		held = nil
+		current := &store.Lease{}
+		err := tx.Get(key, current)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && !current.Expired(time.Now()) {
+			held = current
+			return nil
+		}
+		_, err = tx.Put(key, &lease)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError("lock", uniqueID, err)
+	}
+	if held != nil {
+		return nil, store.NewLockedError(*held)
+	}
+	return &lease, nil
+}
+
+// Unlock releases a lease in a transaction, if it is still held
+func (rs ReleaseStore) Unlock(ctx context.Context, lease store.Lease) error {
+	key := datastore.NameKey(leaseKind, lease.UniqueID, nil)
+	_, err := rs.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		current := &store.Lease{}
+		if err := tx.Get(key, current); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if current.Token != lease.Token {
+			return nil
+		}
+		return tx.Delete(key)
+	})
+	if err != nil {
+		return wrapError("unlock", lease.UniqueID, err)
 	}
 	return nil
 }
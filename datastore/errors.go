@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"github.com/skuid/helm-value-store/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// codeKinds maps gRPC status codes returned by Datastore onto store error kinds
+var codeKinds = map[codes.Code]error{
+	codes.NotFound:           store.ErrNotFound,
+	codes.AlreadyExists:      store.ErrAlreadyExists,
+	codes.Aborted:            store.ErrConflict,
+	codes.InvalidArgument:    store.ErrInvalidRelease,
+	codes.Unavailable:        store.ErrUnavailable,
+	codes.DeadlineExceeded:   store.ErrUnavailable,
+	codes.ResourceExhausted:  store.ErrUnavailable,
+	codes.PermissionDenied:   store.ErrPermissionDenied,
+	codes.Unauthenticated:    store.ErrPermissionDenied,
+	codes.Canceled:           store.ErrUnavailable,
+	codes.FailedPrecondition: store.ErrUnavailable,
+}
+
+// wrapError maps a Datastore error onto a store error kind
+func wrapError(op, uniqueID string, err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case datastore.MultiError:
+		// Report the first failure of a multi-entity operation
+		for _, merr := range e {
+			if merr != nil {
+				return wrapError(op, uniqueID, merr)
+			}
+		}
+		return nil
+	case *datastore.ErrFieldMismatch:
+		return store.NewError(op, uniqueID, store.ErrInvalidRelease, err)
+	}
+
+	switch err {
+	case store.ErrConflict:
+		return store.NewError(op, uniqueID, store.ErrConflict, nil)
+	case datastore.ErrNoSuchEntity:
+		return store.NewError(op, uniqueID, store.ErrNotFound, err)
+	case datastore.ErrConcurrentTransaction:
+		return store.NewError(op, uniqueID, store.ErrConflict, err)
+	case datastore.ErrInvalidKey, datastore.ErrInvalidEntityType:
+		return store.NewError(op, uniqueID, store.ErrInvalidRelease, err)
+	}
+
+	if s, ok := status.FromError(err); ok {
+		if kind, ok := codeKinds[s.Code()]; ok {
+			return store.NewError(op, uniqueID, kind, err)
+		}
+	}
+	return fmt.Errorf("Error during %s: %q", op, err)
+}
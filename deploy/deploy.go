@@ -0,0 +1,76 @@
+// Package deploy installs releases from the store into a cluster.
+package deploy
+
+import (
+	"path"
+
+	"github.com/skuid/helm-value-store/store"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// Options are options for changing a deployed release
+type Options struct {
+	DryRun bool
+	// Timeout is the time in seconds to wait for any individual kubernetes
+	// operation (like Jobs for hooks)
+	Timeout int64
+}
+
+// A Deployer installs and inspects releases in a cluster. Releases are
+// identified by their Name.
+type Deployer interface {
+	// Get returns the deployed release. If it isn't deployed, the error
+	// satisfies store.IsNotFound
+	Get(r store.Release) (*hapi_release.Release, error)
+	// Install creates a new release from the chart at chartLocation with
+	// the release's values
+	Install(r store.Release, chartLocation string, opts Options) (*hapi_release.Release, error)
+	// Upgrade updates a deployed release to the chart at chartLocation with
+	// the release's values
+	Upgrade(r store.Release, chartLocation string, opts Options) (*hapi_release.Release, error)
+	// History returns up to max revisions of the deployed release
+	History(r store.Release, max int32) ([]*hapi_release.Release, error)
+	// Rollback rolls the deployed release back to a previous revision
+	Rollback(r store.Release, version int32, opts Options) (*hapi_release.Release, error)
+}
+
+// A Lister lists the releases deployed in a cluster
+type Lister interface {
+	// List returns the newest revision of every deployed release
+	List() ([]*hapi_release.Release, error)
+}
+
+// Imported returns a release for the store from a deployed release, with its
+// chart, version, namespace and the values it was deployed with. Tiller
+// doesn't record which repository a chart came from, so the chart is prefixed
+// with repo.
+func Imported(rel *hapi_release.Release, repo string, labels map[string]string) store.Release {
+	r := store.Release{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Labels:    labels,
+	}
+	if md := rel.GetChart().GetMetadata(); md != nil {
+		r.Chart = path.Join(repo, md.Name)
+		r.Version = md.Version
+	}
+	if rel.GetConfig() != nil {
+		r.Values = rel.Config.Raw
+	}
+	return r
+}
+
+// Upsert installs a release if it isn't deployed, and upgrades it otherwise.
+// It returns "installed" or "upgraded", and the deployed release.
+func Upsert(d Deployer, r store.Release, chartLocation string, opts Options) (string, *hapi_release.Release, error) {
+	_, err := d.Get(r)
+	if store.IsNotFound(err) {
+		deployed, err := d.Install(r, chartLocation, opts)
+		return "installed", deployed, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	deployed, err := d.Upgrade(r, chartLocation, opts)
+	return "upgraded", deployed, err
+}
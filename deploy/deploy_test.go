@@ -0,0 +1,164 @@
+package deploy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func TestUpsert(t *testing.T) {
+	f := NewFake()
+	r := store.Release{Name: "prom", Chart: "stable/prometheus", Version: "0.1.0", Values: "replicas: 2\n"}
+
+	action, deployed, err := Upsert(f, r, "prometheus.tgz", Options{Timeout: 300})
+	if err != nil || action != "installed" || deployed.Version != 1 {
+		t.Fatalf("Expected the first upsert to install revision 1, got %s, %v, %v", action, deployed, err)
+	}
+
+	r.Values = "replicas: 3\n"
+	action, deployed, err = Upsert(f, r, "prometheus.tgz", Options{Timeout: 300})
+	if err != nil || action != "upgraded" || deployed.Version != 2 {
+		t.Fatalf("Expected the second upsert to upgrade to revision 2, got %s, %v, %v", action, deployed, err)
+	}
+
+	got, err := f.Get(r)
+	if err != nil {
+		t.Fatalf("Error getting deployed release: %s", err)
+	}
+	if got.Config.Raw != r.Values || got.Chart.Metadata.Name != "prometheus" || got.Chart.Metadata.Version != "0.1.0" {
+		t.Errorf("Expected the deployed release to match %v, got %v", r, got)
+	}
+
+	actions := []string{}
+	for _, call := range f.Calls() {
+		actions = append(actions, call.Action)
+	}
+	if want := []string{"install", "upgrade"}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("Expected calls %v, got %v", want, actions)
+	}
+}
+
+func TestUpsertError(t *testing.T) {
+	f := NewFake()
+	f.Errors["prom"] = errors.New("tiller is down")
+
+	_, _, err := Upsert(f, store.Release{Name: "prom"}, "prometheus.tgz", Options{})
+	if err == nil {
+		t.Errorf("Expected the configured error, got nil")
+	}
+	if _, err := f.Get(store.Release{Name: "prom"}); !store.IsNotFound(err) {
+		t.Errorf("Expected nothing to be deployed after a failure, got %v", err)
+	}
+}
+
+func TestFakeDryRun(t *testing.T) {
+	f := NewFake()
+	r := store.Release{Name: "prom"}
+	if _, err := f.Install(r, "prometheus.tgz", Options{DryRun: true}); err != nil {
+		t.Fatalf("Error installing release: %s", err)
+	}
+	if _, err := f.Get(r); !store.IsNotFound(err) {
+		t.Errorf("Expected a dry run install to deploy nothing, got %v", err)
+	}
+}
+
+func TestFakeRollback(t *testing.T) {
+	f := NewFake()
+	r := store.Release{Name: "prom", Values: "replicas: 1\n"}
+	f.Install(r, "prometheus.tgz", Options{})
+	r.Values = "replicas: 2\n"
+	f.Upgrade(r, "prometheus.tgz", Options{})
+
+	rolledBack, err := f.Rollback(r, 1, Options{})
+	if err != nil {
+		t.Fatalf("Error rolling back: %s", err)
+	}
+	if rolledBack.Version != 3 || rolledBack.Config.Raw != "replicas: 1\n" {
+		t.Errorf("Expected revision 3 with the values of revision 1, got %v", rolledBack)
+	}
+
+	history, err := f.History(r, 2)
+	if err != nil {
+		t.Fatalf("Error getting history: %s", err)
+	}
+	versions := []int32{}
+	for _, rel := range history {
+		versions = append(versions, rel.Version)
+	}
+	if want := []int32{3, 2}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("Expected history %v, got %v", want, versions)
+	}
+	if _, err := f.Rollback(r, 7, Options{}); err == nil {
+		t.Errorf("Expected an error rolling back to a missing revision")
+	}
+}
+
+func TestTillerGet(t *testing.T) {
+	tiller := NewTiller(&helm.FakeClient{
+		Rels: []*hapi_release.Release{helm.ReleaseMock(&helm.MockReleaseOptions{Name: "prom"})},
+	})
+	deployed, err := tiller.Get(store.Release{Name: "prom"})
+	if err != nil || deployed.Name != "prom" {
+		t.Errorf("Expected to get the deployed release, got %v, %v", deployed, err)
+	}
+	if _, err := tiller.Get(store.Release{Name: "missing"}); !store.IsNotFound(err) {
+		t.Errorf("Expected a missing release to be not found, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	f := NewFake()
+	for _, r := range []store.Release{{Name: "prom"}, {Name: "alertmanager"}, {Name: "prom", Values: "replicas: 2\n"}} {
+		if _, _, err := Upsert(f, r, "chart.tgz", Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listers := map[string]Lister{"fake": f, "tiller": NewTiller(f.Client)}
+	for name, lister := range listers {
+		releases, err := lister.List()
+		if err != nil {
+			t.Errorf("Test '%s': Unexpected error: %s", name, err)
+			continue
+		}
+		names := map[string]bool{}
+		for _, rel := range releases {
+			names[rel.Name] = true
+		}
+		if !names["prom"] || !names["alertmanager"] {
+			t.Errorf("Test '%s': Expected prom and alertmanager to be listed, got %v", name, names)
+		}
+	}
+
+	releases, _ := f.List()
+	if len(releases) != 2 || releases[1].Name != "prom" || releases[1].Version != 2 {
+		t.Errorf("Expected the fake to list only the newest revision of each release, got %v", releases)
+	}
+}
+
+func TestImported(t *testing.T) {
+	rel := helm.ReleaseMock(&helm.MockReleaseOptions{
+		Name:      "prom",
+		Namespace: "monitoring",
+		Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: "prometheus", Version: "5.0.1"}},
+	})
+	rel.Config = &chart.Config{Raw: "replicas: 2\n"}
+
+	got := Imported(rel, "stable", map[string]string{"environment": "prod"})
+	want := store.Release{
+		Name:      "prom",
+		Namespace: "monitoring",
+		Chart:     "stable/prometheus",
+		Version:   "5.0.1",
+		Values:    "replicas: 2\n",
+		Labels:    map[string]string{"environment": "prod"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,192 @@
+package deploy
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/skuid/helm-value-store/store"
+	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// A Call is a change made to a Fake deployer
+type Call struct {
+	// Action is "install", "upgrade" or "rollback"
+	Action  string
+	Release store.Release
+	// Version is the revision rolled back to
+	Version int32
+	Options Options
+}
+
+// Fake is a Deployer that keeps releases in memory, in a helm.FakeClient.
+// Deployed releases record the chart name and version and the values they
+// were deployed with, and every change is recorded in Calls. It is safe for
+// concurrent use.
+type Fake struct {
+	// Client holds every revision of every deployed release
+	Client *helm.FakeClient
+	// Errors makes changes to a release with the given name fail
+	Errors map[string]error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewFake creates a Fake deployer with releases already deployed
+func NewFake(deployed ...*hapi_release.Release) *Fake {
+	return &Fake{
+		Client: &helm.FakeClient{Rels: deployed},
+		Errors: map[string]error{},
+	}
+}
+
+// Calls returns the changes made so far, in order
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call{}, f.calls...)
+}
+
+// latest returns the newest revision of a release. The caller must hold the
+// lock.
+func (f *Fake) latest(name string) *hapi_release.Release {
+	var latest *hapi_release.Release
+	for _, rel := range f.Client.Rels {
+		if rel.Name == name && (latest == nil || rel.Version > latest.Version) {
+			latest = rel
+		}
+	}
+	return latest
+}
+
+// record records a call and returns the configured error for the release.
+// The caller must hold the lock.
+func (f *Fake) record(call Call) error {
+	f.calls = append(f.calls, call)
+	return f.Errors[call.Release.Name]
+}
+
+// deploy adds a new revision of a release. The caller must hold the lock.
+func (f *Fake) deploy(r store.Release, version int32) *hapi_release.Release {
+	rel := helm.ReleaseMock(&helm.MockReleaseOptions{
+		Name:      r.Name,
+		Version:   version,
+		Namespace: r.Namespace,
+		Chart: &chart.Chart{Metadata: &chart.Metadata{
+			Name:    path.Base(r.Chart),
+			Version: r.Version,
+		}},
+	})
+	rel.Config = &chart.Config{Raw: r.Values}
+	f.Client.Rels = append(f.Client.Rels, rel)
+	return rel
+}
+
+// Get returns the newest revision of the deployed release
+func (f *Fake) Get(r store.Release) (*hapi_release.Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rel := f.latest(r.Name)
+	if rel == nil {
+		return nil, store.NewError("get deployed release", r.Name, store.ErrNotFound, nil)
+	}
+	return rel, nil
+}
+
+// Install deploys the first revision of a release
+func (f *Fake) Install(r store.Release, chartLocation string, opts Options) (*hapi_release.Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record(Call{Action: "install", Release: r, Options: opts}); err != nil {
+		return nil, err
+	}
+	if f.latest(r.Name) != nil {
+		return nil, fmt.Errorf("release %s is already deployed", r.Name)
+	}
+	rel := f.deploy(r, 1)
+	if opts.DryRun {
+		f.Client.Rels = f.Client.Rels[:len(f.Client.Rels)-1]
+	}
+	return rel, nil
+}
+
+// Upgrade deploys a new revision of a release
+func (f *Fake) Upgrade(r store.Release, chartLocation string, opts Options) (*hapi_release.Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record(Call{Action: "upgrade", Release: r, Options: opts}); err != nil {
+		return nil, err
+	}
+	latest := f.latest(r.Name)
+	if latest == nil {
+		return nil, store.NewError("upgrade", r.Name, store.ErrNotFound, nil)
+	}
+	if opts.DryRun {
+		return latest, nil
+	}
+	return f.deploy(r, latest.Version+1), nil
+}
+
+// History returns up to max revisions of a release, newest first
+func (f *Fake) History(r store.Release, max int32) ([]*hapi_release.Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	history := []*hapi_release.Release{}
+	for i := len(f.Client.Rels) - 1; i >= 0 && int32(len(history)) < max; i-- {
+		if f.Client.Rels[i].Name == r.Name {
+			history = append(history, f.Client.Rels[i])
+		}
+	}
+	if len(history) == 0 {
+		return nil, store.NewError("get deployed history", r.Name, store.ErrNotFound, nil)
+	}
+	return history, nil
+}
+
+// Rollback deploys a copy of a previous revision as a new revision
+func (f *Fake) Rollback(r store.Release, version int32, opts Options) (*hapi_release.Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record(Call{Action: "rollback", Release: r, Version: version, Options: opts}); err != nil {
+		return nil, err
+	}
+	latest := f.latest(r.Name)
+	for _, rel := range f.Client.Rels {
+		if rel.Name == r.Name && rel.Version == version {
+			if opts.DryRun {
+				return latest, nil
+			}
+			next := *rel
+			next.Version = latest.Version + 1
+			f.Client.Rels = append(f.Client.Rels, &next)
+			return &next, nil
+		}
+	}
+	return nil, fmt.Errorf("release %s has no revision %d", r.Name, version)
+}
+
+// List returns the newest revision of every deployed release, sorted by name
+func (f *Fake) List() ([]*hapi_release.Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := map[string]bool{}
+	releases := []*hapi_release.Release{}
+	for _, rel := range f.Client.Rels {
+		if !names[rel.Name] {
+			names[rel.Name] = true
+			releases = append(releases, f.latest(rel.Name))
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].Name < releases[j].Name })
+	return releases, nil
+}
@@ -0,0 +1,120 @@
+package deploy
+
+import (
+	"strings"
+
+	"github.com/skuid/helm-value-store/store"
+	"k8s.io/helm/pkg/helm"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// listPageSize is the number of releases listed from Tiller at a time
+const listPageSize = 256
+
+// Tiller is a Deployer that talks to a Tiller server
+type Tiller struct {
+	client helm.Interface
+}
+
+// NewTiller creates a Tiller deployer from a helm client
+func NewTiller(client helm.Interface) *Tiller {
+	return &Tiller{client: client}
+}
+
+// NewTillerHost creates a Tiller deployer for the Tiller server at host
+func NewTillerHost(host string) *Tiller {
+	return NewTiller(helm.NewClient(helm.Host(host)))
+}
+
+func notFound(op string, r store.Release, err error) error {
+	// Tiller reports `release: "name" not found`, and helm's fake client
+	// reports "No such release: name"
+	if err != nil && (strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "No such release")) {
+		return store.NewError(op, r.Name, store.ErrNotFound, err)
+	}
+	return err
+}
+
+// Get returns the deployed release's content from Tiller
+func (t *Tiller) Get(r store.Release) (*hapi_release.Release, error) {
+	resp, err := t.client.ReleaseContent(r.Name)
+	if err != nil {
+		return nil, notFound("get deployed release", r, err)
+	}
+	return resp.Release, nil
+}
+
+// Install creates a new release in a cluster
+func (t *Tiller) Install(r store.Release, chartLocation string, opts Options) (*hapi_release.Release, error) {
+	resp, err := t.client.InstallRelease(
+		chartLocation,
+		r.Namespace,
+		helm.ValueOverrides([]byte(r.Values)),
+		helm.ReleaseName(r.Name),
+		helm.InstallDryRun(opts.DryRun),
+		helm.InstallTimeout(opts.Timeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Release, nil
+}
+
+// Upgrade sends an update to an existing release in a cluster
+func (t *Tiller) Upgrade(r store.Release, chartLocation string, opts Options) (*hapi_release.Release, error) {
+	resp, err := t.client.UpdateRelease(
+		r.Name,
+		chartLocation,
+		helm.UpdateValueOverrides([]byte(r.Values)),
+		helm.UpgradeDryRun(opts.DryRun),
+		helm.UpgradeTimeout(opts.Timeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Release, nil
+}
+
+// History gets up to max revisions of the release from Tiller
+func (t *Tiller) History(r store.Release, max int32) ([]*hapi_release.Release, error) {
+	resp, err := t.client.ReleaseHistory(r.Name, helm.WithMaxHistory(max))
+	if err != nil {
+		return nil, notFound("get deployed history", r, err)
+	}
+	return resp.Releases, nil
+}
+
+// Rollback rolls the release in the cluster back to a previous Tiller revision
+func (t *Tiller) Rollback(r store.Release, version int32, opts Options) (*hapi_release.Release, error) {
+	resp, err := t.client.RollbackRelease(
+		r.Name,
+		helm.RollbackVersion(version),
+		helm.RollbackDryRun(opts.DryRun),
+		helm.RollbackTimeout(opts.Timeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Release, nil
+}
+
+// List returns every deployed release from Tiller
+func (t *Tiller) List() ([]*hapi_release.Release, error) {
+	releases := []*hapi_release.Release{}
+	offset := ""
+	for {
+		resp, err := t.client.ListReleases(
+			helm.ReleaseListStatuses([]hapi_release.Status_Code{hapi_release.Status_DEPLOYED}),
+			helm.ReleaseListLimit(listPageSize),
+			helm.ReleaseListOffset(offset),
+		)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, resp.Releases...)
+		if len(resp.Next) == 0 {
+			return releases, nil
+		}
+		offset = resp.Next
+	}
+}
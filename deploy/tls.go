@@ -0,0 +1,72 @@
+package deploy
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/tlsutil"
+)
+
+// TLSOptions configures the connection to a Tiller server running with --tls
+// or --tls-verify
+type TLSOptions struct {
+	// Enable connects over TLS without verifying Tiller's certificate
+	Enable bool `json:"enable,omitempty"`
+	// Verify connects over TLS and verifies Tiller's certificate
+	Verify bool `json:"verify,omitempty"`
+	// CACertFile is the CA to verify Tiller's certificate with. The system
+	// roots are used if empty
+	CACertFile string `json:"caCert,omitempty"`
+	// CertFile and KeyFile are the client certificate presented to Tiller
+	CertFile string `json:"cert,omitempty"`
+	KeyFile  string `json:"key,omitempty"`
+	// ServerName overrides the name Tiller's certificate is verified against,
+	// for example when connecting through a port-forward
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// Enabled returns true if the connection uses TLS
+func (o TLSOptions) Enabled() bool {
+	return o.Enable || o.Verify
+}
+
+// Config returns the TLS configuration for a helm client
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if (len(o.CertFile) == 0) != (len(o.KeyFile) == 0) {
+		return nil, fmt.Errorf("Both a TLS certificate and key are required, got cert %q and key %q", o.CertFile, o.KeyFile)
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: !o.Verify,
+		ServerName:         o.ServerName,
+	}
+	if len(o.CertFile) > 0 {
+		cert, err := tlsutil.CertFromFilePair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	if o.Verify && len(o.CACertFile) > 0 {
+		pool, err := tlsutil.CertPoolFromFile(o.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// NewTillerTLS creates a Tiller deployer for the Tiller server at host,
+// connecting over TLS if it is enabled in tlsOpts
+func NewTillerTLS(host string, tlsOpts TLSOptions) (*Tiller, error) {
+	if !tlsOpts.Enabled() {
+		return NewTillerHost(host), nil
+	}
+	cfg, err := tlsOpts.Config()
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring TLS for Tiller: %q", err)
+	}
+	return NewTiller(helm.NewClient(helm.Host(host), helm.WithTLS(cfg))), nil
+}
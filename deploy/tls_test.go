@@ -0,0 +1,112 @@
+package deploy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and its key to dir
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tiller-deploy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir)
+
+	cases := []struct {
+		name         string
+		opts         TLSOptions
+		wantErr      bool
+		wantInsecure bool
+		wantCerts    int
+		wantRoots    bool
+	}{
+		{"enable", TLSOptions{Enable: true}, false, true, 0, false},
+		{"verify with system roots", TLSOptions{Verify: true}, false, false, 0, false},
+		{"verify with CA", TLSOptions{Verify: true, CACertFile: certFile}, false, false, 0, true},
+		{"mutual TLS", TLSOptions{Verify: true, CACertFile: certFile, CertFile: certFile, KeyFile: keyFile}, false, false, 1, true},
+		{"cert without key", TLSOptions{Verify: true, CertFile: certFile}, true, false, 0, false},
+		{"missing CA", TLSOptions{Verify: true, CACertFile: filepath.Join(dir, "missing.pem")}, true, false, 0, false},
+		{"bad key pair", TLSOptions{Enable: true, CertFile: certFile, KeyFile: certFile}, true, false, 0, false},
+	}
+
+	for _, c := range cases {
+		cfg, err := c.opts.Config()
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Test '%s': Expected an error, got nil", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%s': Unexpected error: %s", c.name, err)
+			continue
+		}
+		if cfg.InsecureSkipVerify != c.wantInsecure {
+			t.Errorf("Test '%s': Expected InsecureSkipVerify to be %t", c.name, c.wantInsecure)
+		}
+		if len(cfg.Certificates) != c.wantCerts {
+			t.Errorf("Test '%s': Expected %d client certificates, got %d", c.name, c.wantCerts, len(cfg.Certificates))
+		}
+		if (cfg.RootCAs != nil) != c.wantRoots {
+			t.Errorf("Test '%s': Expected a CA pool: %t", c.name, c.wantRoots)
+		}
+	}
+
+	cfg, err := TLSOptions{Verify: true, ServerName: "tiller-deploy"}.Config()
+	if err != nil || cfg.ServerName != "tiller-deploy" {
+		t.Errorf("Expected the server name to be overridden, got %v, %v", cfg, err)
+	}
+}
+
+func TestNewTillerTLS(t *testing.T) {
+	if _, err := NewTillerTLS("localhost:44134", TLSOptions{}); err != nil {
+		t.Errorf("Unexpected error without TLS: %s", err)
+	}
+	if _, err := NewTillerTLS("localhost:44134", TLSOptions{Verify: true, CertFile: "cert.pem"}); err == nil {
+		t.Errorf("Expected an error for a certificate without a key")
+	}
+}
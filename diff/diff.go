@@ -0,0 +1,245 @@
+// Package diff compares stored releases against what is deployed in a
+// cluster.
+package diff
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/skuid/helm-value-store/refs"
+	"github.com/skuid/helm-value-store/store"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// Kind is the kind of a Change
+type Kind string
+
+const (
+	// Added is a value that is only in the new values
+	Added Kind = "added"
+	// Removed is a value that is only in the old values
+	Removed Kind = "removed"
+	// Changed is a value that differs between the old and new values
+	Changed Kind = "changed"
+)
+
+// A Change is a single difference between two sets of values
+type Change struct {
+	// Path is the dot-separated path to the value, with list indexes in
+	// brackets, such as image.tag or hosts[0]
+	Path string      `json:"path"`
+	Kind Kind        `json:"kind"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Values returns the changes from the old YAML values to the new ones, ordered
+// by path. Values that are a secret reference in the new values are skipped,
+// since they can't be compared without resolving the secret.
+func Values(old, new string) ([]Change, error) {
+	oldValues := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(old), &oldValues); err != nil {
+		return nil, fmt.Errorf("Error parsing old values: %s", err)
+	}
+	newValues := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(new), &newValues); err != nil {
+		return nil, fmt.Errorf("Error parsing new values: %s", err)
+	}
+
+	changes := []Change{}
+	compare("", oldValues, newValues, &changes)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func join(prefix, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func compare(prefix string, old, new interface{}, changes *[]Change) {
+	if s, ok := new.(string); ok && refs.IsRef(s) {
+		return
+	}
+
+	switch o := old.(type) {
+	case map[string]interface{}:
+		if n, ok := new.(map[string]interface{}); ok {
+			for k, ov := range o {
+				if nv, ok := n[k]; ok {
+					compare(join(prefix, k), ov, nv, changes)
+				} else {
+					*changes = append(*changes, Change{Path: join(prefix, k), Kind: Removed, Old: ov})
+				}
+			}
+			for k, nv := range n {
+				if _, ok := o[k]; !ok {
+					if s, ok := nv.(string); ok && refs.IsRef(s) {
+						continue
+					}
+					*changes = append(*changes, Change{Path: join(prefix, k), Kind: Added, New: nv})
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if n, ok := new.([]interface{}); ok && len(o) == len(n) {
+			for i := range o {
+				compare(prefix+"["+strconv.Itoa(i)+"]", o[i], n[i], changes)
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, Change{Path: prefix, Kind: Changed, Old: old, New: new})
+	}
+}
+
+// A ReleaseDiff is the difference between a deployed release and a stored
+// release. Old values are the deployed ones, and new values are the stored
+// ones that an install would deploy.
+type ReleaseDiff struct {
+	UniqueID string `json:"unique_id"`
+	Name     string `json:"name"`
+	// Missing is true if the release isn't deployed at all
+	Missing bool `json:"missing"`
+	// Chart and Version are nil if they are unchanged
+	Chart   *Change  `json:"chart,omitempty"`
+	Version *Change  `json:"version,omitempty"`
+	Values  []Change `json:"values"`
+}
+
+// Empty reports whether there are no differences
+func (d ReleaseDiff) Empty() bool {
+	return !d.Missing && d.Chart == nil && d.Version == nil && len(d.Values) == 0
+}
+
+// Reasons lists what differs: "missing", "chart", "version" and "values"
+func (d ReleaseDiff) Reasons() []string {
+	reasons := []string{}
+	if d.Missing {
+		reasons = append(reasons, "missing")
+	}
+	if d.Chart != nil {
+		reasons = append(reasons, "chart")
+	}
+	if d.Version != nil {
+		reasons = append(reasons, "version")
+	}
+	if len(d.Values) > 0 {
+		reasons = append(reasons, "values")
+	}
+	return reasons
+}
+
+// Missing returns the diff of a stored release that isn't deployed
+func Missing(stored store.Release) *ReleaseDiff {
+	return &ReleaseDiff{UniqueID: stored.UniqueID, Name: stored.Name, Missing: true, Values: []Change{}}
+}
+
+// Release compares a stored release with the release deployed in Tiller.
+// The chart is compared by name, without the repository, and the version is
+// only compared if the stored release has one.
+func Release(stored store.Release, deployed *hapi_release.Release) (*ReleaseDiff, error) {
+	d := &ReleaseDiff{UniqueID: stored.UniqueID, Name: stored.Name}
+
+	chartName := path.Base(stored.Chart)
+	metadata := deployed.GetChart().GetMetadata()
+	if deployedName := metadata.GetName(); deployedName != chartName {
+		d.Chart = &Change{Path: "chart", Kind: Changed, Old: deployedName, New: chartName}
+	}
+	if deployedVersion := metadata.GetVersion(); len(stored.Version) > 0 && deployedVersion != stored.Version {
+		d.Version = &Change{Path: "version", Kind: Changed, Old: deployedVersion, New: stored.Version}
+	}
+
+	values, err := Values(deployed.GetConfig().GetRaw(), stored.Values)
+	if err != nil {
+		return nil, err
+	}
+	d.Values = values
+	return d, nil
+}
+
+// MatchingRevision returns the newest revision in a stored release's history
+// with the same chart, version and values as a deployed release, or nil if
+// there isn't one
+func MatchingRevision(history store.Releases, deployed *hapi_release.Release) (*store.Release, error) {
+	for i := len(history) - 1; i >= 0; i-- {
+		d, err := Release(history[i], deployed)
+		if err != nil {
+			return nil, err
+		}
+		if d.Empty() {
+			match := history[i]
+			return &match, nil
+		}
+	}
+	return nil, nil
+}
+
+const (
+	red   = "\x1b[31m"
+	green = "\x1b[32m"
+	reset = "\x1b[0m"
+)
+
+func format(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		out, err := yaml.Marshal(v)
+		if err == nil {
+			return strings.TrimSpace(strings.Replace(string(out), "\n", " ", -1))
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// Fprint writes a change as removed and added lines, colored red and green
+// if color is true
+func (c Change) Fprint(w io.Writer, color bool) {
+	line := func(sign, colorCode string, v interface{}) {
+		if color {
+			fmt.Fprintf(w, "%s%s %s: %s%s\n", colorCode, sign, c.Path, format(v), reset)
+		} else {
+			fmt.Fprintf(w, "%s %s: %s\n", sign, c.Path, format(v))
+		}
+	}
+	if c.Kind != Added {
+		line("-", red, c.Old)
+	}
+	if c.Kind != Removed {
+		line("+", green, c.New)
+	}
+}
+
+// Fprint writes the differences of a release, colored if color is true
+func (d ReleaseDiff) Fprint(w io.Writer, color bool) {
+	fmt.Fprintf(w, "# %s: %s\n", d.Name, d.UniqueID)
+	if d.Missing {
+		fmt.Fprintln(w, "Not deployed, install would create it")
+		return
+	}
+	if d.Empty() {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+	for _, c := range []*Change{d.Chart, d.Version} {
+		if c != nil {
+			c.Fprint(w, color)
+		}
+	}
+	for _, c := range d.Values {
+		c.Fprint(w, color)
+	}
+}
@@ -0,0 +1,200 @@
+package diff
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	hapi_release "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func TestValues(t *testing.T) {
+	cases := []struct {
+		name string
+		old  string
+		new  string
+		want []Change
+	}{
+		{"no changes", "replicas: 2\n", "replicas: 2\n", []Change{}},
+		{
+			"scalar changes",
+			"replicas: 2\nimage:\n  tag: v1\n  pullPolicy: Always\n",
+			"replicas: 3\nimage:\n  tag: v2\ndebug: true\n",
+			[]Change{
+				{Path: "debug", Kind: Added, New: true},
+				{Path: "image.pullPolicy", Kind: Removed, Old: "Always"},
+				{Path: "image.tag", Kind: Changed, Old: "v1", New: "v2"},
+				{Path: "replicas", Kind: Changed, Old: float64(2), New: float64(3)},
+			},
+		},
+		{
+			"lists",
+			"hosts:\n- a\n- b\nports:\n- 80\n",
+			"hosts:\n- a\n- c\nports:\n- 80\n- 443\n",
+			[]Change{
+				{Path: "hosts[1]", Kind: Changed, Old: "b", New: "c"},
+				{Path: "ports", Kind: Changed, Old: []interface{}{float64(80)}, New: []interface{}{float64(80), float64(443)}},
+			},
+		},
+		{
+			"type changes",
+			"resources: none\n",
+			"resources:\n  cpu: 1\n",
+			[]Change{
+				{Path: "resources", Kind: Changed, Old: "none", New: map[string]interface{}{"cpu": float64(1)}},
+			},
+		},
+		{
+			"references are skipped",
+			"password: hunter2\n",
+			"password: ref+env://PASSWORD\ntoken: ref+env://TOKEN\n",
+			[]Change{},
+		},
+	}
+
+	for _, c := range cases {
+		got, err := Values(c.old, c.new)
+		if err != nil {
+			t.Errorf("Test '%s': unexpected error %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Test '%s': Expected changes %#v, got %#v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	deployed := &hapi_release.Release{
+		Chart:  &chart.Chart{Metadata: &chart.Metadata{Name: "prometheus", Version: "0.1.0"}},
+		Config: &chart.Config{Raw: "replicas: 2\n"},
+	}
+
+	cases := []struct {
+		name        string
+		stored      store.Release
+		wantChart   bool
+		wantVersion bool
+		wantValues  int
+	}{
+		{"same", store.Release{Chart: "stable/prometheus", Version: "0.1.0", Values: "replicas: 2\n"}, false, false, 0},
+		{"no stored version", store.Release{Chart: "stable/prometheus", Values: "replicas: 2\n"}, false, false, 0},
+		{"new version", store.Release{Chart: "stable/prometheus", Version: "0.2.0", Values: "replicas: 3\n"}, false, true, 1},
+		{"new chart", store.Release{Chart: "stable/alertmanager", Version: "0.1.0", Values: "replicas: 2\n"}, true, false, 0},
+	}
+
+	for _, c := range cases {
+		d, err := Release(c.stored, deployed)
+		if err != nil {
+			t.Errorf("Test '%s': unexpected error %s", c.name, err)
+			continue
+		}
+		if (d.Chart != nil) != c.wantChart {
+			t.Errorf("Test '%s': Expected chart change %t, got %v", c.name, c.wantChart, d.Chart)
+		}
+		if (d.Version != nil) != c.wantVersion {
+			t.Errorf("Test '%s': Expected version change %t, got %v", c.name, c.wantVersion, d.Version)
+		}
+		if len(d.Values) != c.wantValues {
+			t.Errorf("Test '%s': Expected %d value changes, got %v", c.name, c.wantValues, d.Values)
+		}
+		if d.Empty() != (!c.wantChart && !c.wantVersion && c.wantValues == 0) {
+			t.Errorf("Test '%s': Empty() returned %t", c.name, d.Empty())
+		}
+	}
+}
+
+func TestMatchingRevision(t *testing.T) {
+	deployed := &hapi_release.Release{
+		Chart:  &chart.Chart{Metadata: &chart.Metadata{Name: "prometheus", Version: "0.1.0"}},
+		Config: &chart.Config{Raw: "replicas: 2\n"},
+	}
+	history := store.Releases{
+		{Chart: "stable/prometheus", Version: "0.1.0", Values: "replicas: 2\n", Revision: 1},
+		{Chart: "stable/prometheus", Version: "0.1.0", Values: "replicas: 3\n", Revision: 2},
+		{Chart: "stable/prometheus", Version: "0.1.0", Values: "replicas: 2\n", Revision: 3},
+		{Chart: "stable/prometheus", Version: "0.2.0", Values: "replicas: 2\n", Revision: 4},
+	}
+
+	cases := []struct {
+		name    string
+		history store.Releases
+		want    int64
+	}{
+		{"newest match", history, 3},
+		{"older match", history[:2], 1},
+		{"no match", history[1:2], 0},
+		{"no history", store.Releases{}, 0},
+	}
+
+	for _, c := range cases {
+		got, err := MatchingRevision(c.history, deployed)
+		if err != nil {
+			t.Errorf("Test '%s': unexpected error %s", c.name, err)
+			continue
+		}
+		gotRevision := int64(0)
+		if got != nil {
+			gotRevision = got.Revision
+		}
+		if gotRevision != c.want {
+			t.Errorf("Test '%s': Expected revision %d, got %d", c.name, c.want, gotRevision)
+		}
+	}
+}
+
+func TestReasons(t *testing.T) {
+	cases := []struct {
+		name string
+		d    *ReleaseDiff
+		want []string
+	}{
+		{"in sync", &ReleaseDiff{}, []string{}},
+		{"missing", Missing(store.Release{UniqueID: "abc123"}), []string{"missing"}},
+		{
+			"everything",
+			&ReleaseDiff{
+				Chart:   &Change{Path: "chart", Kind: Changed},
+				Version: &Change{Path: "version", Kind: Changed},
+				Values:  []Change{{Path: "replicas", Kind: Changed}},
+			},
+			[]string{"chart", "version", "values"},
+		},
+	}
+
+	for _, c := range cases {
+		if got := c.d.Reasons(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Test '%s': Expected reasons %v, got %v", c.name, c.want, got)
+		}
+		if c.d.Empty() != (len(c.want) == 0) {
+			t.Errorf("Test '%s': Empty() returned %t", c.name, c.d.Empty())
+		}
+	}
+}
+
+func TestFprint(t *testing.T) {
+	d := ReleaseDiff{
+		UniqueID: "abc123",
+		Name:     "prom",
+		Version:  &Change{Path: "version", Kind: Changed, Old: "0.1.0", New: "0.2.0"},
+		Values: []Change{
+			{Path: "debug", Kind: Added, New: true},
+			{Path: "image.pullPolicy", Kind: Removed, Old: "Always"},
+		},
+	}
+	want := "# prom: abc123\n- version: 0.1.0\n+ version: 0.2.0\n+ debug: true\n- image.pullPolicy: Always\n"
+
+	buf := &bytes.Buffer{}
+	d.Fprint(buf, false)
+	if buf.String() != want {
+		t.Errorf("Expected output %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	d.Fprint(buf, true)
+	if !bytes.Contains(buf.Bytes(), []byte(green+"+ debug: true"+reset)) {
+		t.Errorf("Expected colored output, got %q", buf.String())
+	}
+}
@@ -0,0 +1,41 @@
+package dynamo
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/skuid/helm-value-store/store"
+)
+
+// errorKinds maps DynamoDB and AWS SDK error codes onto store error kinds
+var errorKinds = map[string]error{
+	dynamodb.ErrCodeConditionalCheckFailedException:          store.ErrConflict,
+	dynamodb.ErrCodeItemCollectionSizeLimitExceededException: store.ErrInvalidRelease,
+	"ValidationException":                                    store.ErrInvalidRelease,
+	dynamodb.ErrCodeResourceNotFoundException:                store.ErrUnavailable,
+	dynamodb.ErrCodeProvisionedThroughputExceededException:   store.ErrUnavailable,
+	"RequestLimitExceeded":                                   store.ErrUnavailable,
+	dynamodb.ErrCodeInternalServerError:                      store.ErrUnavailable,
+	"ThrottlingException":                                    store.ErrUnavailable,
+	"ServiceUnavailable":                                     store.ErrUnavailable,
+	"AccessDeniedException":                                  store.ErrPermissionDenied,
+	"UnrecognizedClientException":                            store.ErrPermissionDenied,
+	"NoCredentialProviders":                                  store.ErrUnavailable,
+	"RequestError":                                           store.ErrUnavailable,
+	request.ErrCodeResponseTimeout:                           store.ErrUnavailable,
+	request.CanceledErrorCode:                                store.ErrUnavailable,
+}
+
+// wrapError maps an AWS error onto a store error kind. Errors with no
+// matching kind are returned unchanged.
+func wrapError(op, uniqueID string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		if kind, ok := errorKinds[aerr.Code()]; ok {
+			return store.NewError(op, uniqueID, kind, err)
+		}
+	}
+	return err
+}
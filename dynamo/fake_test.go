@@ -0,0 +1,214 @@
+package dynamo
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+type item = map[string]*dynamodb.AttributeValue
+
+// fakeTableClient keeps DynamoDB tables in memory. Tables whose name ends in
+// "-history" are keyed by UniqueID and Revision, and every other table by
+// UniqueID. Scan filters are ignored, and only the condition expressions the
+// release store uses are understood.
+type fakeTableClient struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu     sync.Mutex
+	tables map[string]map[string]item
+	// failPuts fails PutItem calls to the named tables
+	failPuts map[string]error
+}
+
+func newFakeTableClient() *fakeTableClient {
+	return &fakeTableClient{tables: map[string]map[string]item{}, failPuts: map[string]error{}}
+}
+
+func itemKey(table string, it item) string {
+	key := aws.StringValue(it["UniqueID"].S)
+	if strings.HasSuffix(table, "-history") {
+		key += "/" + aws.StringValue(it["Revision"].N)
+	}
+	return key
+}
+
+func (c *fakeTableClient) table(name string) map[string]item {
+	if c.tables[name] == nil {
+		c.tables[name] = map[string]item{}
+	}
+	return c.tables[name]
+}
+
+func copyItem(it item) item {
+	response := item{}
+	for k, v := range it {
+		response[k] = v
+	}
+	return response
+}
+
+var errConditionFailed = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+
+// conditionHolds evaluates terms joined by OR, each of which is
+// attribute_not_exists(#name), #name = :value or #name <= :value
+func conditionHolds(it item, expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+	if expr == nil {
+		return true
+	}
+	for _, term := range strings.Split(*expr, " OR ") {
+		if strings.HasPrefix(term, "attribute_not_exists(") {
+			name := aws.StringValue(names[strings.TrimSuffix(strings.TrimPrefix(term, "attribute_not_exists("), ")")])
+			if _, ok := it[name]; !ok {
+				return true
+			}
+			continue
+		}
+		parts := strings.Fields(term)
+		attr, ok := it[aws.StringValue(names[parts[0]])]
+		if !ok {
+			continue
+		}
+		value := values[parts[2]]
+		switch parts[1] {
+		case "=":
+			if aws.StringValue(attr.S) == aws.StringValue(value.S) && aws.StringValue(attr.N) == aws.StringValue(value.N) {
+				return true
+			}
+		case "<=":
+			a, _ := strconv.ParseInt(aws.StringValue(attr.N), 10, 64)
+			b, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+			if a <= b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *fakeTableClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.table(*input.TableName)[itemKey(*input.TableName, input.Key)]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(it)}, nil
+}
+
+func (c *fakeTableClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.failPuts[*input.TableName]; err != nil {
+		return nil, err
+	}
+	table := c.table(*input.TableName)
+	key := itemKey(*input.TableName, input.Item)
+	if !conditionHolds(table[key], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, errConditionFailed
+	}
+	table[key] = copyItem(input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *fakeTableClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	table := c.table(*input.TableName)
+	key := itemKey(*input.TableName, input.Key)
+	if !conditionHolds(table[key], input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues) {
+		return nil, errConditionFailed
+	}
+	delete(table, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// query returns the items with the queried UniqueID, ordered by Revision
+func (c *fakeTableClient) query(input *dynamodb.QueryInput) []item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uniqueID := aws.StringValue(input.ExpressionAttributeValues[":id"].S)
+	items := []item{}
+	for _, it := range c.table(*input.TableName) {
+		if aws.StringValue(it["UniqueID"].S) == uniqueID {
+			items = append(items, copyItem(it))
+		}
+	}
+	revision := func(it item) int64 {
+		n, _ := strconv.ParseInt(aws.StringValue(it["Revision"].N), 10, 64)
+		return n
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if aws.BoolValue(input.ScanIndexForward) || input.ScanIndexForward == nil {
+			return revision(items[i]) < revision(items[j])
+		}
+		return revision(items[i]) > revision(items[j])
+	})
+	if input.Limit != nil && int64(len(items)) > *input.Limit {
+		items = items[:*input.Limit]
+	}
+	return items
+}
+
+func (c *fakeTableClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{Items: c.query(input)}, nil
+}
+
+func (c *fakeTableClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	fn(&dynamodb.QueryOutput{Items: c.query(input)}, true)
+	return nil
+}
+
+func (c *fakeTableClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	c.mu.Lock()
+	items := []item{}
+	for _, it := range c.table(*input.TableName) {
+		items = append(items, copyItem(it))
+	}
+	c.mu.Unlock()
+	fn(&dynamodb.ScanOutput{Items: items}, true)
+	return nil
+}
+
+func (c *fakeTableClient) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{}}
+	for name, keys := range input.RequestItems {
+		for _, key := range keys.Keys {
+			if it, ok := c.table(name)[itemKey(name, key)]; ok {
+				resp.Responses[name] = append(resp.Responses[name], copyItem(it))
+			}
+		}
+	}
+	return resp, nil
+}
+
+func (c *fakeTableClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, reqs := range input.RequestItems {
+		if len(reqs) > batchSize {
+			return nil, fmt.Errorf("batch of %d items is too large", len(reqs))
+		}
+		if err := c.failPuts[name]; err != nil {
+			return nil, err
+		}
+		for _, req := range reqs {
+			c.table(name)[itemKey(name, req.PutRequest.Item)] = copyItem(req.PutRequest.Item)
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func (c *fakeTableClient) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{}, nil
+}
@@ -0,0 +1,270 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/skuid/helm-value-store/store"
+)
+
+const (
+	// batchSize is the most items DynamoDB accepts in one BatchWriteItem call
+	batchSize = 25
+	// maxBatchRetries is how many times unprocessed or throttled items are
+	// retried before they are reported as failed
+	maxBatchRetries = 8
+)
+
+// exponentialBackoff returns a jittered delay that doubles with each attempt,
+// up to a few seconds
+func exponentialBackoff(attempt int) time.Duration {
+	if attempt > 7 {
+		attempt = 7
+	}
+	base := 50 * time.Millisecond << uint(attempt)
+	return base/2 + time.Duration(rand.Int63n(int64(base/2)))
+}
+
+// retryable reports whether a BatchWriteItem error is worth retrying
+func retryable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException,
+		dynamodb.ErrCodeInternalServerError,
+		"RequestLimitExceeded",
+		"ThrottlingException",
+		"ServiceUnavailable":
+		return true
+	}
+	return false
+}
+
+// LoadWithProgress bulk-writes releases to DynamoDB in batches of 25,
+// retrying unprocessed and throttled items with backoff. Every release is
+// validated before anything is written. progress, if not nil, is called with
+// the outcome of each release, and a *store.LoadError lists any releases that
+// could not be written.
+//
+// The stored revisions of each batch are read before it is written, since
+// batches can't be written conditionally. Releases changed by someone else
+// while they are loaded may have a revision written twice.
+func (rs ReleaseStore) LoadWithProgress(ctx context.Context, releases store.Releases, progress store.LoadProgressFunc) error {
+	// Later releases with the same UniqueID replace earlier ones, since
+	// DynamoDB rejects batches that contain duplicate keys
+	pending := store.Releases{}
+	index := map[string]int{}
+	for _, r := range releases {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if i, ok := index[r.UniqueID]; ok {
+			pending[i] = r
+		} else {
+			index[r.UniqueID] = len(pending)
+			pending = append(pending, r)
+		}
+	}
+
+	failed := []store.LoadResult{}
+	report := func(r store.Release, err error) {
+		result := store.LoadResult{Release: r, Err: err}
+		if err != nil {
+			failed = append(failed, result)
+		}
+		if progress != nil {
+			progress(result)
+		}
+	}
+
+	for start := 0; start < len(pending); start += batchSize {
+		end := start + batchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		current, err := rs.currentItems(ctx, pending[start:end])
+		if err == nil {
+			var batch store.Releases
+			if batch, err = rs.nextRevisions(ctx, pending[start:end], current); err == nil {
+				rs.loadBatch(ctx, batch, current, report)
+				continue
+			}
+		}
+		for _, r := range pending[start:end] {
+			report(r, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &store.LoadError{Failed: failed}
+	}
+	return nil
+}
+
+// loadBatch writes a batch of releases to the release table. As with put, the
+// stored items are archived to the history table first, and a release whose
+// stored item couldn't be archived isn't written.
+func (rs ReleaseStore) loadBatch(ctx context.Context, batch store.Releases, current map[string]map[string]*dynamodb.AttributeValue, report func(store.Release, error)) {
+	byID := map[string]store.Release{}
+	writes := map[string]*dynamodb.WriteRequest{}
+	archives := []*dynamodb.WriteRequest{}
+	requests := []*dynamodb.WriteRequest{}
+	for _, r := range batch {
+		avm := attributeValueMap{}
+		if err := avm.UnmarshalRelease(r); err != nil {
+			report(r, store.NewError("load", r.UniqueID, store.ErrInvalidRelease, err))
+			continue
+		}
+		byID[r.UniqueID] = r
+		writes[r.UniqueID] = &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: avm}}
+		if item, ok := current[r.UniqueID]; ok && item["Revision"] != nil {
+			archives = append(archives, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+		} else {
+			requests = append(requests, writes[r.UniqueID])
+		}
+	}
+	reportRequest := func(req *dynamodb.WriteRequest, err error) {
+		report(byID[writeRequestID(req)], err)
+	}
+
+	if len(archives) > 0 {
+		rs.writeBatch(ctx, rs.historyTableName, archives, func(req *dynamodb.WriteRequest, err error) {
+			if err != nil {
+				reportRequest(req, err)
+				return
+			}
+			requests = append(requests, writes[writeRequestID(req)])
+		})
+	}
+	if len(requests) > 0 {
+		rs.writeBatch(ctx, rs.tableName, requests, reportRequest)
+	}
+}
+
+// nextRevisions returns releases with the Revision each is written at: one
+// higher than the stored release's or, for releases that don't exist, than
+// the highest in its history
+func (rs ReleaseStore) nextRevisions(ctx context.Context, releases store.Releases, current map[string]map[string]*dynamodb.AttributeValue) (store.Releases, error) {
+	var err error
+	response := store.Releases{}
+	for _, r := range releases {
+		var latest int64
+		if item, ok := current[r.UniqueID]; ok {
+			if revision, ok := item["Revision"]; ok {
+				if latest, err = strconv.ParseInt(aws.StringValue(revision.N), 10, 64); err != nil {
+					return nil, store.NewError("load", r.UniqueID, store.ErrInvalidRelease, err)
+				}
+			}
+		} else if latest, err = rs.latestRevision(ctx, r.UniqueID); err != nil {
+			return nil, wrapError("load", r.UniqueID, err)
+		}
+		r.Revision = latest + 1
+		response = append(response, r)
+	}
+	return response, nil
+}
+
+// currentItems reads the stored items of up to 100 releases, by UniqueID,
+// retrying unprocessed keys with backoff
+func (rs ReleaseStore) currentItems(ctx context.Context, releases store.Releases) (map[string]map[string]*dynamodb.AttributeValue, error) {
+	keys := []map[string]*dynamodb.AttributeValue{}
+	for _, r := range releases {
+		keys = append(keys, map[string]*dynamodb.AttributeValue{"UniqueID": {S: aws.String(r.UniqueID)}})
+	}
+
+	response := map[string]map[string]*dynamodb.AttributeValue{}
+	lastErr := store.NewError("load", "", store.ErrUnavailable, errors.New("keys were left unprocessed"))
+	for attempt := 0; len(keys) > 0; attempt++ {
+		if attempt > maxBatchRetries {
+			return nil, lastErr
+		}
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(rs.backoff(attempt - 1)):
+			}
+		}
+
+		resp, err := rs.svc.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				rs.tableName: {Keys: keys, ConsistentRead: aws.Bool(true)},
+			},
+		})
+		if err != nil {
+			lastErr = wrapError("load", "", err)
+			if !retryable(err) {
+				return nil, lastErr
+			}
+			continue
+		}
+		for _, item := range resp.Responses[rs.tableName] {
+			response[aws.StringValue(item["UniqueID"].S)] = item
+		}
+		keys = nil
+		if unprocessed, ok := resp.UnprocessedKeys[rs.tableName]; ok {
+			keys = unprocessed.Keys
+		}
+	}
+	return response, nil
+}
+
+// writeBatch writes a single batch to tableName, retrying until every item has
+// been processed or the retries run out, and reports the outcome of each item
+func (rs ReleaseStore) writeBatch(ctx context.Context, tableName string, batch []*dynamodb.WriteRequest, report func(*dynamodb.WriteRequest, error)) {
+	unprocessed := batch
+	var lastErr error
+retries:
+	for attempt := 0; len(unprocessed) > 0 && attempt <= maxBatchRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				lastErr = ctx.Err()
+				break retries
+			case <-time.After(rs.backoff(attempt - 1)):
+			}
+		}
+
+		resp, err := rs.svc.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{tableName: unprocessed},
+		})
+		if err != nil {
+			lastErr = wrapError("load", "", err)
+			if !retryable(err) {
+				break
+			}
+			continue
+		}
+
+		remaining := map[string]bool{}
+		for _, req := range resp.UnprocessedItems[tableName] {
+			remaining[writeRequestID(req)] = true
+		}
+		retry := []*dynamodb.WriteRequest{}
+		for _, req := range unprocessed {
+			if remaining[writeRequestID(req)] {
+				retry = append(retry, req)
+			} else {
+				report(req, nil)
+			}
+		}
+		unprocessed = retry
+		lastErr = store.NewError("load", "", store.ErrUnavailable, errors.New("items were left unprocessed"))
+	}
+
+	for _, req := range unprocessed {
+		report(req, lastErr)
+	}
+}
+
+func writeRequestID(req *dynamodb.WriteRequest) string {
+	return aws.StringValue(req.PutRequest.Item["UniqueID"].S)
+}
@@ -0,0 +1,201 @@
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/skuid/helm-value-store/store"
+)
+
+// fakeBatchClient leaves the first `unprocessed` items of each call to the
+// releases table unprocessed, and fails with the errors in `errs` in order.
+// It stores no releases, so nothing is archived to the history table.
+type fakeBatchClient struct {
+	dynamodbiface.DynamoDBAPI
+
+	unprocessed []int
+	errs        []error
+
+	calls   int
+	written []string
+	history []string
+}
+
+func (c *fakeBatchClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	if reqs, ok := input.RequestItems["releases-history"]; ok {
+		for _, req := range reqs {
+			c.history = append(c.history, writeRequestID(req))
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}
+
+	call := c.calls
+	c.calls++
+	if call < len(c.errs) && c.errs[call] != nil {
+		return nil, c.errs[call]
+	}
+
+	reqs := input.RequestItems["releases"]
+	if len(reqs) > batchSize {
+		return nil, fmt.Errorf("batch of %d items is too large", len(reqs))
+	}
+	skip := 0
+	if call < len(c.unprocessed) {
+		skip = c.unprocessed[call]
+	}
+	if skip > len(reqs) {
+		skip = len(reqs)
+	}
+	for _, req := range reqs[skip:] {
+		c.written = append(c.written, writeRequestID(req))
+	}
+	resp := &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]*dynamodb.WriteRequest{}}
+	if skip > 0 {
+		resp.UnprocessedItems["releases"] = reqs[:skip]
+	}
+	return resp, nil
+}
+
+// BatchGetItemWithContext finds no stored releases
+func (c *fakeBatchClient) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	return &dynamodb.BatchGetItemOutput{}, nil
+}
+
+// QueryWithContext finds no history
+func (c *fakeBatchClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{}, nil
+}
+
+func numberedReleases(n int) store.Releases {
+	releases := store.Releases{}
+	for i := 0; i < n; i++ {
+		releases = append(releases, store.Release{UniqueID: fmt.Sprintf("%02d", i), Name: "prom"})
+	}
+	return releases
+}
+
+func TestLoadWithProgress(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	denied := awserr.New("AccessDeniedException", "no", nil)
+
+	cases := []struct {
+		name        string
+		releases    store.Releases
+		unprocessed []int
+		errs        []error
+		wantCalls   int
+		wantFailed  int
+	}{
+		{"fills batches", numberedReleases(60), nil, nil, 3, 0},
+		{"retries unprocessed items", numberedReleases(30), []int{10, 4, 0}, nil, 4, 0},
+		{"retries throttling", numberedReleases(5), nil, []error{throttled, throttled}, 3, 0},
+		{"gives up on unprocessed items", numberedReleases(3), []int{3, 3, 3, 3, 3, 3, 3, 3, 3}, nil, maxBatchRetries + 1, 3},
+		{"fails batch on other errors", numberedReleases(30), nil, []error{denied}, 2, 25},
+		{"deduplicates releases", append(numberedReleases(2), numberedReleases(2)...), nil, nil, 1, 0},
+	}
+
+	for _, c := range cases {
+		svc := &fakeBatchClient{unprocessed: c.unprocessed, errs: c.errs, written: []string{}, history: []string{}}
+		rs := ReleaseStore{
+			tableName:        "releases",
+			historyTableName: "releases-history",
+			svc:              svc,
+			backoff:          func(int) time.Duration { return 0 },
+		}
+
+		succeeded := []string{}
+		failed := []string{}
+		err := rs.LoadWithProgress(context.Background(), c.releases, func(result store.LoadResult) {
+			if result.Err != nil {
+				failed = append(failed, result.Release.UniqueID)
+			} else {
+				succeeded = append(succeeded, result.Release.UniqueID)
+			}
+		})
+
+		if svc.calls != c.wantCalls {
+			t.Errorf("Test '%s': Expected %d BatchWriteItem calls, got %d", c.name, c.wantCalls, svc.calls)
+		}
+		if len(failed) != c.wantFailed {
+			t.Errorf("Test '%s': Expected %d failed releases, got %d", c.name, c.wantFailed, len(failed))
+		}
+		if c.wantFailed == 0 && err != nil {
+			t.Errorf("Test '%s': Expected no error, got %s", c.name, err)
+		}
+		if c.wantFailed > 0 {
+			loadErr, ok := err.(*store.LoadError)
+			if !ok {
+				t.Errorf("Test '%s': Expected a *store.LoadError, got %#v", c.name, err)
+			} else if len(loadErr.Failed) != c.wantFailed {
+				t.Errorf("Test '%s': Expected %d releases in the LoadError, got %d", c.name, c.wantFailed, len(loadErr.Failed))
+			}
+		}
+		sort.Strings(succeeded)
+		sort.Strings(svc.written)
+		if !reflect.DeepEqual(succeeded, svc.written) {
+			t.Errorf("Test '%s': Reported successes %v do not match written items %v", c.name, succeeded, svc.written)
+		}
+		if len(svc.history) > 0 {
+			t.Errorf("Test '%s': Expected new releases not to be archived, got history items %v", c.name, svc.history)
+		}
+	}
+}
+
+func TestLoadArchivesStoredReleases(t *testing.T) {
+	cases := []struct {
+		name        string
+		historyErr  error
+		wantHistory []string
+		wantStored  string
+		wantFailed  bool
+	}{
+		{"archives before writing", nil, []string{"abc123/2"}, "3", false},
+		{"doesn't write when archiving fails", awserr.New("AccessDeniedException", "no", nil), []string{}, "2", true},
+	}
+
+	for _, c := range cases {
+		svc := newFakeTableClient()
+		svc.table("releases")["abc123"] = revisionItem("abc123", "2")
+		if c.historyErr != nil {
+			svc.failPuts["releases-history"] = c.historyErr
+		}
+		rs := ReleaseStore{tableName: "releases", historyTableName: "releases-history", svc: svc, backoff: func(int) time.Duration { return 0 }}
+
+		err := rs.Load(context.Background(), store.Releases{{UniqueID: "abc123", Name: "prom"}})
+		if (err != nil) != c.wantFailed {
+			t.Errorf("Test '%s': Expected failure %t, got %v", c.name, c.wantFailed, err)
+		}
+		history := []string{}
+		for key := range svc.table("releases-history") {
+			history = append(history, key)
+		}
+		if !reflect.DeepEqual(history, c.wantHistory) {
+			t.Errorf("Test '%s': Expected history %v, got %v", c.name, c.wantHistory, history)
+		}
+		if got := aws.StringValue(svc.table("releases")["abc123"]["Revision"].N); got != c.wantStored {
+			t.Errorf("Test '%s': Expected stored revision %s, got %s", c.name, c.wantStored, got)
+		}
+	}
+}
+
+func TestLoadInvalidRelease(t *testing.T) {
+	svc := &fakeBatchClient{}
+	rs := ReleaseStore{tableName: "releases", historyTableName: "releases-history", svc: svc, backoff: exponentialBackoff}
+
+	releases := append(numberedReleases(3), store.Release{Name: "missing-id"})
+	if err := rs.Load(context.Background(), releases); !store.IsInvalidRelease(err) {
+		t.Errorf("Expected an invalid release error, got %v", err)
+	}
+	if svc.calls > 0 {
+		t.Errorf("Expected nothing to be written when a release is invalid, got %d calls", svc.calls)
+	}
+}
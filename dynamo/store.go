@@ -3,38 +3,76 @@ package dynamo
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/skuid/helm-value-store/store"
 )
 
 // ReleaseStore stores and retrieves releases from a DynamoDB table
 type ReleaseStore struct {
-	tableName string
-	sess      *session.Session
+	tableName        string
+	historyTableName string
+	lockTableName    string
+	scanSegments     int
+	svc              dynamodbiface.DynamoDBAPI
+	backoff          func(attempt int) time.Duration
+}
+
+// ReleaseStoreOpt is a func that modifies a ReleaseStore
+type ReleaseStoreOpt func(*ReleaseStore)
+
+// WithScanSegments sets the number of parallel scan segments List uses.
+// Values less than 2 scan the table sequentially.
+func WithScanSegments(segments int) ReleaseStoreOpt {
+	return func(rs *ReleaseStore) {
+		rs.scanSegments = segments
+	}
+}
+
+// WithClient sets the DynamoDB client, in place of one created from the
+// default AWS session
+func WithClient(svc dynamodbiface.DynamoDBAPI) ReleaseStoreOpt {
+	return func(rs *ReleaseStore) {
+		rs.svc = svc
+	}
 }
 
 // NewReleaseStore Creates a new ReleaseStore
-func NewReleaseStore(tableName string) (store.ReleaseStore, error) {
-	rs := &ReleaseStore{tableName: tableName}
+func NewReleaseStore(tableName string, opts ...ReleaseStoreOpt) (store.ReleaseStore, error) {
+	rs := &ReleaseStore{
+		tableName:        tableName,
+		historyTableName: tableName + "-history",
+		lockTableName:    tableName + "-locks",
+		scanSegments:     1,
+		backoff:          exponentialBackoff,
+	}
+	for _, opt := range opts {
+		opt(rs)
+	}
 
-	sess, err := session.NewSession(
-		&aws.Config{CredentialsChainVerboseErrors: aws.Bool(true)},
-	)
-	if err != nil {
-		return nil, err
+	if rs.svc == nil {
+		sess, err := session.NewSession(
+			&aws.Config{CredentialsChainVerboseErrors: aws.Bool(true)},
+		)
+		if err != nil {
+			return nil, err
+		}
+		rs.svc = dynamodb.New(sess)
 	}
-	rs.sess = sess
 
 	return rs, nil
 }
 
 // Get gets a release by it's UniqueID
 func (rs ReleaseStore) Get(ctx context.Context, uniqueID string) (*store.Release, error) {
-	svc := dynamodb.New(rs.sess)
-
 	params := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"UniqueID": {
@@ -44,162 +82,470 @@ func (rs ReleaseStore) Get(ctx context.Context, uniqueID string) (*store.Release
 		TableName:      aws.String(rs.tableName),
 		ConsistentRead: aws.Bool(true),
 	}
-	resp, err := svc.GetItemWithContext(ctx, params)
+	resp, err := rs.svc.GetItemWithContext(ctx, params)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("get", uniqueID, err)
+	}
+	if len(resp.Item) == 0 {
+		return nil, store.NewError("get", uniqueID, store.ErrNotFound, nil)
 	}
 	avm := attributeValueMap(resp.Item)
 	return avm.MarshalRelease()
 
 }
 
-// Delete deletes a release by it's UniqueID
+// Delete deletes a release by it's UniqueID. The stored revision is archived
+// to the history table first, and the release is only deleted if it hasn't
+// changed since.
 func (rs ReleaseStore) Delete(ctx context.Context, uniqueID string) error {
-	svc := dynamodb.New(rs.sess)
-
-	params := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"UniqueID": {
-				S: aws.String(uniqueID),
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		var current *store.Release
+		if current, err = rs.current(ctx, uniqueID); err != nil || current == nil {
+			return err
+		}
+		if err = rs.archive(ctx, current); err != nil {
+			return err
+		}
+		params := &dynamodb.DeleteItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				"UniqueID": {
+					S: aws.String(uniqueID),
+				},
 			},
-		},
-		TableName: aws.String(rs.tableName),
+			TableName: aws.String(rs.tableName),
+		}
+		params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues = revisionCondition(current.Revision)
+		_, err = rs.svc.DeleteItemWithContext(ctx, params)
+		if err = wrapError("delete", uniqueID, err); !store.IsConflict(err) {
+			return err
+		}
 	}
-	_, err := svc.DeleteItemWithContext(ctx, params)
 	return err
 }
 
+// maxWriteAttempts is how many times Put and Delete try to write a release
+// that someone else is changing at the same time
+const maxWriteAttempts = 5
+
 // Put creates or updates a release in DynamoDB
 func (rs ReleaseStore) Put(ctx context.Context, r store.Release) error {
-	svc := dynamodb.New(rs.sess)
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		var current *store.Release
+		if current, err = rs.current(ctx, r.UniqueID); err != nil {
+			return err
+		}
+		if err = rs.put(ctx, r, current); !store.IsConflict(err) {
+			return err
+		}
+	}
+	return err
+}
 
-	avm := attributeValueMap{}
-	err := avm.UnmarshalRelease(r)
+// ConditionalPut creates or updates a release in DynamoDB if the stored
+// release has the same Revision
+func (rs ReleaseStore) ConditionalPut(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	current, err := rs.current(ctx, r.UniqueID)
 	if err != nil {
 		return err
 	}
+	if (current == nil && r.Revision != 0) || (current != nil && current.Revision != r.Revision) {
+		return store.NewError("put", r.UniqueID, store.ErrConflict, nil)
+	}
+	return rs.put(ctx, r, current)
+}
 
-	params := &dynamodb.PutItemInput{
+// current returns the stored release, or nil if it doesn't exist
+func (rs ReleaseStore) current(ctx context.Context, uniqueID string) (*store.Release, error) {
+	r, err := rs.Get(ctx, uniqueID)
+	if store.IsNotFound(err) {
+		return nil, nil
+	}
+	return r, err
+}
+
+// put writes r with a Revision one higher than current's, on the condition
+// that current is still the stored release. A release that doesn't exist
+// continues from the highest revision in its history.
+//
+// DynamoDB can't write the release and history tables in one request, so
+// current is archived to the history table before it is replaced rather than
+// r being recorded after it is written. If the release write fails or never
+// happens, the history holds a copy of the release that is still stored.
+func (rs ReleaseStore) put(ctx context.Context, r store.Release, current *store.Release) error {
+	var expr *string
+	var names map[string]*string
+	var values map[string]*dynamodb.AttributeValue
+	if current != nil {
+		if err := rs.archive(ctx, current); err != nil {
+			return err
+		}
+		r.Revision = current.Revision + 1
+		expr, names, values = revisionCondition(current.Revision)
+	} else {
+		latest, err := rs.latestRevision(ctx, r.UniqueID)
+		if err != nil {
+			return wrapError("put", r.UniqueID, err)
+		}
+		r.Revision = latest + 1
+		expr, names = aws.String("attribute_not_exists(#id)"), map[string]*string{"#id": aws.String("UniqueID")}
+	}
+
+	params, err := rs.putItemInput(r)
+	if err != nil {
+		return err
+	}
+	params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues = expr, names, values
+	_, err = rs.svc.PutItemWithContext(ctx, params)
+	return wrapError("put", r.UniqueID, err)
+}
+
+// revisionCondition returns a condition expression that the stored release
+// has a revision
+func revisionCondition(revision int64) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	expr := "#revision = :revision"
+	if revision == 0 {
+		// Releases written before revisions were tracked have no Revision
+		expr = "attribute_not_exists(#revision) OR #revision = :revision"
+	}
+	return aws.String(expr),
+		map[string]*string{"#revision": aws.String("Revision")},
+		map[string]*dynamodb.AttributeValue{":revision": {N: aws.String(strconv.FormatInt(revision, 10))}}
+}
+
+// latestRevision returns the highest revision in a release's history, or 0
+// if it has none
+func (rs ReleaseStore) latestRevision(ctx context.Context, uniqueID string) (int64, error) {
+	resp, err := rs.svc.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                aws.String(rs.historyTableName),
+		ConsistentRead:           aws.Bool(true),
+		KeyConditionExpression:   aws.String("#id = :id"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("UniqueID")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {S: aws.String(uniqueID)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(1),
+	})
+	if err != nil || len(resp.Items) == 0 {
+		return 0, err
+	}
+	return strconv.ParseInt(aws.StringValue(resp.Items[0]["Revision"].N), 10, 64)
+}
+
+// archive records a stored release in the history table. Archiving the same
+// revision again writes the same item, so racing writers can both archive it.
+func (rs ReleaseStore) archive(ctx context.Context, current *store.Release) error {
+	if current.Revision == 0 {
+		// Releases written before revisions were tracked have no history
+		return nil
+	}
+	avm := attributeValueMap{}
+	if err := avm.UnmarshalRelease(*current); err != nil {
+		return store.NewError("archive", current.UniqueID, store.ErrInvalidRelease, err)
+	}
+	_, err := rs.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
 		Item:      avm,
-		TableName: aws.String(rs.tableName),
+		TableName: aws.String(rs.historyTableName),
+	})
+	return wrapError("archive", current.UniqueID, err)
+}
+
+// History returns every stored revision of a release, oldest first: the
+// archived revisions from the history table, and the current revision from
+// the release table
+func (rs ReleaseStore) History(ctx context.Context, uniqueID string) (store.Releases, error) {
+	params := &dynamodb.QueryInput{
+		TableName:                aws.String(rs.historyTableName),
+		ConsistentRead:           aws.Bool(true),
+		KeyConditionExpression:   aws.String("#id = :id"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("UniqueID")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {S: aws.String(uniqueID)},
+		},
+		ScanIndexForward: aws.Bool(true),
 	}
-	_, err = svc.PutItemWithContext(ctx, params)
-	return err
+
+	response := store.Releases{}
+	var marshalErr error
+	err := rs.svc.QueryPagesWithContext(ctx, params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			avm := attributeValueMap(item)
+			r, err := avm.MarshalRelease()
+			if err != nil {
+				marshalErr = err
+				return false
+			}
+			response = append(response, *r)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, wrapError("history", uniqueID, err)
+	}
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+
+	// The current revision is only archived once it is replaced. Releases
+	// written before history existed have no history until their first
+	// update.
+	current, err := rs.current(ctx, uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && current.Revision > 0 && (len(response) == 0 || response[len(response)-1].Revision < current.Revision) {
+		response = append(response, *current)
+	}
+	return response, nil
 }
 
-// List returns releases from DynamoDB
-func (rs ReleaseStore) List(ctx context.Context, selector map[string]string) (store.Releases, error) {
-	svc := dynamodb.New(rs.sess)
+// putItemInput returns the input to write r
+func (rs ReleaseStore) putItemInput(r store.Release) (*dynamodb.PutItemInput, error) {
+	avm := attributeValueMap{}
+	if err := avm.UnmarshalRelease(r); err != nil {
+		return nil, store.NewError("put", r.UniqueID, store.ErrInvalidRelease, err)
+	}
+	return &dynamodb.PutItemInput{
+		Item:      avm,
+		TableName: aws.String(rs.tableName),
+	}, nil
+}
 
+// List returns releases from DynamoDB. The label selector is applied as a
+// scan filter, and every page of the scan is read.
+func (rs ReleaseStore) List(ctx context.Context, selector map[string]string) (store.Releases, error) {
 	// Dynamo doesn't support indexes on map types
 	params := &dynamodb.ScanInput{
 		TableName:      aws.String(rs.tableName),
 		ConsistentRead: aws.Bool(true),
 		Select:         aws.String("ALL_ATTRIBUTES"),
 	}
-	resp, err := svc.ScanWithContext(ctx, params)
+	params.FilterExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues = selectorFilter(selector)
 
-	if err != nil {
-		return nil, err
+	segments := rs.scanSegments
+	if segments < 2 {
+		segments = 1
+	}
+
+	type segmentResult struct {
+		items []map[string]*dynamodb.AttributeValue
+		err   error
+	}
+	results := make(chan segmentResult, segments)
+	for segment := 0; segment < segments; segment++ {
+		input := *params
+		if segments > 1 {
+			input.Segment = aws.Int64(int64(segment))
+			input.TotalSegments = aws.Int64(int64(segments))
+		}
+		go func(input *dynamodb.ScanInput) {
+			result := segmentResult{}
+			result.err = rs.svc.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+				result.items = append(result.items, page.Items...)
+				return true
+			})
+			results <- result
+		}(&input)
 	}
 
 	response := store.Releases{}
-	for _, item := range resp.Items {
-		avm := attributeValueMap(item)
-		r, _ := avm.MarshalRelease()
-		if r.MatchesSelector(selector) {
-			response = append(response, *r)
+	var err error
+	for segment := 0; segment < segments; segment++ {
+		result := <-results
+		if result.err != nil {
+			err = result.err
+			continue
 		}
+		for _, item := range result.items {
+			avm := attributeValueMap(item)
+			r, marshalErr := avm.MarshalRelease()
+			if marshalErr != nil {
+				err = store.NewError("list", aws.StringValue(item["UniqueID"].S), store.ErrInvalidRelease, marshalErr)
+				break
+			}
+			if r.MatchesSelector(selector) {
+				response = append(response, *r)
+			}
+		}
+	}
+	if err != nil {
+		return nil, wrapError("list", "", err)
 	}
 	return response, nil
 }
 
-// Load bulk-writes releases to DynamoDB
-func (rs ReleaseStore) Load(ctx context.Context, releases store.Releases) error {
-	svc := dynamodb.New(rs.sess)
-	params := &dynamodb.BatchWriteItemInput{
-		RequestItems: map[string][]*dynamodb.WriteRequest{},
+// selectorFilter builds a scan filter expression that matches the selector
+// against the Labels map. An empty selector value only requires the label to
+// exist, the same as store.Release.MatchesSelector.
+func selectorFilter(selector map[string]string) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	if len(selector) == 0 {
+		return nil, nil, nil
 	}
-	writeRequests := []*dynamodb.WriteRequest{}
 
-	for i, r := range releases {
-		avm := attributeValueMap{}
-		err := avm.UnmarshalRelease(r)
-		if err != nil {
-			return err
-		}
-		writeRequests = append(writeRequests, &dynamodb.WriteRequest{
-			PutRequest: &dynamodb.PutRequest{Item: avm},
-		})
+	keys := []string{}
+	for k := range selector {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-		params.RequestItems[rs.tableName] = writeRequests
-		if i%25 == 0 {
-			_, err := svc.BatchWriteItemWithContext(ctx, params)
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
-			params = &dynamodb.BatchWriteItemInput{
-				RequestItems: map[string][]*dynamodb.WriteRequest{},
-			}
-			writeRequests = []*dynamodb.WriteRequest{}
+	conditions := []string{}
+	names := map[string]*string{"#labels": aws.String("Labels")}
+	values := map[string]*dynamodb.AttributeValue{}
+	for i, k := range keys {
+		name := fmt.Sprintf("#label%d", i)
+		names[name] = aws.String(k)
+		if len(selector[k]) == 0 {
+			conditions = append(conditions, fmt.Sprintf("attribute_exists(#labels.%s)", name))
+			continue
 		}
+		value := fmt.Sprintf(":label%d", i)
+		values[value] = &dynamodb.AttributeValue{S: aws.String(selector[k])}
+		conditions = append(conditions, fmt.Sprintf("#labels.%s = %s", name, value))
 	}
-	if len(writeRequests) > 0 {
-		_, err := svc.BatchWriteItemWithContext(ctx, params)
-		if err != nil {
-			return err
+	if len(values) == 0 {
+		values = nil
+	}
+	return aws.String(strings.Join(conditions, " AND ")), names, values
+}
+
+// Load bulk-writes releases to DynamoDB
+func (rs ReleaseStore) Load(ctx context.Context, releases store.Releases) error {
+	return rs.LoadWithProgress(ctx, releases, nil)
+}
+
+// Lock takes a lease on a release in the lock table, unless someone else holds
+// one that hasn't expired
+func (rs ReleaseStore) Lock(ctx context.Context, uniqueID, owner string, ttl time.Duration) (*store.Lease, error) {
+	lease := store.NewLease(uniqueID, owner, ttl)
+	params := &dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"UniqueID": {S: aws.String(lease.UniqueID)},
+			"Owner":    {S: aws.String(lease.Owner)},
+			"Token":    {S: aws.String(lease.Token)},
+			"Expires":  {N: aws.String(strconv.FormatInt(lease.Expires.UnixNano(), 10))},
+		},
+		TableName:                aws.String(rs.lockTableName),
+		ConditionExpression:      aws.String("attribute_not_exists(#id) OR #expires <= :now"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("UniqueID"), "#expires": aws.String("Expires")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+		},
+	}
+	_, err := rs.svc.PutItemWithContext(ctx, params)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, rs.lockedError(ctx, uniqueID)
 		}
+		return nil, wrapError("lock", uniqueID, err)
 	}
-	return nil
+	return &lease, nil
+}
+
+// lockedError describes the lease held on a release. If the lease can't be
+// read, the error doesn't say who holds it.
+func (rs ReleaseStore) lockedError(ctx context.Context, uniqueID string) error {
+	resp, err := rs.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:            map[string]*dynamodb.AttributeValue{"UniqueID": {S: aws.String(uniqueID)}},
+		TableName:      aws.String(rs.lockTableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(resp.Item) == 0 {
+		return store.NewError("lock", uniqueID, store.ErrLocked, nil)
+	}
+	expires, _ := strconv.ParseInt(aws.StringValue(resp.Item["Expires"].N), 10, 64)
+	return store.NewLockedError(store.Lease{
+		UniqueID: uniqueID,
+		Owner:    aws.StringValue(resp.Item["Owner"].S),
+		Expires:  time.Unix(0, expires),
+	})
+}
+
+// Unlock releases a lease in the lock table, if it is still held
+func (rs ReleaseStore) Unlock(ctx context.Context, lease store.Lease) error {
+	_, err := rs.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		Key:                      map[string]*dynamodb.AttributeValue{"UniqueID": {S: aws.String(lease.UniqueID)}},
+		TableName:                aws.String(rs.lockTableName),
+		ConditionExpression:      aws.String("#token = :token"),
+		ExpressionAttributeNames: map[string]*string{"#token": aws.String("Token")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token": {S: aws.String(lease.Token)},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// The lease expired, and was taken by someone else or released
+		return nil
+	}
+	return wrapError("unlock", lease.UniqueID, err)
 }
 
-// Setup creates the table in DynamoDB if it doesn't exist. This call waits on
-// the creation of the table to return
+// Setup creates the release, history and lock tables in DynamoDB if they
+// don't exist. This call waits on the creation of the tables to return
 func (rs ReleaseStore) Setup(ctx context.Context) error {
-	if !rs.tableExists(ctx) {
-		err := rs.createTable(ctx)
+	tables := []*dynamodb.CreateTableInput{
+		tableInput(rs.tableName, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String("UniqueID"),
+			KeyType:       aws.String("HASH"),
+		}),
+		tableInput(rs.historyTableName, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String("UniqueID"),
+			KeyType:       aws.String("HASH"),
+		}, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String("Revision"),
+			KeyType:       aws.String("RANGE"),
+		}),
+		tableInput(rs.lockTableName, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String("UniqueID"),
+			KeyType:       aws.String("HASH"),
+		}),
+	}
+
+	for _, params := range tables {
+		if rs.tableExists(ctx, params.TableName) {
+			continue
+		}
+		_, err := rs.svc.CreateTableWithContext(ctx, params)
 		if err != nil {
-			return err
+			return wrapError("setup", "", err)
 		}
-		svc := dynamodb.New(rs.sess)
-		err = svc.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(rs.tableName)})
+		err = rs.svc.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{TableName: params.TableName})
 		if err != nil {
-			return err
+			return wrapError("setup", "", err)
 		}
 	}
 	return nil
 }
 
-func (rs ReleaseStore) createTable(ctx context.Context) error {
+// tableInput returns the input to create a table with the given key schema
+func tableInput(tableName string, keys ...*dynamodb.KeySchemaElement) *dynamodb.CreateTableInput {
+	attributeTypes := map[string]string{"UniqueID": "S", "Revision": "N"}
 	params := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String("UniqueID"),
-				AttributeType: aws.String("S"),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String("UniqueID"),
-				KeyType:       aws.String("HASH"),
-			},
-		},
+		KeySchema: keys,
 		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
 			ReadCapacityUnits:  aws.Int64(5),
 			WriteCapacityUnits: aws.Int64(5),
 		},
-		TableName: aws.String(rs.tableName),
+		TableName: aws.String(tableName),
 	}
-	svc := dynamodb.New(rs.sess)
-	_, err := svc.CreateTableWithContext(ctx, params)
-	return err
+	for _, key := range keys {
+		params.AttributeDefinitions = append(params.AttributeDefinitions, &dynamodb.AttributeDefinition{
+			AttributeName: key.AttributeName,
+			AttributeType: aws.String(attributeTypes[aws.StringValue(key.AttributeName)]),
+		})
+	}
+	return params
 }
 
-func (rs ReleaseStore) tableExists(ctx context.Context) bool {
-	svc := dynamodb.New(rs.sess)
-	_, err := svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
-		TableName: aws.String(rs.tableName),
+func (rs ReleaseStore) tableExists(ctx context.Context, tableName *string) bool {
+	_, err := rs.svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: tableName,
 	})
 	if err != nil {
 		return false
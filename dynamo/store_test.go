@@ -0,0 +1,442 @@
+package dynamo
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/helm-value-store/store/storetest"
+)
+
+// fakeScanClient returns each segment's items in pages of pageSize
+type fakeScanClient struct {
+	dynamodbiface.DynamoDBAPI
+
+	segments [][]map[string]*dynamodb.AttributeValue
+	pageSize int
+
+	mu     sync.Mutex
+	inputs []*dynamodb.ScanInput
+}
+
+func (c *fakeScanClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	c.mu.Lock()
+	c.inputs = append(c.inputs, input)
+	c.mu.Unlock()
+
+	items := c.segments[0]
+	if input.Segment != nil {
+		items = c.segments[*input.Segment]
+	}
+	for start := 0; start < len(items); start += c.pageSize {
+		end := start + c.pageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		if !fn(&dynamodb.ScanOutput{Items: items[start:end]}, end == len(items)) {
+			break
+		}
+	}
+	return nil
+}
+
+func labeledItem(uniqueID string, labels map[string]string) map[string]*dynamodb.AttributeValue {
+	m := attributeValueMap{}
+	for k, v := range labels {
+		m[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return map[string]*dynamodb.AttributeValue{
+		"UniqueID": {S: aws.String(uniqueID)},
+		"Labels":   {M: m},
+	}
+}
+
+func TestSelectorFilter(t *testing.T) {
+	cases := []struct {
+		selector   map[string]string
+		wantExpr   *string
+		wantNames  map[string]*string
+		wantValues map[string]*dynamodb.AttributeValue
+	}{
+		{
+			map[string]string{},
+			nil,
+			nil,
+			nil,
+		},
+		{
+			map[string]string{"region": "us", "environment": "test"},
+			aws.String("#labels.#label0 = :label0 AND #labels.#label1 = :label1"),
+			map[string]*string{
+				"#labels": aws.String("Labels"),
+				"#label0": aws.String("environment"),
+				"#label1": aws.String("region"),
+			},
+			map[string]*dynamodb.AttributeValue{
+				":label0": {S: aws.String("test")},
+				":label1": {S: aws.String("us")},
+			},
+		},
+		{
+			map[string]string{"region": ""},
+			aws.String("attribute_exists(#labels.#label0)"),
+			map[string]*string{
+				"#labels": aws.String("Labels"),
+				"#label0": aws.String("region"),
+			},
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		expr, names, values := selectorFilter(c.selector)
+		if !reflect.DeepEqual(expr, c.wantExpr) {
+			t.Errorf("Failed selectorFilter(%v) expression: Expected %v, got %v", c.selector, aws.StringValue(c.wantExpr), aws.StringValue(expr))
+		}
+		if !reflect.DeepEqual(names, c.wantNames) {
+			t.Errorf("Failed selectorFilter(%v) names: Expected %v, got %v", c.selector, c.wantNames, names)
+		}
+		if !reflect.DeepEqual(values, c.wantValues) {
+			t.Errorf("Failed selectorFilter(%v) values: Expected %v, got %v", c.selector, c.wantValues, values)
+		}
+	}
+}
+
+func TestListPages(t *testing.T) {
+	cases := []struct {
+		name     string
+		segments [][]map[string]*dynamodb.AttributeValue
+		selector map[string]string
+		want     []string
+	}{
+		{
+			"single segment, many pages",
+			[][]map[string]*dynamodb.AttributeValue{{
+				labeledItem("1", map[string]string{"region": "us"}),
+				labeledItem("2", map[string]string{"region": "us"}),
+				labeledItem("3", map[string]string{"region": "us"}),
+				labeledItem("4", map[string]string{"region": "us"}),
+				labeledItem("5", map[string]string{"region": "us"}),
+			}},
+			map[string]string{"region": "us"},
+			[]string{"1", "2", "3", "4", "5"},
+		},
+		{
+			"parallel segments",
+			[][]map[string]*dynamodb.AttributeValue{
+				{labeledItem("1", map[string]string{"region": "us"}), labeledItem("2", map[string]string{"region": "us"})},
+				{labeledItem("3", map[string]string{"region": "us"})},
+				{},
+			},
+			map[string]string{},
+			[]string{"1", "2", "3"},
+		},
+	}
+
+	for _, c := range cases {
+		svc := &fakeScanClient{segments: c.segments, pageSize: 2}
+		rs, err := NewReleaseStore("releases", WithClient(svc), WithScanSegments(len(c.segments)))
+		if err != nil {
+			t.Fatalf("Test '%s': error creating release store: %s", c.name, err)
+		}
+
+		releases, err := rs.List(context.Background(), c.selector)
+		if err != nil {
+			t.Errorf("Test '%s': error listing releases: %s", c.name, err)
+			continue
+		}
+		got := []string{}
+		for _, r := range releases {
+			got = append(got, r.UniqueID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Test '%s': Expected releases %v, got %v", c.name, c.want, got)
+		}
+		if len(svc.inputs) != len(c.segments) {
+			t.Errorf("Test '%s': Expected %d scans, got %d", c.name, len(c.segments), len(svc.inputs))
+		}
+	}
+}
+
+func TestListInvalidItem(t *testing.T) {
+	invalid := labeledItem("2", nil)
+	invalid["Revision"] = &dynamodb.AttributeValue{N: aws.String("not a number")}
+	svc := &fakeScanClient{segments: [][]map[string]*dynamodb.AttributeValue{{labeledItem("1", nil), invalid}}, pageSize: 2}
+	rs, _ := NewReleaseStore("releases", WithClient(svc))
+
+	if _, err := rs.List(context.Background(), nil); !store.IsInvalidRelease(err) {
+		t.Errorf("Expected an invalid release error, got %v", err)
+	}
+}
+
+// fakePutClient records PutItem calls and fails them with err
+type fakePutClient struct {
+	dynamodbiface.DynamoDBAPI
+
+	err    error
+	inputs []*dynamodb.PutItemInput
+}
+
+func (c *fakePutClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	c.inputs = append(c.inputs, input)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ReleaseStore, func()) {
+		rs, err := NewReleaseStore("releases", WithClient(newFakeTableClient()))
+		if err != nil {
+			t.Fatalf("Error creating release store: %s", err)
+		}
+		return rs, func() {}
+	})
+}
+
+// recordingClient records the PutItem calls made to a fakeTableClient
+type recordingClient struct {
+	*fakeTableClient
+
+	inputs []*dynamodb.PutItemInput
+}
+
+func (c *recordingClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	c.inputs = append(c.inputs, input)
+	return c.fakeTableClient.PutItemWithContext(ctx, input, opts...)
+}
+
+func TestConditionalPut(t *testing.T) {
+	cases := []struct {
+		name         string
+		stored       item
+		revision     int64
+		wantExpr     string
+		wantRevision string
+		wantArchived []string
+		wantConflict bool
+	}{
+		{"create", nil, 0, "attribute_not_exists(#id)", "1", nil, false},
+		{"update", revisionItem("abc123", "3"), 3, "#revision = :revision", "4", []string{"3"}, false},
+		{"update without a revision", item{"UniqueID": {S: aws.String("abc123")}}, 0, "attribute_not_exists(#revision) OR #revision = :revision", "1", nil, false},
+		{"stale", revisionItem("abc123", "3"), 2, "", "", nil, true},
+		{"deleted", nil, 3, "", "", nil, true},
+	}
+
+	for _, c := range cases {
+		svc := &recordingClient{fakeTableClient: newFakeTableClient()}
+		if c.stored != nil {
+			svc.table("releases")["abc123"] = c.stored
+		}
+		rs, _ := NewReleaseStore("releases", WithClient(svc))
+
+		err := rs.ConditionalPut(context.Background(), store.Release{UniqueID: "abc123", Revision: c.revision})
+		if store.IsConflict(err) != c.wantConflict || (!c.wantConflict && err != nil) {
+			t.Errorf("Test '%s': Expected conflict %t, got %v", c.name, c.wantConflict, err)
+		}
+		if c.wantConflict {
+			if len(svc.inputs) != 0 {
+				t.Errorf("Test '%s': Expected nothing to be written, got %d PutItem calls", c.name, len(svc.inputs))
+			}
+			continue
+		}
+
+		// The stored release is archived before it is replaced
+		archived := []string{}
+		for _, input := range svc.inputs[:len(svc.inputs)-1] {
+			if got := aws.StringValue(input.TableName); got != "releases-history" {
+				t.Errorf("Test '%s': Expected to write releases-history before the release, got %s", c.name, got)
+			}
+			archived = append(archived, aws.StringValue(input.Item["Revision"].N))
+		}
+		if len(archived) != len(c.wantArchived) || (len(archived) > 0 && !reflect.DeepEqual(archived, c.wantArchived)) {
+			t.Errorf("Test '%s': Expected to archive revisions %v, got %v", c.name, c.wantArchived, archived)
+		}
+
+		input := svc.inputs[len(svc.inputs)-1]
+		if got := aws.StringValue(input.TableName); got != "releases" {
+			t.Errorf("Test '%s': Expected to write the release last, got %s", c.name, got)
+		}
+		if got := aws.StringValue(input.ConditionExpression); got != c.wantExpr {
+			t.Errorf("Test '%s': Expected condition %q, got %q", c.name, c.wantExpr, got)
+		}
+		if got := aws.StringValue(input.Item["Revision"].N); got != c.wantRevision {
+			t.Errorf("Test '%s': Expected to write revision %s, got %s", c.name, c.wantRevision, got)
+		}
+	}
+}
+
+func TestArchiveFailure(t *testing.T) {
+	denied := awserr.New("AccessDeniedException", "no", nil)
+	cases := []struct {
+		name  string
+		write func(store.ReleaseStore) error
+	}{
+		{"put", func(rs store.ReleaseStore) error {
+			return rs.Put(context.Background(), store.Release{UniqueID: "abc123", Name: "prom"})
+		}},
+		{"delete", func(rs store.ReleaseStore) error {
+			return rs.Delete(context.Background(), "abc123")
+		}},
+	}
+
+	for _, c := range cases {
+		svc := newFakeTableClient()
+		svc.table("releases")["abc123"] = revisionItem("abc123", "3")
+		svc.failPuts["releases-history"] = denied
+		rs, _ := NewReleaseStore("releases", WithClient(svc))
+
+		if err := c.write(rs); !store.IsPermissionDenied(err) {
+			t.Errorf("Test '%s': Expected the archive error, got %v", c.name, err)
+		}
+		if got := svc.table("releases")["abc123"]; !reflect.DeepEqual(got, revisionItem("abc123", "3")) {
+			t.Errorf("Test '%s': Expected the release to be left alone, got %v", c.name, got)
+		}
+	}
+}
+
+func revisionItem(uniqueID, revision string) item {
+	return item{"UniqueID": {S: aws.String(uniqueID)}, "Revision": {N: aws.String(revision)}}
+}
+
+func TestPutRetriesConflicts(t *testing.T) {
+	svc := &racingClient{fakeTableClient: newFakeTableClient(), races: 2}
+	rs, _ := NewReleaseStore("releases", WithClient(svc))
+
+	if err := rs.Put(context.Background(), store.Release{UniqueID: "abc123"}); err != nil {
+		t.Fatalf("Expected Put to retry writes that raced, got %s", err)
+	}
+	r, err := rs.Get(context.Background(), "abc123")
+	if err != nil {
+		t.Fatalf("Error getting release: %s", err)
+	}
+	// Each race wrote a revision before Put's write
+	if r.Revision != 3 {
+		t.Errorf("Expected revision 3, got %d", r.Revision)
+	}
+}
+
+// racingClient writes the release itself before the first `races` writes to
+// the releases table, as if someone else wrote it at the same time
+type racingClient struct {
+	*fakeTableClient
+
+	races int
+}
+
+func (c *racingClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if aws.StringValue(input.TableName) == "releases" && c.races > 0 {
+		c.races--
+		racing := copyItem(input.Item)
+		c.fakeTableClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: input.TableName, Item: racing})
+		c.fakeTableClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("releases-history"), Item: racing})
+	}
+	return c.fakeTableClient.PutItemWithContext(ctx, input, opts...)
+}
+
+// fakeLockClient fails PutItem and DeleteItem calls with err, and returns
+// held from GetItem
+type fakeLockClient struct {
+	fakePutClient
+
+	held    map[string]*dynamodb.AttributeValue
+	deletes []*dynamodb.DeleteItemInput
+}
+
+func (c *fakeLockClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: c.held}, nil
+}
+
+func (c *fakeLockClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	c.deletes = append(c.deletes, input)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestLock(t *testing.T) {
+	conditionFailed := awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "failed", nil)
+	expires := time.Now().Add(time.Minute)
+	cases := []struct {
+		name       string
+		err        error
+		held       map[string]*dynamodb.AttributeValue
+		wantLocked bool
+		wantErr    string
+	}{
+		{"free", nil, nil, false, ""},
+		{"held", conditionFailed, map[string]*dynamodb.AttributeValue{
+			"UniqueID": {S: aws.String("abc123")},
+			"Owner":    {S: aws.String("replica-2")},
+			"Expires":  {N: aws.String(strconv.FormatInt(expires.UnixNano(), 10))},
+		}, true, "held by replica-2 until " + expires.Format(time.RFC3339)},
+		{"released while checking", conditionFailed, nil, true, ""},
+	}
+
+	for _, c := range cases {
+		svc := &fakeLockClient{fakePutClient: fakePutClient{err: c.err}, held: c.held}
+		rs, _ := NewReleaseStore("releases", WithClient(svc))
+
+		lease, err := rs.Lock(context.Background(), "abc123", "replica-1", time.Minute)
+		if store.IsLocked(err) != c.wantLocked {
+			t.Errorf("Test '%s': Expected locked %t, got %v", c.name, c.wantLocked, err)
+		}
+		if len(c.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+			t.Errorf("Test '%s': Expected error to contain %q, got %v", c.name, c.wantErr, err)
+		}
+		if !c.wantLocked && (lease == nil || lease.Owner != "replica-1") {
+			t.Errorf("Test '%s': Expected a lease owned by replica-1, got %+v", c.name, lease)
+		}
+
+		input := svc.inputs[0]
+		if got := aws.StringValue(input.TableName); got != "releases-locks" {
+			t.Errorf("Test '%s': Expected lease to be written to releases-locks, got %s", c.name, got)
+		}
+		if got, want := aws.StringValue(input.ConditionExpression), "attribute_not_exists(#id) OR #expires <= :now"; got != want {
+			t.Errorf("Test '%s': Expected condition %q, got %q", c.name, want, got)
+		}
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"held", nil, nil},
+		{"taken by someone else", awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "failed", nil), nil},
+		{"unavailable", awserr.New(dynamodb.ErrCodeInternalServerError, "failed", nil), store.ErrUnavailable},
+		{"access denied", awserr.New("AccessDeniedException", "denied", nil), store.ErrPermissionDenied},
+	}
+
+	for _, c := range cases {
+		svc := &fakeLockClient{fakePutClient: fakePutClient{err: c.err}}
+		rs, _ := NewReleaseStore("releases", WithClient(svc))
+
+		err := rs.Unlock(context.Background(), store.Lease{UniqueID: "abc123", Token: "token"})
+		if got := store.KindOf(err); got != c.want || (c.want == nil && err != nil) {
+			t.Errorf("Test '%s': Expected error kind %v, got %v", c.name, c.want, err)
+		}
+		if len(svc.deletes) != 1 {
+			t.Fatalf("Test '%s': Expected 1 DeleteItem call, got %d", c.name, len(svc.deletes))
+		}
+		if got := aws.StringValue(svc.deletes[0].ExpressionAttributeValues[":token"].S); got != "token" {
+			t.Errorf("Test '%s': Expected delete conditioned on token, got %q", c.name, got)
+		}
+	}
+}
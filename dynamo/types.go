@@ -1,7 +1,9 @@
 package dynamo
 
 import (
+	"encoding/json"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -27,6 +29,16 @@ func (avm *attributeValueMap) MarshalRelease() (*store.Release, error) {
 			r.Version = *v.S
 		case "values":
 			r.Values = *v.S
+		case "revision":
+			revision, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			r.Revision = revision
+		case "dependencies":
+			if err := json.Unmarshal([]byte(aws.StringValue(v.S)), &r.Dependencies); err != nil {
+				return nil, err
+			}
 		case "labels":
 			labels := map[string]string{}
 			for label, value := range v.M {
@@ -54,6 +66,18 @@ func (avm *attributeValueMap) UnmarshalRelease(r store.Release) error {
 			if len(labels) > 0 {
 				response[st.Field(i).Name] = &dynamodb.AttributeValue{M: labels}
 			}
+		} else if strings.Compare(fieldType.Name, "Dependencies") == 0 {
+			if fieldVal.Len() > 0 {
+				dependencies, err := json.Marshal(fieldVal.Interface())
+				if err != nil {
+					return err
+				}
+				response[st.Field(i).Name] = &dynamodb.AttributeValue{S: aws.String(string(dependencies))}
+			}
+		} else if fieldVal.Kind() == reflect.Int64 {
+			if fieldVal.Int() > 0 {
+				response[st.Field(i).Name] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(fieldVal.Int(), 10))}
+			}
 		} else if fieldVal.Len() > 0 {
 			response[st.Field(i).Name] = &dynamodb.AttributeValue{S: aws.String(fieldVal.String())}
 		}
@@ -47,6 +47,29 @@ func TestMarshalRelease(t *testing.T) {
 				Name:     "prom1",
 			},
 		},
+		{
+			attributeValueMap{
+				"UniqueID": {S: aws.String("abc123")},
+				"Revision": {N: aws.String("42")},
+			},
+			&store.Release{
+				UniqueID: "abc123",
+				Revision: 42,
+			},
+		},
+		{
+			attributeValueMap{
+				"UniqueID":     {S: aws.String("abc123")},
+				"Dependencies": {S: aws.String(`[{"unique_id":"def456"},{"name":"alertmanager","selector":{"region":"us"}}]`)},
+			},
+			&store.Release{
+				UniqueID: "abc123",
+				Dependencies: []store.Dependency{
+					{UniqueID: "def456"},
+					{Name: "alertmanager", Selector: map[string]string{"region": "us"}},
+				},
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -96,6 +119,26 @@ func TestUnmarshalRelease(t *testing.T) {
 				"Name":     {S: aws.String("prom1")},
 			},
 		},
+		{
+			&store.Release{
+				UniqueID: "abc123",
+				Revision: 7,
+			},
+			attributeValueMap{
+				"UniqueID": {S: aws.String("abc123")},
+				"Revision": {N: aws.String("7")},
+			},
+		},
+		{
+			&store.Release{
+				UniqueID:     "abc123",
+				Dependencies: []store.Dependency{{UniqueID: "def456"}},
+			},
+			attributeValueMap{
+				"UniqueID":     {S: aws.String("abc123")},
+				"Dependencies": {S: aws.String(`[{"unique_id":"def456"}]`)},
+			},
+		},
 	}
 
 	for _, c := range cases {
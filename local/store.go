@@ -0,0 +1,293 @@
+package local
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/skuid/helm-value-store/store"
+)
+
+var (
+	releaseBucket = []byte("releases")
+	historyBucket = []byte("history")
+	lockBucket    = []byte("locks")
+)
+
+// ReleaseStore stores and retrieves releases from a local BoltDB file
+type ReleaseStore struct {
+	db *bolt.DB
+}
+
+// NewReleaseStore opens (or creates) the database file at path and returns a
+// new ReleaseStore
+func NewReleaseStore(path string) (*ReleaseStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, store.NewError("open", "", store.ErrUnavailable, err)
+	}
+	rs := &ReleaseStore{db: db}
+	if err := rs.Setup(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Close releases the lock on the database file
+func (rs ReleaseStore) Close() error {
+	return rs.db.Close()
+}
+
+// Get gets a release by it's UniqueID
+func (rs ReleaseStore) Get(ctx context.Context, uniqueID string) (*store.Release, error) {
+	response := &store.Release{}
+	err := rs.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(releaseBucket).Get([]byte(uniqueID))
+		if data == nil {
+			return store.ErrNotFound
+		}
+		return json.Unmarshal(data, response)
+	})
+	if err != nil {
+		return nil, wrapError("get", uniqueID, err)
+	}
+	return response, nil
+}
+
+// Delete deletes a release by it's UniqueID. The release's history is kept.
+func (rs ReleaseStore) Delete(ctx context.Context, uniqueID string) error {
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(releaseBucket).Delete([]byte(uniqueID))
+	})
+	if err != nil {
+		return wrapError("delete", uniqueID, err)
+	}
+	return nil
+}
+
+// Put creates or updates a release
+func (rs ReleaseStore) Put(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		return putRelease(tx, r)
+	})
+	if err != nil {
+		return wrapError("put", r.UniqueID, err)
+	}
+	return nil
+}
+
+// ConditionalPut creates or updates a release if the stored release has the
+// same Revision
+func (rs ReleaseStore) ConditionalPut(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(releaseBucket)
+		current := store.Release{}
+		if data := bucket.Get([]byte(r.UniqueID)); data != nil {
+			if err := json.Unmarshal(data, &current); err != nil {
+				return err
+			}
+		}
+		if current.Revision != r.Revision {
+			return store.ErrConflict
+		}
+		return putRelease(tx, r)
+	})
+	if err != nil {
+		return wrapError("put", r.UniqueID, err)
+	}
+	return nil
+}
+
+// List returns releases
+func (rs ReleaseStore) List(ctx context.Context, selector map[string]string) (store.Releases, error) {
+	response := store.Releases{}
+	err := rs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(releaseBucket).ForEach(func(k, v []byte) error {
+			r := store.Release{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.MatchesSelector(selector) {
+				response = append(response, r)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, wrapError("list", "", err)
+	}
+	return response, nil
+}
+
+// Load bulk-writes releases in a single transaction
+func (rs ReleaseStore) Load(ctx context.Context, releases store.Releases) error {
+	for _, r := range releases {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range releases {
+			if err := putRelease(tx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return wrapError("load", "", err)
+	}
+	return nil
+}
+
+// History returns every stored revision of a release, oldest first
+func (rs ReleaseStore) History(ctx context.Context, uniqueID string) (store.Releases, error) {
+	response := store.Releases{}
+	err := rs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(uniqueID))
+		if bucket == nil {
+			return nil
+		}
+		// Keys are big-endian revisions, so they iterate in order
+		return bucket.ForEach(func(k, v []byte) error {
+			r := store.Release{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			response = append(response, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, wrapError("history", uniqueID, err)
+	}
+	return response, nil
+}
+
+// Lock takes a lease on a release, unless someone else holds one that hasn't
+// expired
+func (rs ReleaseStore) Lock(ctx context.Context, uniqueID, owner string, ttl time.Duration) (*store.Lease, error) {
+	lease := store.NewLease(uniqueID, owner, ttl)
+	var held *store.Lease
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(lockBucket)
+		if data := bucket.Get([]byte(uniqueID)); data != nil {
+			current := store.Lease{}
+			if err := json.Unmarshal(data, &current); err != nil {
+				return err
+			}
+			if !current.Expired(time.Now()) {
+				held = &current
+				return nil
+			}
+		}
+		data, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(uniqueID), data)
+	})
+	if err != nil {
+		return nil, wrapError("lock", uniqueID, err)
+	}
+	if held != nil {
+		return nil, store.NewLockedError(*held)
+	}
+	return &lease, nil
+}
+
+// Unlock releases a lease, if it is still held
+func (rs ReleaseStore) Unlock(ctx context.Context, lease store.Lease) error {
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(lockBucket)
+		data := bucket.Get([]byte(lease.UniqueID))
+		if data == nil {
+			return nil
+		}
+		current := store.Lease{}
+		if err := json.Unmarshal(data, &current); err != nil {
+			return err
+		}
+		if current.Token != lease.Token {
+			return nil
+		}
+		return bucket.Delete([]byte(lease.UniqueID))
+	})
+	if err != nil {
+		return wrapError("unlock", lease.UniqueID, err)
+	}
+	return nil
+}
+
+// Setup creates the release, history and lock buckets in the database file if
+// they don't exist
+func (rs ReleaseStore) Setup(ctx context.Context) error {
+	err := rs.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{releaseBucket, historyBucket, lockBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return wrapError("setup", "", err)
+	}
+	return nil
+}
+
+// putRelease writes r with a Revision one higher than any the release has had,
+// and records it in the release's history
+func putRelease(tx *bolt.Tx, r store.Release) error {
+	history, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(r.UniqueID))
+	if err != nil {
+		return err
+	}
+	current := store.Release{}
+	if data := tx.Bucket(releaseBucket).Get([]byte(r.UniqueID)); data != nil {
+		if err := json.Unmarshal(data, &current); err != nil {
+			return err
+		}
+	}
+	// The history keeps the revisions of deleted releases too, and its last
+	// key is the highest
+	r.Revision = current.Revision + 1
+	if last, _ := history.Cursor().Last(); last != nil && int64(binary.BigEndian.Uint64(last)) >= r.Revision {
+		r.Revision = int64(binary.BigEndian.Uint64(last)) + 1
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(releaseBucket).Put([]byte(r.UniqueID), data); err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(r.Revision))
+	return history.Put(key, data)
+}
+
+// wrapError maps bolt errors onto store error kinds
+func wrapError(op, uniqueID string, err error) error {
+	switch err {
+	case store.ErrNotFound, store.ErrConflict:
+		return store.NewError(op, uniqueID, err, nil)
+	case bolt.ErrTimeout, bolt.ErrDatabaseNotOpen, bolt.ErrDatabaseReadOnly:
+		return store.NewError(op, uniqueID, store.ErrUnavailable, err)
+	case bolt.ErrKeyRequired, bolt.ErrKeyTooLarge, bolt.ErrValueTooLarge:
+		return store.NewError(op, uniqueID, store.ErrInvalidRelease, err)
+	}
+	return fmt.Errorf("Error during %s: %q", op, err)
+}
@@ -0,0 +1,110 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/helm-value-store/store/storetest"
+)
+
+func newTestStore(t *testing.T) (*ReleaseStore, func()) {
+	dir, err := ioutil.TempDir("", "hvs-local")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	rs, err := NewReleaseStore(filepath.Join(dir, "releases.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error creating release store: %s", err)
+	}
+	return rs, func() {
+		rs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	rs, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	want := store.Release{
+		UniqueID:  "abc123",
+		Labels:    map[string]string{"region": "us", "environment": "test"},
+		Name:      "prom1",
+		Chart:     "skuid/prometheus",
+		Namespace: "default",
+		Version:   "0.1.3",
+		Values:    "image: prometheus\ntag: latest",
+	}
+	if err := rs.Put(ctx, want); err != nil {
+		t.Fatalf("Error putting release: %s", err)
+	}
+
+	got, err := rs.Get(ctx, want.UniqueID)
+	if err != nil {
+		t.Fatalf("Error getting release: %s", err)
+	}
+	want.Revision = 1
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("Failed getting release: Expected \n\t%#v\ngot: \n\t%#v", want, *got)
+	}
+
+	if err := rs.Delete(ctx, want.UniqueID); err != nil {
+		t.Fatalf("Error deleting release: %s", err)
+	}
+	if _, err := rs.Get(ctx, want.UniqueID); err == nil {
+		t.Errorf("Expected an error getting a deleted release")
+	}
+}
+
+func TestLoadList(t *testing.T) {
+	rs, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	releases := store.Releases{
+		{UniqueID: "1", Name: "prom1", Labels: map[string]string{"region": "us", "environment": "test"}},
+		{UniqueID: "2", Name: "prom2", Labels: map[string]string{"region": "us", "environment": "prod"}},
+		{UniqueID: "3", Name: "prom3", Labels: map[string]string{"region": "eu", "environment": "prod"}},
+	}
+	if err := rs.Load(ctx, releases); err != nil {
+		t.Fatalf("Error loading releases: %s", err)
+	}
+
+	cases := []struct {
+		selector map[string]string
+		want     []string
+	}{
+		{map[string]string{}, []string{"1", "2", "3"}},
+		{map[string]string{"region": "us"}, []string{"1", "2"}},
+		{map[string]string{"environment": "prod", "region": "eu"}, []string{"3"}},
+		{map[string]string{"region": "ap"}, []string{}},
+	}
+
+	for _, c := range cases {
+		got, err := rs.List(ctx, c.selector)
+		if err != nil {
+			t.Errorf("Error listing releases for %v: %s", c.selector, err)
+			continue
+		}
+		ids := []string{}
+		for _, r := range got {
+			ids = append(ids, r.UniqueID)
+		}
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("Failed List(%v): Expected %v, got %v", c.selector, c.want, ids)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ReleaseStore, func()) {
+		return newTestStore(t)
+	})
+}
@@ -0,0 +1,189 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skuid/helm-value-store/store"
+)
+
+// ReleaseStore stores releases in memory. It is safe for concurrent use, and
+// is mostly useful in tests or as a reference implementation.
+type ReleaseStore struct {
+	mu       sync.RWMutex
+	releases map[string]store.Release
+	history  map[string]store.Releases
+	leases   map[string]store.Lease
+}
+
+// NewReleaseStore creates a new, empty ReleaseStore
+func NewReleaseStore() *ReleaseStore {
+	return &ReleaseStore{
+		releases: map[string]store.Release{},
+		history:  map[string]store.Releases{},
+		leases:   map[string]store.Lease{},
+	}
+}
+
+// put writes r with a Revision one higher than any the release has had, and
+// records it in the history. The caller must hold the write lock.
+func (rs *ReleaseStore) put(r store.Release) {
+	r.Revision = 1
+	if history := rs.history[r.UniqueID]; len(history) > 0 {
+		r.Revision = history[len(history)-1].Revision + 1
+	}
+	rs.releases[r.UniqueID] = copyRelease(r)
+	rs.history[r.UniqueID] = append(rs.history[r.UniqueID], copyRelease(r))
+}
+
+// copyRelease returns a copy of r that shares no maps with r
+func copyRelease(r store.Release) store.Release {
+	if r.Labels != nil {
+		labels := make(map[string]string, len(r.Labels))
+		for k, v := range r.Labels {
+			labels[k] = v
+		}
+		r.Labels = labels
+	}
+	if r.Dependencies != nil {
+		dependencies := make([]store.Dependency, len(r.Dependencies))
+		for i, d := range r.Dependencies {
+			if d.Selector != nil {
+				selector := make(map[string]string, len(d.Selector))
+				for k, v := range d.Selector {
+					selector[k] = v
+				}
+				d.Selector = selector
+			}
+			dependencies[i] = d
+		}
+		r.Dependencies = dependencies
+	}
+	r.ReleaseLabels = nil
+	return r
+}
+
+// Get gets a release by it's UniqueID
+func (rs *ReleaseStore) Get(ctx context.Context, uniqueID string) (*store.Release, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	r, ok := rs.releases[uniqueID]
+	if !ok {
+		return nil, store.NewError("get", uniqueID, store.ErrNotFound, nil)
+	}
+	response := copyRelease(r)
+	return &response, nil
+}
+
+// Delete deletes a release by it's UniqueID. The release's history is kept.
+func (rs *ReleaseStore) Delete(ctx context.Context, uniqueID string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	delete(rs.releases, uniqueID)
+	return nil
+}
+
+// Put creates or updates a release
+func (rs *ReleaseStore) Put(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.put(r)
+	return nil
+}
+
+// ConditionalPut creates or updates a release if the stored release has the
+// same Revision
+func (rs *ReleaseStore) ConditionalPut(ctx context.Context, r store.Release) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if current := rs.releases[r.UniqueID]; current.Revision != r.Revision {
+		return store.NewError("put", r.UniqueID, store.ErrConflict, nil)
+	}
+	rs.put(r)
+	return nil
+}
+
+// List returns releases ordered by UniqueID
+func (rs *ReleaseStore) List(ctx context.Context, selector map[string]string) (store.Releases, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	response := store.Releases{}
+	for _, r := range rs.releases {
+		if r.MatchesSelector(selector) {
+			response = append(response, copyRelease(r))
+		}
+	}
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].UniqueID < response[j].UniqueID
+	})
+	return response, nil
+}
+
+// Load bulk-writes releases
+func (rs *ReleaseStore) Load(ctx context.Context, releases store.Releases) error {
+	for _, r := range releases {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, r := range releases {
+		rs.put(r)
+	}
+	return nil
+}
+
+// History returns every stored revision of a release, oldest first
+func (rs *ReleaseStore) History(ctx context.Context, uniqueID string) (store.Releases, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	response := store.Releases{}
+	for _, r := range rs.history[uniqueID] {
+		response = append(response, copyRelease(r))
+	}
+	return response, nil
+}
+
+// Lock takes a lease on a release, unless someone else holds one that hasn't
+// expired
+func (rs *ReleaseStore) Lock(ctx context.Context, uniqueID, owner string, ttl time.Duration) (*store.Lease, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if held, ok := rs.leases[uniqueID]; ok && !held.Expired(time.Now()) {
+		return nil, store.NewLockedError(held)
+	}
+	lease := store.NewLease(uniqueID, owner, ttl)
+	rs.leases[uniqueID] = lease
+	return &lease, nil
+}
+
+// Unlock releases a lease, if it is still held
+func (rs *ReleaseStore) Unlock(ctx context.Context, lease store.Lease) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if held, ok := rs.leases[lease.UniqueID]; ok && held.Token == lease.Token {
+		delete(rs.leases, lease.UniqueID)
+	}
+	return nil
+}
+
+// Setup satisfies the RelaseStore interface. No action is required
+func (rs *ReleaseStore) Setup(ctx context.Context) error { return nil }
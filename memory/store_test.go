@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/helm-value-store/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ReleaseStore, func()) {
+		return NewReleaseStore(), func() {}
+	})
+}
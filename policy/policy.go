@@ -0,0 +1,174 @@
+// Package policy decides which releases a user may read, write and apply.
+//
+// A policy file lists groups of users, and rules that let users and groups
+// take actions on the releases matching a label selector:
+//
+//	groups:
+//	  team-payments:
+//	  - alice@example.com
+//	  - bob@example.com
+//	rules:
+//	- name: payments-staging
+//	  groups: [team-payments]
+//	  actions: [read, write, apply]
+//	  selector:
+//	    team: payments
+//	    environment: staging
+//	- name: everyone-reads
+//	  users: ["*"]
+//	  actions: [read]
+//
+// An action is allowed if any rule allows it, and denied otherwise. A rule
+// without a selector matches every release.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/skuid/helm-value-store/store"
+)
+
+// An Action is something a user can do to a release
+type Action string
+
+// Actions a rule can allow
+const (
+	// Read is getting and listing releases, and the status of jobs
+	// applying them
+	Read Action = "read"
+	// Write is creating, changing and deleting releases
+	Write Action = "write"
+	// Apply is installing or upgrading releases in a cluster
+	Apply Action = "apply"
+)
+
+// Anyone is a user in a rule that matches every user, including requests
+// that aren't authenticated
+const Anyone = "*"
+
+// An Identity is a user, and the groups they are in
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// A Rule allows its users, and the members of its groups, to take its actions
+// on the releases matching its selector
+type Rule struct {
+	// Name identifies the rule in the audit log
+	Name     string            `json:"name,omitempty"`
+	Users    []string          `json:"users,omitempty"`
+	Groups   []string          `json:"groups,omitempty"`
+	Actions  []Action          `json:"actions"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// matches reports whether the rule applies to a user in groups
+func (rule Rule) matches(user string, groups map[string]bool) bool {
+	for _, u := range rule.Users {
+		if u == Anyone || (len(user) > 0 && strings.EqualFold(u, user)) {
+			return true
+		}
+	}
+	for _, g := range rule.Groups {
+		if groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the rule includes action
+func (rule Rule) allows(action Action) bool {
+	for _, a := range rule.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// A Policy is a set of rules, and the members of the groups they name.
+// Groups may also come from an identity, such as the groups claim of a token.
+type Policy struct {
+	Groups map[string][]string `json:"groups,omitempty"`
+	Rules  []Rule              `json:"rules"`
+}
+
+// Validate checks that every rule names who it applies to, and only known
+// actions. Rules without a name are named by their position.
+func (p *Policy) Validate() error {
+	if len(p.Rules) == 0 {
+		return errors.New("policy has no rules")
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+			return fmt.Errorf("%s has no users or groups", rule.Name)
+		}
+		if len(rule.Actions) == 0 {
+			return fmt.Errorf("%s has no actions", rule.Name)
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case Read, Write, Apply:
+			default:
+				return fmt.Errorf("%s has unknown action %q", rule.Name, action)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadFile reads a policy from a YAML file
+func LoadFile(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading policy file: %q", err)
+	}
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Error parsing policy file %s: %q", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid policy file %s: %s", path, err)
+	}
+	return p, nil
+}
+
+// GroupsOf returns the groups an identity is in, both its own and the ones the
+// policy lists it in
+func (p *Policy) GroupsOf(id Identity) []string {
+	response := append([]string{}, id.Groups...)
+	for group, members := range p.Groups {
+		for _, member := range members {
+			if len(id.User) > 0 && strings.EqualFold(member, id.User) {
+				response = append(response, group)
+				break
+			}
+		}
+	}
+	return response
+}
+
+// Allowed reports whether an identity may take action on a release, and the
+// name of the first rule that allows it
+func (p *Policy) Allowed(id Identity, action Action, r store.Release) (string, bool) {
+	groups := map[string]bool{}
+	for _, g := range p.GroupsOf(id) {
+		groups[g] = true
+	}
+	for _, rule := range p.Rules {
+		if rule.allows(action) && rule.matches(id.User, groups) && r.MatchesSelector(rule.Selector) {
+			return rule.Name, true
+		}
+	}
+	return "", false
+}
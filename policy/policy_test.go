@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+)
+
+const testPolicy = `
+groups:
+  team-payments:
+  - alice@example.com
+  - Bob@example.com
+rules:
+- name: payments-staging
+  groups: [team-payments]
+  actions: [read, write, apply]
+  selector:
+    team: payments
+    environment: staging
+- name: sre
+  groups: [sre]
+  actions: [read, write, apply]
+- users: ["*"]
+  actions: [read]
+`
+
+func loadTestPolicy(t *testing.T) *Policy {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(testPolicy), 0644); err != nil {
+		t.Fatalf("Error writing policy file: %s", err)
+	}
+	p, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("Error loading policy file: %s", err)
+	}
+	return p
+}
+
+func TestAllowed(t *testing.T) {
+	p := loadTestPolicy(t)
+	staging := store.Release{Labels: map[string]string{"team": "payments", "environment": "staging"}}
+	prod := store.Release{Labels: map[string]string{"team": "payments", "environment": "prod"}}
+
+	cases := []struct {
+		name     string
+		id       Identity
+		action   Action
+		release  store.Release
+		wantRule string
+		want     bool
+	}{
+		{"group member applies in scope", Identity{User: "alice@example.com"}, Apply, staging, "payments-staging", true},
+		{"group member applies out of scope", Identity{User: "alice@example.com"}, Apply, prod, "", false},
+		{"group member reads out of scope", Identity{User: "alice@example.com"}, Read, prod, "rule 3", true},
+		{"members match case-insensitively", Identity{User: "bob@example.com"}, Write, staging, "payments-staging", true},
+		{"group from identity", Identity{User: "carol@example.com", Groups: []string{"sre"}}, Apply, prod, "sre", true},
+		{"no group", Identity{User: "carol@example.com"}, Write, staging, "", false},
+		{"anonymous reads", Identity{}, Read, prod, "rule 3", true},
+		{"anonymous writes", Identity{}, Write, prod, "", false},
+	}
+
+	for _, c := range cases {
+		rule, ok := p.Allowed(c.id, c.action, c.release)
+		if ok != c.want || rule != c.wantRule {
+			t.Errorf("Test '%s': Expected (%q, %t), got (%q, %t)", c.name, c.wantRule, c.want, rule, ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{"valid", Policy{Rules: []Rule{{Users: []string{"*"}, Actions: []Action{Read}}}}, false},
+		{"no rules", Policy{}, true},
+		{"no users or groups", Policy{Rules: []Rule{{Actions: []Action{Read}}}}, true},
+		{"no actions", Policy{Rules: []Rule{{Groups: []string{"sre"}}}}, true},
+		{"unknown action", Policy{Rules: []Rule{{Groups: []string{"sre"}, Actions: []Action{"delete"}}}}, true},
+	}
+
+	for _, c := range cases {
+		if err := c.policy.Validate(); (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package refs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// EnvResolver resolves ref+env:// references to the value of an environment
+// variable. Unset variables are an error, so a missing secret isn't
+// installed as an empty string.
+type EnvResolver struct{}
+
+// Resolve looks up the referenced environment variable
+func (EnvResolver) Resolve(ctx context.Context, ref Ref) (string, error) {
+	if len(ref.Key) > 0 {
+		return "", errors.New("env references do not support keys")
+	}
+	value, ok := os.LookupEnv(ref.Path)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref.Path)
+	}
+	return value, nil
+}
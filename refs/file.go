@@ -0,0 +1,55 @@
+package refs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// FileResolver resolves ref+file:// references. Without a key, a reference
+// resolves to the file's contents with trailing newlines removed. With a key,
+// the file is parsed as YAML and the reference resolves to that field. Keys
+// of nested fields are separated by dots.
+type FileResolver struct{}
+
+// Resolve reads the referenced file
+func (FileResolver) Resolve(ctx context.Context, ref Ref) (string, error) {
+	data, err := ioutil.ReadFile(ref.Path)
+	if err != nil {
+		return "", err
+	}
+	if len(ref.Key) == 0 {
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	fields := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("Error parsing %s: %s", ref.Path, err)
+	}
+	return lookup(fields, ref.Key)
+}
+
+// lookup returns the string at a dot-separated key in fields
+func lookup(fields map[string]interface{}, key string) (string, error) {
+	var value interface{} = fields
+	for _, part := range strings.Split(key, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("key %q not found", key)
+		}
+		if value, ok = m[part]; !ok {
+			return "", fmt.Errorf("key %q not found", key)
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("key %q is not a scalar value", key)
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,222 @@
+// Package refs resolves references to secrets in release values.
+//
+// A reference is a string value of the form ref+<scheme>://<path>[#<key>],
+// such as ref+file://secrets/db.yaml#password, ref+env://DB_PASSWORD or
+// ref+vault://secret/data/db#password. References are stored in the release
+// store as-is, and are only replaced with the secrets they point to when a
+// release is installed, so the secrets themselves never reach the store.
+package refs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// prefix marks a string value as a reference
+const prefix = "ref+"
+
+// A Ref is a parsed reference
+type Ref struct {
+	Scheme string
+	Path   string
+	// Key selects a field from the referenced secret, and may be empty
+	Key string
+}
+
+func (r Ref) String() string {
+	s := prefix + r.Scheme + "://" + r.Path
+	if len(r.Key) > 0 {
+		s += "#" + r.Key
+	}
+	return s
+}
+
+// IsRef reports whether a value is a reference
+func IsRef(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Parse parses a reference
+func Parse(value string) (Ref, error) {
+	if !IsRef(value) {
+		return Ref{}, fmt.Errorf("%q is not a reference, references start with %q", value, prefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, prefix), "://", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return Ref{}, fmt.Errorf("Invalid reference %q, must be of the form %s<scheme>://<path>[#<key>]", value, prefix)
+	}
+	ref := Ref{Scheme: parts[0], Path: parts[1]}
+	if i := strings.LastIndex(ref.Path, "#"); i >= 0 {
+		ref.Path, ref.Key = ref.Path[:i], ref.Path[i+1:]
+	}
+	return ref, nil
+}
+
+// A Resolver returns the secret a reference points to
+type Resolver interface {
+	Resolve(ctx context.Context, ref Ref) (string, error)
+}
+
+// ResolverFunc is an adapter to use a func as a Resolver
+type ResolverFunc func(ctx context.Context, ref Ref) (string, error)
+
+// Resolve calls f(ctx, ref)
+func (f ResolverFunc) Resolve(ctx context.Context, ref Ref) (string, error) {
+	return f(ctx, ref)
+}
+
+// A Registry resolves references with the Resolver registered for their
+// scheme
+type Registry struct {
+	resolvers map[string]Resolver
+}
+
+// NewRegistry creates a Registry with no resolvers
+func NewRegistry() *Registry {
+	return &Registry{resolvers: map[string]Resolver{}}
+}
+
+// DefaultRegistry creates a Registry with the file and env resolvers, and the
+// vault resolver if VAULT_ADDR is set
+func DefaultRegistry() *Registry {
+	reg := NewRegistry()
+	reg.Register("file", FileResolver{})
+	reg.Register("env", EnvResolver{})
+	if addr := os.Getenv("VAULT_ADDR"); len(addr) > 0 {
+		reg.Register("vault", NewVaultResolver(addr, os.Getenv("VAULT_TOKEN")))
+	}
+	return reg
+}
+
+// Restrict returns a Registry with only the resolvers for schemes. Schemes
+// with no resolver in reg are left out.
+func (reg *Registry) Restrict(schemes ...string) *Registry {
+	restricted := NewRegistry()
+	for _, scheme := range schemes {
+		if r, ok := reg.resolvers[scheme]; ok {
+			restricted.Register(scheme, r)
+		}
+	}
+	return restricted
+}
+
+// AllowPaths restricts the references of scheme that reg resolves to those
+// whose path is one of prefixes, or is under one of them. Paths with ".."
+// segments are rejected. If scheme has no resolver, AllowPaths does nothing.
+func (reg *Registry) AllowPaths(scheme string, prefixes ...string) {
+	r, ok := reg.resolvers[scheme]
+	if !ok {
+		return
+	}
+	reg.resolvers[scheme] = ResolverFunc(func(ctx context.Context, ref Ref) (string, error) {
+		if !allowedPath(ref.Path, prefixes) {
+			return "", fmt.Errorf("%s references to %s are not allowed", scheme, ref.Path)
+		}
+		return r.Resolve(ctx, ref)
+	})
+}
+
+// allowedPath reports whether p is one of prefixes or under one of them
+func allowedPath(p string, prefixes []string) bool {
+	p = strings.Trim(p, "/")
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(prefix, "/")
+		if len(prefix) > 0 && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Register sets the Resolver for a scheme, replacing any existing one
+func (reg *Registry) Register(scheme string, r Resolver) {
+	reg.resolvers[scheme] = r
+}
+
+// Schemes returns the registered schemes in order
+func (reg *Registry) Schemes() []string {
+	schemes := []string{}
+	for scheme := range reg.resolvers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Resolve resolves a single reference
+func (reg *Registry) Resolve(ctx context.Context, value string) (string, error) {
+	ref, err := Parse(value)
+	if err != nil {
+		return "", err
+	}
+	resolver, ok := reg.resolvers[ref.Scheme]
+	if !ok {
+		return "", fmt.Errorf("No resolver for reference %s, must be one of %v", ref, reg.Schemes())
+	}
+	secret, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("Error resolving reference %s: %s", ref, err)
+	}
+	return secret, nil
+}
+
+// ResolveValues returns YAML values with every reference replaced by the
+// secret it points to. Values without references are returned unchanged.
+func (reg *Registry) ResolveValues(ctx context.Context, values string) (string, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(values), &parsed); err != nil {
+		return "", fmt.Errorf("Error parsing values: %s", err)
+	}
+
+	found := false
+	resolved, err := reg.walk(ctx, parsed, &found)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return values, nil
+	}
+
+	out, err := yaml.Marshal(resolved)
+	if err != nil {
+		return "", fmt.Errorf("Error marshaling resolved values: %s", err)
+	}
+	return string(out), nil
+}
+
+func (reg *Registry) walk(ctx context.Context, value interface{}, found *bool) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			resolved, err := reg.walk(ctx, child, found)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = resolved
+		}
+	case []interface{}:
+		for i, child := range v {
+			resolved, err := reg.walk(ctx, child, found)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	case string:
+		if IsRef(v) {
+			*found = true
+			return reg.Resolve(ctx, v)
+		}
+	}
+	return value, nil
+}
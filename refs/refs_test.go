@@ -0,0 +1,206 @@
+package refs
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    Ref
+		wantErr bool
+	}{
+		{"ref+env://DB_PASSWORD", Ref{Scheme: "env", Path: "DB_PASSWORD"}, false},
+		{"ref+vault://secret/data/db#password", Ref{Scheme: "vault", Path: "secret/data/db", Key: "password"}, false},
+		{"ref+file:///etc/secrets.yaml#db.password", Ref{Scheme: "file", Path: "/etc/secrets.yaml", Key: "db.password"}, false},
+		{"ref+file://", Ref{}, true},
+		{"ref+nothing", Ref{}, true},
+		{"env://DB_PASSWORD", Ref{}, true},
+	}
+
+	for _, c := range cases {
+		got, err := Parse(c.value)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Failed Parse(%q): Expected error %t, got %v", c.value, c.wantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Failed Parse(%q): Expected %#v, got %#v", c.value, c.want, got)
+		}
+		if err == nil && got.String() != c.value {
+			t.Errorf("Failed Parse(%q): String() returned %q", c.value, got.String())
+		}
+	}
+}
+
+func TestResolveValues(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("fake", ResolverFunc(func(ctx context.Context, ref Ref) (string, error) {
+		return ref.Path + "-secret", nil
+	}))
+
+	cases := []struct {
+		name    string
+		values  string
+		want    string
+		wantErr bool
+	}{
+		{"no references", "replicas: 2  # keep formatting\n", "replicas: 2  # keep formatting\n", false},
+		{"nested references", "db:\n  password: ref+fake://db\nusers:\n- ref+fake://user\nreplicas: 2\n", "db:\n  password: db-secret\nreplicas: 2\nusers:\n- user-secret\n", false},
+		{"unknown scheme", "password: ref+other://db\n", "", true},
+		{"invalid yaml", "password: [\n", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := reg.ResolveValues(context.Background(), c.values)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.name, c.wantErr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Test '%s': Expected values %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hvs-refs")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	plain := filepath.Join(dir, "password")
+	ioutil.WriteFile(plain, []byte("hunter2\n"), 0600)
+	structured := filepath.Join(dir, "secrets.yaml")
+	ioutil.WriteFile(structured, []byte("db:\n  password: hunter2\n  port: 5432\n"), 0600)
+
+	cases := []struct {
+		ref     Ref
+		want    string
+		wantErr bool
+	}{
+		{Ref{Scheme: "file", Path: plain}, "hunter2", false},
+		{Ref{Scheme: "file", Path: structured, Key: "db.password"}, "hunter2", false},
+		{Ref{Scheme: "file", Path: structured, Key: "db.port"}, "5432", false},
+		{Ref{Scheme: "file", Path: structured, Key: "db"}, "", true},
+		{Ref{Scheme: "file", Path: structured, Key: "db.user"}, "", true},
+		{Ref{Scheme: "file", Path: filepath.Join(dir, "missing")}, "", true},
+	}
+
+	for _, c := range cases {
+		got, err := FileResolver{}.Resolve(context.Background(), c.ref)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Failed resolving %s: Expected error %t, got %v", c.ref, c.wantErr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Failed resolving %s: Expected %q, got %q", c.ref, c.want, got)
+		}
+	}
+}
+
+func TestEnvResolver(t *testing.T) {
+	os.Setenv("HVS_REFS_TEST", "hunter2")
+	defer os.Unsetenv("HVS_REFS_TEST")
+
+	got, err := EnvResolver{}.Resolve(context.Background(), Ref{Scheme: "env", Path: "HVS_REFS_TEST"})
+	if err != nil || got != "hunter2" {
+		t.Errorf("Expected hunter2, got %q, %v", got, err)
+	}
+	if _, err := (EnvResolver{}).Resolve(context.Background(), Ref{Scheme: "env", Path: "HVS_REFS_TEST_UNSET"}); err == nil {
+		t.Errorf("Expected an error resolving an unset variable")
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	reg := DefaultRegistry().Restrict("env", "vault", "missing")
+	want := []string{"env"}
+	if len(os.Getenv("VAULT_ADDR")) > 0 {
+		want = append(want, "vault")
+	}
+	if got := reg.Schemes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected schemes %v, got %v", want, got)
+	}
+	if _, err := reg.Resolve(context.Background(), "ref+file:///etc/hostname"); err == nil {
+		t.Errorf("Expected a restricted registry to reject the file scheme")
+	}
+}
+
+func TestAllowPaths(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("vault", ResolverFunc(func(ctx context.Context, ref Ref) (string, error) {
+		return "secret", nil
+	}))
+	reg.AllowPaths("vault", "secret/data/apps/", "kv/shared")
+	reg.AllowPaths("missing", "anything")
+
+	cases := []struct {
+		ref     string
+		wantErr bool
+	}{
+		{"ref+vault://secret/data/apps#password", false},
+		{"ref+vault://secret/data/apps/db#password", false},
+		{"ref+vault:///kv/shared/db#password", false},
+		{"ref+vault://secret/data/apps-admin/db#password", true},
+		{"ref+vault://secret/data/apps/../admin#password", true},
+		{"ref+vault://secret/data/admin#password", true},
+		{"ref+vault://kv#password", true},
+	}
+	for _, c := range cases {
+		if _, err := reg.Resolve(context.Background(), c.ref); (err != nil) != c.wantErr {
+			t.Errorf("Test '%s': Expected error %t, got %v", c.ref, c.wantErr, err)
+		}
+	}
+	if got := reg.Schemes(); !reflect.DeepEqual(got, []string{"vault"}) {
+		t.Errorf("Expected AllowPaths not to add schemes, got %v", got)
+	}
+}
+
+func TestVaultResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv1/db":
+			w.Write([]byte(`{"data": {"password": "hunter2"}}`))
+		case "/v1/secret/data/db":
+			w.Write([]byte(`{"data": {"data": {"password": "hunter3"}, "metadata": {"version": 2}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		token   string
+		ref     Ref
+		want    string
+		wantErr bool
+	}{
+		{"token", Ref{Scheme: "vault", Path: "kv1/db", Key: "password"}, "hunter2", false},
+		{"token", Ref{Scheme: "vault", Path: "secret/data/db", Key: "password"}, "hunter3", false},
+		{"token", Ref{Scheme: "vault", Path: "secret/data/db"}, "", true},
+		{"token", Ref{Scheme: "vault", Path: "secret/data/missing", Key: "password"}, "", true},
+		{"wrong", Ref{Scheme: "vault", Path: "kv1/db", Key: "password"}, "", true},
+	}
+
+	for _, c := range cases {
+		got, err := NewVaultResolver(ts.URL+"/", c.token).Resolve(context.Background(), c.ref)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Failed resolving %s: Expected error %t, got %v", c.ref, c.wantErr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Failed resolving %s: Expected %q, got %q", c.ref, c.want, got)
+		}
+	}
+}
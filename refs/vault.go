@@ -0,0 +1,67 @@
+package refs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// VaultResolver resolves ref+vault:// references by reading a secret over
+// Vault's HTTP API. The path is the secret's API path without the /v1/
+// prefix, and the key selects a field of the secret. Secrets in both
+// version 1 and version 2 KV engines are supported.
+type VaultResolver struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+// NewVaultResolver creates a VaultResolver for the Vault server at address
+func NewVaultResolver(address, token string) *VaultResolver {
+	return &VaultResolver{
+		address: strings.TrimRight(address, "/"),
+		token:   token,
+		client:  http.DefaultClient,
+	}
+}
+
+type vaultSecret struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// Resolve reads a field of the referenced secret
+func (v *VaultResolver) Resolve(ctx context.Context, ref Ref) (string, error) {
+	if len(ref.Key) == 0 {
+		return "", errors.New("vault references must specify a key")
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s", v.address, strings.TrimLeft(ref.Path, "/")), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, ref.Path)
+	}
+
+	secret := &vaultSecret{}
+	if err := json.NewDecoder(resp.Body).Decode(secret); err != nil {
+		return "", fmt.Errorf("Error decoding vault response: %s", err)
+	}
+	fields := secret.Data
+	// KV version 2 nests the secret's fields in data.data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		if _, ok := fields["metadata"]; ok {
+			fields = nested
+		}
+	}
+	return lookup(fields, ref.Key)
+}
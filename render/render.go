@@ -0,0 +1,108 @@
+// Package render renders the Kubernetes manifests of a release locally, the
+// way Tiller would, without a cluster.
+package render
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/skuid/helm-value-store/store"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/engine"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/timeconv"
+	"k8s.io/helm/pkg/version"
+)
+
+// A Manifest is a rendered template
+type Manifest struct {
+	// Name is the template's path in the chart, like
+	// prometheus/templates/deployment.yaml
+	Name    string
+	Content string
+}
+
+// Chart loads the chart archive or directory at path
+func Chart(path string) (*chart.Chart, error) {
+	c, err := chartutil.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading chart %s: %q", path, err)
+	}
+	return c, nil
+}
+
+// Release renders a release's chart with the chart's default values merged
+// with the release's values. Partials, NOTES.txt and templates that render
+// to nothing are left out, and manifests are sorted by name.
+func Release(r store.Release, c *chart.Chart) ([]Manifest, error) {
+	config := &chart.Config{Raw: r.Values}
+	if err := chartutil.ProcessRequirementsEnabled(c, config); err != nil {
+		return nil, fmt.Errorf("Error processing requirements of release %s: %q", r.Name, err)
+	}
+	if err := chartutil.ProcessRequirementsImportValues(c); err != nil {
+		return nil, fmt.Errorf("Error importing requirement values of release %s: %q", r.Name, err)
+	}
+
+	options := chartutil.ReleaseOptions{
+		Name:      r.Name,
+		Namespace: r.Namespace,
+		Time:      timeconv.Now(),
+		IsInstall: true,
+	}
+	caps := &chartutil.Capabilities{
+		APIVersions:   chartutil.DefaultVersionSet,
+		KubeVersion:   chartutil.DefaultKubeVersion,
+		TillerVersion: version.GetVersionProto(),
+	}
+	values, err := chartutil.ToRenderValuesCaps(c, config, options, caps)
+	if err != nil {
+		return nil, fmt.Errorf("Error merging values of release %s: %q", r.Name, err)
+	}
+
+	rendered, err := engine.New().Render(c, values)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering release %s: %q", r.Name, err)
+	}
+
+	manifests := []Manifest{}
+	for name, content := range rendered {
+		base := filepath.Base(name)
+		if strings.HasPrefix(base, "_") || base == "NOTES.txt" || len(strings.TrimSpace(content)) == 0 {
+			continue
+		}
+		manifests = append(manifests, Manifest{Name: name, Content: content})
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name < manifests[j].Name })
+	return manifests, nil
+}
+
+// Fprint writes manifests as a YAML stream, with a comment naming the
+// template each came from
+func Fprint(w io.Writer, manifests []Manifest) error {
+	for _, m := range manifests {
+		if _, err := fmt.Fprintf(w, "---\n# Source: %s\n%s\n", m.Name, strings.TrimRight(m.Content, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteDir writes each manifest to a file under dir/<release name>, keeping
+// its path in the chart
+func WriteDir(dir string, r store.Release, manifests []Manifest) error {
+	for _, m := range manifests {
+		path := filepath.Join(dir, r.Name, filepath.FromSlash(m.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("Error creating directory for %s: %q", path, err)
+		}
+		if err := ioutil.WriteFile(path, []byte(m.Content), 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %q", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package render
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+func testChart() *chart.Chart {
+	return &chart.Chart{
+		Metadata: &chart.Metadata{Name: "prometheus", Version: "0.1.0"},
+		Values:   &chart.Config{Raw: "replicas: 1\nimage:\n  tag: v2.0.0\n  pullPolicy: IfNotPresent\n"},
+		Templates: []*chart.Template{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{- define "fullname" -}}{{ .Release.Name }}-{{ .Chart.Name }}{{- end -}}`)},
+			{Name: "templates/deployment.yaml", Data: []byte(`name: {{ template "fullname" . }}
+namespace: {{ .Release.Namespace }}
+replicas: {{ .Values.replicas }}
+image: prom:{{ .Values.image.tag }} {{ .Values.image.pullPolicy | lower }}
+`)},
+			{Name: "templates/NOTES.txt", Data: []byte("Installed {{ .Release.Name }}")},
+			{Name: "templates/service.yaml", Data: []byte(`{{- if .Values.service }}kind: Service{{ end }}`)},
+			{Name: "templates/configmap.yaml", Data: []byte("kind: ConfigMap\n")},
+		},
+	}
+}
+
+func TestRelease(t *testing.T) {
+	r := store.Release{Name: "prom", Namespace: "monitoring", Values: "replicas: 3\nimage:\n  tag: v2.1.0\n"}
+
+	manifests, err := Release(r, testChart())
+	if err != nil {
+		t.Fatalf("Error rendering release: %s", err)
+	}
+
+	want := []Manifest{
+		{Name: "prometheus/templates/configmap.yaml", Content: "kind: ConfigMap\n"},
+		{Name: "prometheus/templates/deployment.yaml", Content: "name: prom-prometheus\nnamespace: monitoring\nreplicas: 3\nimage: prom:v2.1.0 ifnotpresent\n"},
+	}
+	if !reflect.DeepEqual(manifests, want) {
+		t.Errorf("Expected manifests %v, got %v", want, manifests)
+	}
+}
+
+func TestReleaseError(t *testing.T) {
+	c := testChart()
+	c.Templates = append(c.Templates, &chart.Template{Name: "templates/bad.yaml", Data: []byte(`{{ required "a host is required" .Values.host }}`)})
+
+	if _, err := Release(store.Release{Name: "prom"}, c); err == nil {
+		t.Errorf("Expected an error for a missing required value")
+	}
+}
+
+func TestFprint(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := Fprint(buf, []Manifest{
+		{Name: "prometheus/templates/configmap.yaml", Content: "kind: ConfigMap\n"},
+		{Name: "prometheus/templates/service.yaml", Content: "kind: Service"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `---
+# Source: prometheus/templates/configmap.yaml
+kind: ConfigMap
+---
+# Source: prometheus/templates/service.yaml
+kind: Service
+`
+	if buf.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifests := []Manifest{{Name: "prometheus/templates/configmap.yaml", Content: "kind: ConfigMap\n"}}
+	if err := WriteDir(dir, store.Release{Name: "prom"}, manifests); err != nil {
+		t.Fatalf("Error writing manifests: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "prom", "prometheus", "templates", "configmap.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading written manifest: %s", err)
+	}
+	if string(got) != "kind: ConfigMap\n" {
+		t.Errorf("Unexpected manifest content %q", got)
+	}
+}
@@ -1,11 +1,15 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/policy"
 	"github.com/skuid/helm-value-store/store"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -13,32 +17,180 @@ import (
 
 type applyRequest struct {
 	UUID string `json:"uuid"`
+	// Async applies the release in the background, and responds with the
+	// ID of the job applying it
+	Async bool `json:"async"`
 }
 
 type applyResponse struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	Job     string `json:"job,omitempty"`
 }
 
-type upsertConfig struct {
-	location string
-	timeout  int64
+// applyResult is the outcome of applying a release and its dependencies
+type applyResult struct {
+	// status is the HTTP status to report the result with
+	status int
+	// message describes the result, or the step that failed
+	message string
+	// dependencies is the number of dependencies applied
+	dependencies int
+	err          error
 }
 
-func upsertRelease(r *store.Release, conf upsertConfig) error {
-	_, err := r.Get()
+// applyOrder returns release and every release it depends on, in the order
+// they should be applied. It fails if any of their dependencies matches no
+// stored release.
+func (c ApiController) applyOrder(ctx context.Context, release store.Release) (store.Releases, error) {
+	all, err := c.releaseStore.List(ctx, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	releases := append(store.Upstream(all, release), release)
+	if err := store.CheckDependencies(all, releases); err != nil {
+		return nil, err
+	}
+	levels, err := store.Levels(releases)
+	if err != nil {
+		return nil, err
+	}
+
+	response := store.Releases{}
+	for _, level := range levels {
+		response = append(response, level...)
+	}
+	return response, nil
+}
+
+// applyRelease resolves the values of a release, downloads its chart and
+// installs or upgrades it, reporting each step to progress. If it fails, it
+// returns a message describing the step that failed.
+func (c ApiController) applyRelease(ctx context.Context, release store.Release, progress func(string)) (string, error) {
+	progress(fmt.Sprintf("Resolving values of %s", release.Name))
+	values, err := c.resolver.ResolveValues(ctx, release.Values)
+	if err != nil {
+		return "Error resolving values", err
+	}
+	release.Values = values
+
+	progress(strings.TrimSpace(fmt.Sprintf("Downloading chart %s %s", release.Chart, release.Version)))
+	location, err := c.download(release)
+	if err != nil {
+		return "Error downloading release", err
+	}
 
-	if err != nil && !strings.Contains(err.Error(), "not found") {
-		return err
+	progress(fmt.Sprintf("Applying %s", release.Name))
+	action, _, err := deploy.Upsert(c.deployer, release, location, deploy.Options{Timeout: c.timeout})
+	if err != nil {
+		return "Error applying release", err
+	}
+	progress(fmt.Sprintf("Successfully %s %s", action, release.Name))
+	return "", nil
+}
+
+// prepare orders a release after the releases it depends on, and checks that
+// the user may apply all of them. If it fails, the result describes the step
+// that failed.
+func (c ApiController) prepare(ctx context.Context, release store.Release, acc *access) (store.Releases, applyResult) {
+	// Releases this one depends on are applied first, in dependency order
+	releases, err := c.applyOrder(ctx, release)
+	if err != nil {
+		zap.L().Error("Error ordering dependencies", zap.Error(err))
+
+		status := statusForError(err)
+		switch err.(type) {
+		case *store.CycleError, *store.MissingDependencyError:
+			status = http.StatusConflict
+		}
+		return nil, applyResult{status: status, message: "Error ordering dependencies", err: err}
 	}
+	for _, next := range releases {
+		if !acc.allowed(next) {
+			return nil, applyResult{status: http.StatusForbidden, message: acc.deniedMessage(), err: errForbidden}
+		}
+	}
+	return releases, applyResult{}
+}
 
-	if err != nil && strings.Contains(err.Error(), "not found") {
-		_, err = r.Install(conf.location, false, conf.timeout)
-	} else if err == nil {
-		_, err = r.Upgrade(conf.location, false, conf.timeout)
+// lock takes a lease on each prepared release, so that no one else applies
+// them at the same time. The leases last long enough to apply every release,
+// counted from when they are taken. The returned func releases the leases. If
+// it fails, the result describes the release that couldn't be locked and no
+// leases are held.
+func (c ApiController) lock(ctx context.Context, release store.Release, releases store.Releases) (func(), applyResult) {
+	ttl := c.applyTimeout(releases)
+	leases := []store.Lease{}
+	unlock := func() {
+		for _, lease := range leases {
+			if err := c.releaseStore.Unlock(context.Background(), lease); err != nil {
+				zap.L().Error("Error unlocking release", zap.String("uuid", lease.UniqueID), zap.Error(err))
+			}
+		}
 	}
+	for _, next := range releases {
+		lease, err := c.releaseStore.Lock(ctx, next.UniqueID, c.lockOwner, ttl)
+		if err != nil {
+			unlock()
+			zap.L().Error("Error locking release", zap.String("release", next.Name), zap.Error(err))
 
-	return err
+			message := "Error locking release"
+			if next.UniqueID != release.UniqueID {
+				message = fmt.Sprintf("%s dependency %s", message, next.Name)
+			}
+			return nil, applyResult{status: statusForError(err), message: message, err: err}
+		}
+		leases = append(leases, *lease)
+	}
+	return unlock, applyResult{}
+}
+
+// applyTimeout is how long applying releases may take: the install timeout
+// plus store.LockMargin for each release
+func (c ApiController) applyTimeout(releases store.Releases) time.Duration {
+	return time.Duration(len(releases)) * (time.Duration(c.timeout)*time.Second + store.LockMargin)
+}
+
+// applyAll applies prepared releases in order, reporting each step to
+// progress
+func (c ApiController) applyAll(ctx context.Context, release store.Release, releases store.Releases, progress func(string)) applyResult {
+	result := applyResult{dependencies: len(releases) - 1}
+
+	for _, next := range releases {
+		message, err := c.applyRelease(ctx, next, progress)
+		if err != nil {
+			zap.L().Error(message, zap.String("release", next.Name), zap.Error(err))
+
+			if next.UniqueID != release.UniqueID {
+				message = fmt.Sprintf("%s dependency %s", message, next.Name)
+			}
+			result.status = http.StatusInternalServerError
+			result.message = message
+			result.err = err
+			return result
+		}
+	}
+
+	result.status = http.StatusOK
+	result.message = fmt.Sprintf("Successfully installed %s", release.Name)
+	return result
+}
+
+// statusForError returns the HTTP status code for a release store error. The
+// store denying access is a problem with the server's own credentials, so it
+// is an internal error rather than a 403.
+func statusForError(err error) int {
+	switch {
+	case store.IsNotFound(err):
+		return http.StatusNotFound
+	case store.IsConflict(err), store.IsAlreadyExists(err), store.IsLocked(err):
+		return http.StatusConflict
+	case store.IsInvalidRelease(err):
+		return http.StatusBadRequest
+	case store.IsUnavailable(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
 }
 
 // ApplyChart applies a chart to a tiller server
@@ -54,9 +206,11 @@ func (c ApiController) ApplyChart(w http.ResponseWriter, r *http.Request) {
 	for _, a := range c.authorizers {
 		auditFields = append(auditFields, a.LoggingClosure(r)...)
 	}
+	acc := c.access(r, policy.Apply)
 
 	defer func() {
 		successful := err == nil
+		auditFields = append(auditFields, acc.auditFields()...)
 		auditFields = append(
 			auditFields,
 			zap.String("controller", "apply"),
@@ -82,11 +236,11 @@ func (c ApiController) ApplyChart(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		zap.L().Error("Error getting release", zap.Error(err))
 
+		w.WriteHeader(statusForError(err))
 		applyResp.Status = "error"
 		applyResp.Message = "Error getting release"
-		err = json.NewEncoder(w).Encode(applyResp)
-		if err != nil {
-			zap.L().Error("Error marshaling response", zap.Error(err))
+		if encErr := json.NewEncoder(w).Encode(applyResp); encErr != nil {
+			zap.L().Error("Error marshaling response", zap.Error(encErr))
 		}
 		return
 	}
@@ -97,45 +251,84 @@ func (c ApiController) ApplyChart(w http.ResponseWriter, r *http.Request) {
 		zap.String("namespace", release.Namespace),
 	)
 
-	var location string
-	location, err = release.Download()
+	releases, result := c.prepare(r.Context(), *release, acc)
+	var unlock func()
+	if result.err == nil {
+		unlock, result = c.lock(r.Context(), *release, releases)
+	}
+	if err = result.err; err != nil {
+		w.WriteHeader(result.status)
+		applyResp.Status = "error"
+		applyResp.Message = result.message
+		if encErr := json.NewEncoder(w).Encode(applyResp); encErr != nil {
+			zap.L().Error("Error marshaling response", zap.Error(encErr))
+		}
+		return
+	}
 
-	if err != nil {
-		zap.L().Error("Error downloading release", zap.Error(err))
+	if applyReq.Async {
+		// The leases were only taken to reject a release that is already
+		// being applied straight away. The job takes them again when it
+		// starts, so that time spent in the queue doesn't count against them.
+		unlock()
 
-		w.WriteHeader(http.StatusInternalServerError)
-		applyResp.Status = "error"
-		applyResp.Message = "Error downloading release"
-		err = json.NewEncoder(w).Encode(applyResp)
+		var id string
+		id, err = c.jobs.start(*release, append(auditFields, acc.auditFields()...), func(ctx context.Context, release store.Release, progress func(string)) applyResult {
+			// A job can't outlive its leases
+			ctx, cancel := context.WithTimeout(ctx, c.applyTimeout(releases))
+			defer cancel()
 
+			unlock, result := c.lock(ctx, release, releases)
+			if result.err != nil {
+				return result
+			}
+			defer unlock()
+			return c.applyAll(ctx, release, releases, progress)
+		})
 		if err != nil {
-			zap.L().Error("Error marshaling response", zap.Error(err))
+			zap.L().Error("Error starting job", zap.Error(err))
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+			applyResp.Status = "error"
+			applyResp.Message = "Error starting job"
+			err = json.NewEncoder(w).Encode(applyResp)
+			if err != nil {
+				zap.L().Error("Error marshaling response", zap.Error(err))
+			}
+			return
+		}
+		// The job writes its own audit log when it finishes
+		auditFields = append(auditFields, zap.String("job", id))
+
+		w.Header().Set("Location", "/jobs/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		applyResp.Status = "accepted"
+		applyResp.Message = fmt.Sprintf("Applying %s", release.Name)
+		applyResp.Job = id
+		if encErr := json.NewEncoder(w).Encode(applyResp); encErr != nil {
+			zap.L().Error("Error marshaling response", zap.Error(encErr))
 		}
 		return
 	}
 
-	err = upsertRelease(release, upsertConfig{
-		location: location,
-		timeout:  c.timeout,
-	})
+	defer unlock()
+	result = c.applyAll(r.Context(), *release, releases, func(string) {})
+	auditFields = append(auditFields, zap.Int("dependencies", result.dependencies))
+	err = result.err
 
 	if err != nil {
-		zap.L().Error("Error applying release", zap.Error(err))
-
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(result.status)
 		applyResp.Status = "error"
-		applyResp.Message = "Error applying release"
-		err = json.NewEncoder(w).Encode(applyResp)
-		if err != nil {
-			zap.L().Error("Error marshaling response", zap.Error(err))
+		applyResp.Message = result.message
+		if encErr := json.NewEncoder(w).Encode(applyResp); encErr != nil {
+			zap.L().Error("Error marshaling response", zap.Error(encErr))
 		}
 		return
 	}
 
 	applyResp.Status = "success"
-	applyResp.Message = fmt.Sprintf("Successfully installed %s", release.Name)
-	err = json.NewEncoder(w).Encode(applyResp)
-	if err != nil {
-		zap.L().Error("Error marshaling response", zap.Error(err))
+	applyResp.Message = result.message
+	if encErr := json.NewEncoder(w).Encode(applyResp); encErr != nil {
+		zap.L().Error("Error marshaling response", zap.Error(encErr))
 	}
 }
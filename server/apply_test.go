@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/memory"
+	"github.com/skuid/helm-value-store/refs"
+	"github.com/skuid/helm-value-store/store"
+)
+
+func newTestController(t *testing.T, releases store.Releases, d deploy.Deployer) *ApiController {
+	rs := memory.NewReleaseStore()
+	if err := rs.Load(context.Background(), releases); err != nil {
+		t.Fatalf("Error loading releases: %s", err)
+	}
+	resolver := refs.NewRegistry()
+	resolver.Register("fake", refs.ResolverFunc(func(ctx context.Context, ref refs.Ref) (string, error) {
+		return "secret", nil
+	}))
+	c := NewApiController(rs, WithDeployer(d), WithResolver(resolver))
+	c.download = func(r store.Release) (string, error) {
+		return r.Chart + ".tgz", nil
+	}
+	return c
+}
+
+func apply(c *ApiController, uuid string) (*httptest.ResponseRecorder, *applyResponse) {
+	body, _ := json.Marshal(applyRequest{UUID: uuid})
+	w := httptest.NewRecorder()
+	c.ApplyChart(w, httptest.NewRequest(http.MethodPost, "/apply", bytes.NewReader(body)))
+	resp := &applyResponse{}
+	json.NewDecoder(w.Body).Decode(resp)
+	return w, resp
+}
+
+func TestApplyChart(t *testing.T) {
+	releases := store.Releases{
+		{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Values: "password: ref+fake://password\n",
+			Dependencies: []store.Dependency{{Name: "alertmanager"}, {UniqueID: "exp"}}},
+		{UniqueID: "am", Name: "alertmanager", Chart: "stable/alertmanager", Dependencies: []store.Dependency{{UniqueID: "exp"}}},
+		{UniqueID: "exp", Name: "exporter", Chart: "stable/exporter"},
+		{UniqueID: "other", Name: "other", Chart: "stable/other"},
+		{UniqueID: "orphan", Name: "orphan", Chart: "stable/orphan", Dependencies: []store.Dependency{{Name: "missing"}}},
+		{UniqueID: "indirect", Name: "indirect", Chart: "stable/indirect", Dependencies: []store.Dependency{{UniqueID: "orphan"}}},
+	}
+
+	cases := []struct {
+		name       string
+		uuid       string
+		errors     map[string]error
+		wantStatus int
+		wantCalls  []string
+	}{
+		{"dependencies first", "prom", nil, http.StatusOK, []string{"exporter", "alertmanager", "prometheus"}},
+		{"no dependencies", "other", nil, http.StatusOK, []string{"other"}},
+		{"not found", "missing", nil, http.StatusNotFound, []string{}},
+		{"missing dependency", "orphan", nil, http.StatusConflict, []string{}},
+		{"missing indirect dependency", "indirect", nil, http.StatusConflict, []string{}},
+		{"dependency fails", "prom", map[string]error{"alertmanager": errors.New("boom")}, http.StatusInternalServerError, []string{"exporter", "alertmanager"}},
+	}
+
+	for _, c := range cases {
+		d := deploy.NewFake()
+		for name, err := range c.errors {
+			d.Errors[name] = err
+		}
+		w, resp := apply(newTestController(t, releases, d), c.uuid)
+
+		if w.Code != c.wantStatus {
+			t.Errorf("Test '%s': Expected status %d, got %d (%s)", c.name, c.wantStatus, w.Code, resp.Message)
+		}
+		installed := []string{}
+		for _, call := range d.Calls() {
+			installed = append(installed, call.Release.Name)
+		}
+		if !reflect.DeepEqual(installed, c.wantCalls) {
+			t.Errorf("Test '%s': Expected installs %v, got %v", c.name, c.wantCalls, installed)
+		}
+	}
+}
+
+func TestApplyChartResolvesReferences(t *testing.T) {
+	d := deploy.NewFake()
+	releases := store.Releases{{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Values: "password: ref+fake://password\n"}}
+	c := newTestController(t, releases, d)
+
+	if w, resp := apply(c, "prom"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d (%s)", w.Code, resp.Message)
+	}
+	deployed, err := d.Get(store.Release{Name: "prometheus"})
+	if err != nil {
+		t.Fatalf("Error getting deployed release: %s", err)
+	}
+	if deployed.Config.Raw != "password: secret\n" {
+		t.Errorf("Expected references to be resolved, got %q", deployed.Config.Raw)
+	}
+
+	stored, _ := c.releaseStore.Get(context.Background(), "prom")
+	if stored.Values != releases[0].Values {
+		t.Errorf("Expected stored values to keep their references, got %q", stored.Values)
+	}
+
+	if w, _ := apply(c, "prom"); w.Code != http.StatusOK {
+		t.Errorf("Expected a second apply to upgrade, got status %d", w.Code)
+	}
+	if calls := d.Calls(); len(calls) != 2 || calls[1].Action != "upgrade" {
+		t.Errorf("Expected an install then an upgrade, got %v", calls)
+	}
+}
+
+func TestApplyChartRejectsReferencesByDefault(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": {"password": "hunter2"}}`))
+	}))
+	defer vault.Close()
+	os.Setenv("VAULT_ADDR", vault.URL)
+	defer os.Unsetenv("VAULT_ADDR")
+	os.Setenv("HVS_SERVER_SECRET", "hunter2")
+	defer os.Unsetenv("HVS_SERVER_SECRET")
+
+	for _, values := range []string{"secret: ref+env://HVS_SERVER_SECRET\n", "secret: ref+file:///etc/hostname\n", "secret: ref+vault://secret/db#password\n"} {
+		d := deploy.NewFake()
+		rs := memory.NewReleaseStore()
+		rs.Put(context.Background(), store.Release{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Values: values})
+		// The default resolvers, not newTestController's
+		c := NewApiController(rs, WithDeployer(d))
+		c.download = func(r store.Release) (string, error) {
+			return r.Chart + ".tgz", nil
+		}
+
+		if w, resp := apply(c, "prom"); w.Code == http.StatusOK {
+			t.Errorf("Expected applying %q to fail, got status %d (%s)", values, w.Code, resp.Message)
+		}
+		if calls := d.Calls(); len(calls) != 0 {
+			t.Errorf("Expected nothing to be installed with %q, got %v", values, calls)
+		}
+	}
+}
+
+func TestApplyChartLocked(t *testing.T) {
+	releases := store.Releases{
+		{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Dependencies: []store.Dependency{{UniqueID: "am"}}},
+		{UniqueID: "am", Name: "alertmanager", Chart: "stable/alertmanager"},
+	}
+	d := deploy.NewFake()
+	c := newTestController(t, releases, d)
+
+	// Another replica is applying the dependency
+	lease, err := c.releaseStore.Lock(context.Background(), "am", "replica-2", time.Minute)
+	if err != nil {
+		t.Fatalf("Error locking release: %s", err)
+	}
+	w, resp := apply(c, "prom")
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d (%s)", w.Code, resp.Message)
+	}
+	if want := "Error locking release dependency alertmanager"; resp.Message != want {
+		t.Errorf("Expected message %q, got %q", want, resp.Message)
+	}
+	if calls := d.Calls(); len(calls) != 0 {
+		t.Errorf("Expected nothing to be applied, got %v", calls)
+	}
+
+	// The leases taken before the failure are released
+	if err := c.releaseStore.Unlock(context.Background(), *lease); err != nil {
+		t.Fatalf("Error unlocking release: %s", err)
+	}
+	if w, resp := apply(c, "prom"); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 once the release is unlocked, got %d (%s)", w.Code, resp.Message)
+	}
+}
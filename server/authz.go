@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/helm-value-store/store"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// errForbidden is the error for requests the policy doesn't allow
+var errForbidden = errors.New("not allowed by policy")
+
+// An identifier is an authorizer that knows who made a request, and which
+// groups they are in
+type identifier interface {
+	Identity(r *http.Request) (policy.Identity, bool)
+}
+
+// identity returns who made a request. Authorizers that can't say which groups
+// a user is in are asked for the user they log.
+func (c ApiController) identity(r *http.Request) policy.Identity {
+	for _, a := range c.authorizers {
+		if i, ok := a.(identifier); ok {
+			if id, ok := i.Identity(r); ok {
+				return id
+			}
+			continue
+		}
+		for _, field := range a.LoggingClosure(r) {
+			if field.Key == "user" && field.Type == zapcore.StringType {
+				return policy.Identity{User: field.String}
+			}
+		}
+	}
+	return policy.Identity{}
+}
+
+// access checks what the user making a request may do to releases, and keeps
+// the decisions for the audit log
+type access struct {
+	policy   *policy.Policy
+	identity policy.Identity
+	action   policy.Action
+	// rules are the names of the rules that allowed the request
+	rules map[string]bool
+	// denied is the release the request was denied on, if any
+	denied *store.Release
+}
+
+// access returns the access of the user making a request, who is taking
+// action. Everything is allowed if the controller has no policy.
+func (c ApiController) access(r *http.Request, action policy.Action) *access {
+	a := &access{policy: c.policy, action: action, rules: map[string]bool{}}
+	if c.policy != nil {
+		a.identity = c.identity(r)
+	}
+	return a
+}
+
+// allowed reports whether the user may take the request's action on a release
+func (a *access) allowed(release store.Release) bool {
+	if a.policy == nil {
+		return true
+	}
+	rule, ok := a.policy.Allowed(a.identity, a.action, release)
+	if !ok {
+		if a.denied == nil {
+			a.denied = &release
+		}
+		return false
+	}
+	a.rules[rule] = true
+	return true
+}
+
+// deniedMessage describes the first release the request was denied on
+func (a *access) deniedMessage() string {
+	if a.denied == nil {
+		return "Not allowed"
+	}
+	return fmt.Sprintf("Not allowed to %s release %s", a.action, a.denied.UniqueID)
+}
+
+// auditFields returns the decisions made on the request, if there is a policy
+func (a *access) auditFields() []zapcore.Field {
+	if a.policy == nil {
+		return nil
+	}
+	rules := []string{}
+	for rule := range a.rules {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	fields := []zapcore.Field{
+		zap.String("action", string(a.action)),
+		zap.Strings("groups", a.policy.GroupsOf(a.identity)),
+		zap.Strings("rules", rules),
+		zap.Bool("authorized", a.denied == nil),
+	}
+	if a.denied != nil {
+		fields = append(fields, zap.String("denied", a.denied.UniqueID))
+	}
+	return fields
+}
+
+// writeForbidden writes a JSON response for a request that was denied
+func writeForbidden(w http.ResponseWriter, a *access) {
+	writeJSON(w, http.StatusForbidden, applyResponse{Status: "error", Message: a.deniedMessage()})
+}
+
+// auditRead writes an audit log for a read of id, or of a list if id is
+// empty, with the policy's decisions on it
+func (c ApiController) auditRead(r *http.Request, controller, id string, a *access, successful bool) {
+	var auditFields []zapcore.Field
+	for _, az := range c.authorizers {
+		auditFields = append(auditFields, az.LoggingClosure(r)...)
+	}
+	auditFields = append(auditFields, a.auditFields()...)
+	if len(id) > 0 {
+		auditFields = append(auditFields, zap.String("uuid", id))
+	}
+	auditFields = append(auditFields,
+		zap.String("controller", controller),
+		zap.String("method", r.Method),
+		zap.Bool("successful", successful),
+	)
+	zap.L().Info("Audit Log", auditFields...)
+}
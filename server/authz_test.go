@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skuid/go-middlewares"
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/spec/middlewares"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeAuthorizer logs the user in the X-User header
+type fakeAuthorizer struct{}
+
+func (fakeAuthorizer) Authorize() middlewares.Middleware {
+	return func(h http.Handler) http.Handler { return h }
+}
+
+func (fakeAuthorizer) LoggingClosure(r *http.Request) []zapcore.Field {
+	if user := r.Header.Get("X-User"); len(user) > 0 {
+		return []zapcore.Field{zap.String("user", user)}
+	}
+	return nil
+}
+
+// fakeIdentifier also knows the groups in the X-Groups header
+type fakeIdentifier struct {
+	fakeAuthorizer
+}
+
+func (fakeIdentifier) Identity(r *http.Request) (policy.Identity, bool) {
+	user := r.Header.Get("X-User")
+	if len(user) == 0 {
+		return policy.Identity{}, false
+	}
+	return policy.Identity{User: user, Groups: strings.Split(r.Header.Get("X-Groups"), ",")}, true
+}
+
+var testPolicy = &policy.Policy{
+	Groups: map[string][]string{"team-test": {"alice@example.com"}},
+	Rules: []policy.Rule{
+		{Name: "test", Groups: []string{"team-test"}, Actions: []policy.Action{policy.Read, policy.Write, policy.Apply}, Selector: map[string]string{"environment": "test"}},
+		{Name: "sre", Groups: []string{"sre"}, Actions: []policy.Action{policy.Read, policy.Write, policy.Apply}},
+	},
+}
+
+func newPolicyController(t *testing.T, releases store.Releases, d deploy.Deployer) *ApiController {
+	c := newTestController(t, releases, d)
+	WithAuthorizers(fakeIdentifier{})(c)
+	WithPolicy(testPolicy)(c)
+	return c
+}
+
+func userRequest(method, path, body, user, groups string) *http.Request {
+	r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	r.Header.Set("X-User", user)
+	r.Header.Set("X-Groups", groups)
+	return r
+}
+
+func TestIdentity(t *testing.T) {
+	r := userRequest(http.MethodGet, "/releases", "", "bob@example.com", "sre,dev")
+	cases := []struct {
+		name        string
+		authorizers []go_middlewares.Authorizer
+		want        policy.Identity
+	}{
+		{"logged user", []go_middlewares.Authorizer{fakeAuthorizer{}}, policy.Identity{User: "bob@example.com"}},
+		{"identifier", []go_middlewares.Authorizer{fakeIdentifier{}}, policy.Identity{User: "bob@example.com", Groups: []string{"sre", "dev"}}},
+		{"no authorizers", nil, policy.Identity{}},
+	}
+
+	for _, tc := range cases {
+		c := ApiController{authorizers: tc.authorizers}
+		if got := c.identity(r); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Test '%s': Expected identity %+v, got %+v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestApplyChartPolicy(t *testing.T) {
+	releases := store.Releases{
+		{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Labels: map[string]string{"environment": "test"},
+			Dependencies: []store.Dependency{{UniqueID: "am"}}},
+		{UniqueID: "am", Name: "alertmanager", Chart: "stable/alertmanager", Labels: map[string]string{"environment": "prod"}},
+		{UniqueID: "exp", Name: "exporter", Chart: "stable/exporter", Labels: map[string]string{"environment": "test"}},
+	}
+
+	cases := []struct {
+		name       string
+		uuid       string
+		user       string
+		groups     string
+		wantStatus int
+		wantCalls  int
+	}{
+		{"in scope", "exp", "alice@example.com", "", http.StatusOK, 1},
+		{"dependency out of scope", "prom", "alice@example.com", "", http.StatusForbidden, 0},
+		{"group from identity", "prom", "bob@example.com", "sre", http.StatusOK, 2},
+		{"no rule", "exp", "bob@example.com", "", http.StatusForbidden, 0},
+	}
+
+	for _, tc := range cases {
+		d := deploy.NewFake()
+		c := newPolicyController(t, releases, d)
+		body, _ := json.Marshal(applyRequest{UUID: tc.uuid})
+		w := httptest.NewRecorder()
+		c.ApplyChart(w, userRequest(http.MethodPost, "/apply", string(body), tc.user, tc.groups))
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("Test '%s': Expected status %d, got %d (%s)", tc.name, tc.wantStatus, w.Code, w.Body)
+		}
+		if calls := d.Calls(); len(calls) != tc.wantCalls {
+			t.Errorf("Test '%s': Expected %d installs, got %d", tc.name, tc.wantCalls, len(calls))
+		}
+	}
+}
+
+func TestReleasesPolicy(t *testing.T) {
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"get in scope", http.MethodGet, "/releases/prom-test", "", http.StatusOK},
+		{"get out of scope", http.MethodGet, "/releases/prom", "", http.StatusNotFound},
+		{"get missing", http.MethodGet, "/releases/missing", "", http.StatusNotFound},
+		{"create in scope", http.MethodPost, "/releases", `{"unique_id": "new", "chart": "stable/new", "labels": {"environment": "test"}}`, http.StatusCreated},
+		{"create out of scope", http.MethodPost, "/releases", `{"unique_id": "new", "chart": "stable/new", "labels": {"environment": "prod"}}`, http.StatusForbidden},
+		{"replace into scope", http.MethodPut, "/releases/am", `{"chart": "stable/alertmanager", "labels": {"environment": "test"}}`, http.StatusNotFound},
+		{"replace missing", http.MethodPut, "/releases/missing", `{"chart": "stable/missing", "labels": {"environment": "test"}}`, http.StatusNotFound},
+		{"patch in scope", http.MethodPatch, "/releases/prom-test", `{"version": "0.2.0"}`, http.StatusOK},
+		{"patch out of scope", http.MethodPatch, "/releases/prom-test", `{"labels": {"environment": "prod"}}`, http.StatusForbidden},
+		{"delete out of scope", http.MethodDelete, "/releases/prom", "", http.StatusNotFound},
+		{"delete missing", http.MethodDelete, "/releases/missing", "", http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		c := newPolicyController(t, restReleases, deploy.NewFake())
+		w := httptest.NewRecorder()
+		c.Releases(w, userRequest(tc.method, tc.path, tc.body, "alice@example.com", ""))
+		if w.Code != tc.wantStatus {
+			t.Errorf("Test '%s': Expected status %d, got %d (%s)", tc.name, tc.wantStatus, w.Code, w.Body)
+		}
+		// Releases the user may not read look the same as missing ones
+		if w.Code == http.StatusNotFound && w.Body.String() != "{\"status\":\"error\",\"message\":\"Release not found\"}\n" {
+			t.Errorf("Test '%s': Expected the same response as a missing release, got %s", tc.name, w.Body)
+		}
+	}
+
+	// Lists leave out releases the user may not read
+	c := newPolicyController(t, restReleases, deploy.NewFake())
+	w := httptest.NewRecorder()
+	c.Releases(w, userRequest(http.MethodGet, "/releases", "", "alice@example.com", ""))
+	releases := store.Releases{}
+	json.NewDecoder(w.Body).Decode(&releases)
+	if len(releases) != 1 || releases[0].UniqueID != "prom-test" {
+		t.Errorf("Expected to only list prom-test, got %v", releases)
+	}
+}
+
+func TestReadsAudited(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	c := newPolicyController(t, restReleases, deploy.NewFake())
+	for _, path := range []string{"/releases/prom-test", "/releases/prom", "/releases"} {
+		c.Releases(httptest.NewRecorder(), userRequest(http.MethodGet, path, "", "alice@example.com", ""))
+	}
+
+	audits := logs.FilterMessage("Audit Log").AllUntimed()
+	if len(audits) != 3 {
+		t.Fatalf("Expected every read to be audited, got %d audit logs", len(audits))
+	}
+	want := []struct {
+		uuid       string
+		successful bool
+	}{{"prom-test", true}, {"prom", false}, {"", true}}
+	for i, w := range want {
+		fields := audits[i].ContextMap()
+		if uuid, _ := fields["uuid"].(string); uuid != w.uuid || fields["successful"] != w.successful || fields["user"] != "alice@example.com" {
+			t.Errorf("Expected an audit log of reading %q with successful %t, got %v", w.uuid, w.successful, fields)
+		}
+	}
+}
+
+func TestJobsPolicy(t *testing.T) {
+	c := newPolicyController(t, restReleases, deploy.NewFake())
+	body, _ := json.Marshal(applyRequest{UUID: "prom", Async: true})
+	w := httptest.NewRecorder()
+	c.ApplyChart(w, userRequest(http.MethodPost, "/apply", string(body), "bob@example.com", "sre"))
+	resp := &applyResponse{}
+	json.NewDecoder(w.Body).Decode(resp)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the apply to be accepted, got %d (%s)", w.Code, resp.Message)
+	}
+	waitForJob(t, c, resp.Job)
+
+	w = httptest.NewRecorder()
+	c.Jobs(w, userRequest(http.MethodGet, "/jobs/"+resp.Job, "", "alice@example.com", ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected reading a job out of scope to return 403, got %d", w.Code)
+	}
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/helm-value-store/store"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Job statuses
+const (
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+var (
+	// errQueueFull is returned when a job can't be queued
+	errQueueFull = errors.New("too many jobs are queued")
+	// errShutdown is returned when a job can't be queued, or run, because
+	// the server is shutting down
+	errShutdown = errors.New("the server is shutting down")
+)
+
+// statusMisdirectedRequest is returned for a job kept by another replica. It
+// is http.StatusMisdirectedRequest, which needs Go 1.11.
+const statusMisdirectedRequest = 421
+
+// jobEvent is a progress message from a job
+type jobEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// job is a release being applied in the background
+type job struct {
+	ID       string     `json:"id"`
+	UUID     string     `json:"uuid"`
+	Release  string     `json:"release"`
+	Status   string     `json:"status"`
+	Message  string     `json:"message,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Events   []jobEvent `json:"events,omitempty"`
+
+	// labels are the labels of the release, which decide who may read the
+	// job
+	labels map[string]string
+}
+
+func (j job) done() bool {
+	return j.Status == jobSucceeded || j.Status == jobFailed
+}
+
+// applyFunc applies a release, reporting each step to progress
+type applyFunc func(ctx context.Context, release store.Release, progress func(string)) applyResult
+
+// jobQueue runs jobs on a fixed number of workers, and keeps the most recent
+// jobs so their status can be polled. It is safe for concurrent use.
+//
+// Jobs are only kept in the memory of the replica that started them, so job
+// IDs end with the replica's name, and the replica tells clients that ask it
+// about another replica's job where to go.
+type jobQueue struct {
+	workers int
+	// maxJobs is the number of jobs kept. The oldest finished jobs are
+	// forgotten first.
+	maxJobs int
+	// replica names this server in job IDs
+	replica string
+	queue   chan func()
+	once    sync.Once
+	// ctx is canceled to stop running jobs when a shutdown times out
+	ctx    context.Context
+	cancel context.CancelFunc
+	// running counts the jobs that are queued or running
+	running sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	// ids are job IDs, oldest first
+	ids []string
+	// changed is closed, and replaced, whenever a job changes
+	changed chan struct{}
+	// closed is set once the queue is shut down
+	closed bool
+}
+
+// newJobQueue returns a jobQueue with at least one worker, named after the
+// host it runs on
+func newJobQueue(workers, maxJobs int) *jobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	replica, err := os.Hostname()
+	if err != nil {
+		replica = "unknown"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobQueue{
+		workers: workers,
+		maxJobs: maxJobs,
+		replica: replica,
+		queue:   make(chan func(), maxJobs),
+		ctx:     ctx,
+		cancel:  cancel,
+		jobs:    map[string]*job{},
+		changed: make(chan struct{}),
+	}
+}
+
+// start queues a job applying a release, and returns its ID. The job writes
+// an audit log with auditFields when it finishes.
+func (q *jobQueue) start(release store.Release, auditFields []zapcore.Field, apply applyFunc) (string, error) {
+	q.once.Do(func() {
+		for i := 0; i < q.workers; i++ {
+			go func() {
+				for run := range q.queue {
+					run()
+				}
+			}()
+		}
+	})
+
+	// The caller keeps appending to its own fields
+	auditFields = append([]zapcore.Field{}, auditFields...)
+
+	j := &job{
+		ID:      uuid.New().String() + "." + q.replica,
+		UUID:    release.UniqueID,
+		Release: release.Name,
+		Status:  jobPending,
+		Created: time.Now(),
+		Events:  []jobEvent{},
+		labels:  release.Labels,
+	}
+
+	run := func() {
+		defer q.running.Done()
+
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+
+		result := applyResult{message: "The server shut down before the job started", err: errShutdown}
+		if !closed {
+			q.update(j.ID, func(j *job) { j.Status = jobRunning })
+			result = apply(q.ctx, release, func(message string) {
+				q.update(j.ID, func(j *job) {
+					j.Events = append(j.Events, jobEvent{Time: time.Now(), Message: message})
+				})
+			})
+		}
+		q.update(j.ID, func(j *job) {
+			now := time.Now()
+			j.Finished = &now
+			j.Message = result.message
+			j.Status = jobSucceeded
+			if result.err != nil {
+				j.Status = jobFailed
+				j.Message = fmt.Sprintf("%s: %s", result.message, result.err)
+			}
+		})
+
+		zap.L().Info("Audit Log", append(auditFields,
+			zap.String("job", j.ID),
+			zap.Int("dependencies", result.dependencies),
+			zap.String("controller", "apply"),
+			zap.Bool("successful", result.err == nil),
+		)...)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return "", errShutdown
+	}
+	q.running.Add(1)
+	select {
+	case q.queue <- run:
+	default:
+		q.running.Done()
+		return "", errQueueFull
+	}
+	q.jobs[j.ID] = j
+	q.ids = append(q.ids, j.ID)
+	q.evict()
+	return j.ID, nil
+}
+
+// shutdown stops queueing jobs, fails the jobs that haven't started, and waits
+// for the running jobs to finish. If ctx is done first, the running jobs are
+// canceled and ctx's error is returned.
+func (q *jobQueue) shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+// replicaOf returns the name of the replica that started a job
+func replicaOf(id string) string {
+	parts := strings.SplitN(id, ".", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// evict forgets the oldest finished jobs until at most maxJobs are kept. The
+// caller must hold the lock.
+func (q *jobQueue) evict() {
+	kept := []string{}
+	excess := len(q.ids) - q.maxJobs
+	for _, id := range q.ids {
+		if excess > 0 && q.jobs[id].done() {
+			delete(q.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	q.ids = kept
+}
+
+// update changes a job and wakes anyone watching it
+func (q *jobQueue) update(id string, change func(*job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.jobs[id]; ok {
+		change(j)
+	}
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// get returns a copy of a job, and a channel that is closed the next time
+// any job changes
+func (q *jobQueue) get(id string) (job, <-chan struct{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, q.changed, false
+	}
+	response := *j
+	response.Events = append([]jobEvent{}, j.Events...)
+	return response, q.changed, true
+}
+
+// Jobs serves the status of jobs started by applying a release with
+// "async": true:
+//
+//	GET /jobs/{id}         returns the job's status and progress events
+//	GET /jobs/{id}/events  streams the job's progress as server-sent events
+//
+// The event stream sends each progress event with its index as its id, then
+// a "done" event with the finished job. A Last-Event-ID header resumes the
+// stream after that event.
+func (c ApiController) Jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, applyResponse{Status: "error", Message: "Method not allowed"})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/")
+	j, _, ok := c.jobs.get(parts[0])
+	acc := c.access(r, policy.Read)
+	switch {
+	case !ok && len(replicaOf(parts[0])) > 0 && replicaOf(parts[0]) != c.jobs.replica:
+		// Load balancers must send requests for a job to the replica that
+		// started it
+		writeJSON(w, statusMisdirectedRequest, applyResponse{
+			Status:  "error",
+			Message: fmt.Sprintf("Job was started by replica %s, not %s", replicaOf(parts[0]), c.jobs.replica),
+		})
+	case !ok || len(parts) > 2 || len(parts) == 2 && parts[1] != "events":
+		writeJSON(w, http.StatusNotFound, applyResponse{Status: "error", Message: "Job not found"})
+	case !acc.allowed(store.Release{UniqueID: j.UUID, Labels: j.labels}):
+		c.auditRead(r, "jobs", j.ID, acc, false)
+		writeForbidden(w, acc)
+	case len(parts) == 1:
+		c.auditRead(r, "jobs", j.ID, acc, true)
+		writeJSON(w, http.StatusOK, j)
+	default:
+		c.auditRead(r, "jobs", j.ID, acc, true)
+		c.streamJob(w, r, j.ID)
+	}
+}
+
+// flusherKey is the request context key of the server's http.Flusher
+type flusherKey struct{}
+
+// flushing keeps the server's http.Flusher in the request context, so that a
+// handler can flush its response through middlewares that wrap the writer
+// without passing Flush on
+func flushing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flusher, ok := w.(http.Flusher); ok {
+			r = r.WithContext(context.WithValue(r.Context(), flusherKey{}, flusher))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// streamJob writes a job's progress events as they happen, until it finishes
+func (c ApiController) streamJob(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		flusher, ok = r.Context().Value(flusherKey{}).(http.Flusher)
+	}
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, applyResponse{Status: "error", Message: "Streaming is not supported"})
+		return
+	}
+
+	next := 0
+	if last, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = last + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		j, changed, ok := c.jobs.get(id)
+		if !ok {
+			// The job was forgotten while streaming
+			return
+		}
+		for ; next < len(j.Events); next++ {
+			data, _ := json.Marshal(j.Events[next])
+			fmt.Fprintf(w, "id: %d\nevent: progress\ndata: %s\n\n", next, data)
+		}
+		if j.done() {
+			j.Events = nil
+			data, _ := json.Marshal(j)
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/refs"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/spec/middlewares"
+)
+
+var jobReleases = store.Releases{
+	{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Dependencies: []store.Dependency{{UniqueID: "am"}}},
+	{UniqueID: "am", Name: "alertmanager", Chart: "stable/alertmanager"},
+}
+
+func applyAsync(t *testing.T, c *ApiController, uuid string) string {
+	body, _ := json.Marshal(applyRequest{UUID: uuid, Async: true})
+	w := httptest.NewRecorder()
+	c.ApplyChart(w, httptest.NewRequest(http.MethodPost, "/apply", bytes.NewReader(body)))
+
+	resp := &applyResponse{}
+	json.NewDecoder(w.Body).Decode(resp)
+	if w.Code != http.StatusAccepted || resp.Status != "accepted" || len(resp.Job) == 0 {
+		t.Fatalf("Expected the apply to be accepted as a job, got %d %v", w.Code, resp)
+	}
+	if location := w.Header().Get("Location"); location != "/jobs/"+resp.Job {
+		t.Errorf("Expected the job's location, got %s", location)
+	}
+	return resp.Job
+}
+
+// waitForJob waits until a job is done
+func waitForJob(t *testing.T, c *ApiController, id string) job {
+	timeout := time.After(5 * time.Second)
+	for {
+		j, changed, ok := c.jobs.get(id)
+		if !ok {
+			t.Fatalf("Job %s not found", id)
+		}
+		if j.done() {
+			return j
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("Timed out waiting for job %s, got %v", id, j)
+		}
+	}
+}
+
+func getJob(c *ApiController, path string, header http.Header) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		r.Header.Set(k, v[0])
+	}
+	c.Jobs(w, r)
+	return w
+}
+
+func TestAsyncApply(t *testing.T) {
+	d := deploy.NewFake()
+	c := newTestController(t, jobReleases, d)
+
+	id := applyAsync(t, c, "prom")
+	waitForJob(t, c, id)
+
+	w := getJob(c, "/jobs/"+id, nil)
+	j := job{}
+	json.NewDecoder(w.Body).Decode(&j)
+	if w.Code != http.StatusOK || j.Status != jobSucceeded || j.UUID != "prom" || j.Finished == nil {
+		t.Fatalf("Expected a succeeded job, got %d %v", w.Code, j)
+	}
+	if len(j.Events) != 8 || j.Events[3].Message != "Successfully installed alertmanager" {
+		t.Errorf("Expected progress events for both releases, got %v", j.Events)
+	}
+	if calls := d.Calls(); len(calls) != 2 {
+		t.Errorf("Expected the release and its dependency to be installed, got %v", calls)
+	}
+
+	// A finished job's stream sends every event, then the job
+	w = getJob(c, "/jobs/"+id+"/events", nil)
+	body := w.Body.String()
+	if w.Header().Get("Content-Type") != "text/event-stream" || strings.Count(body, "event: progress") != 8 || !strings.Contains(body, "event: done") {
+		t.Errorf("Unexpected event stream:\n%s", body)
+	}
+
+	w = getJob(c, "/jobs/"+id+"/events", http.Header{"Last-Event-ID": {"5"}})
+	if body := w.Body.String(); strings.Count(body, "event: progress") != 2 || !strings.HasPrefix(body, "id: 6\n") {
+		t.Errorf("Expected the stream to resume after event 5, got:\n%s", body)
+	}
+}
+
+func TestAsyncApplyFailure(t *testing.T) {
+	d := deploy.NewFake()
+	d.Errors["prometheus"] = errors.New("tiller is down")
+	c := newTestController(t, jobReleases, d)
+
+	j := waitForJob(t, c, applyAsync(t, c, "prom"))
+	if j.Status != jobFailed || !strings.Contains(j.Message, "tiller is down") {
+		t.Errorf("Expected the job to fail with the deploy error, got %v", j)
+	}
+}
+
+func TestJobsNotFound(t *testing.T) {
+	c := newTestController(t, jobReleases, deploy.NewFake())
+	id := applyAsync(t, c, "am")
+	waitForJob(t, c, id)
+
+	for _, path := range []string{"/jobs/missing", "/jobs/missing/events", "/jobs/" + id + "/other", "/jobs/"} {
+		if w := getJob(c, path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to be not found, got %d", path, w.Code)
+		}
+	}
+}
+
+// streamEvents streams a job through handler, and returns the data of each
+// event. unblock is closed once the first events have been received.
+func streamEvents(t *testing.T, handler http.Handler, id string, unblock chan struct{}) []string {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/jobs/" + id + "/events")
+	if err != nil {
+		t.Fatalf("Error streaming job: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the job to be streamed, got %d", resp.StatusCode)
+	}
+
+	events := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		events = append(events, line)
+		// The job waits on the download until the first events are streamed
+		if len(events) == 2 {
+			close(unblock)
+		}
+	}
+	return events
+}
+
+func TestStreamRunningJob(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler func(c *ApiController) http.Handler
+	}{
+		{"jobs handler", func(c *ApiController) http.Handler { return http.HandlerFunc(c.Jobs) }},
+		// serve wraps the API's writers in middlewares that don't implement
+		// http.Flusher
+		{"with serve's middlewares", func(c *ApiController) http.Handler {
+			return c.Handler(middlewares.InstrumentRoute(), middlewares.Logging())
+		}},
+	}
+
+	for _, tc := range cases {
+		c := newTestController(t, jobReleases, deploy.NewFake())
+		unblock := make(chan struct{})
+		c.download = func(r store.Release) (string, error) {
+			<-unblock
+			return r.Chart + ".tgz", nil
+		}
+
+		id := applyAsync(t, c, "am")
+		events := streamEvents(t, tc.handler(c), id, unblock)
+		if len(events) != 5 || !strings.Contains(events[4], `"status":"succeeded"`) {
+			t.Errorf("Test '%s': Expected 4 progress events and the finished job, got %v", tc.name, events)
+		}
+	}
+}
+
+func TestJobQueueFull(t *testing.T) {
+	releases := store.Releases{}
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("queued%d", i)
+		releases = append(releases, store.Release{UniqueID: id, Name: id, Chart: "stable/" + id})
+	}
+	c := newTestController(t, releases, deploy.NewFake())
+	c.jobs = newJobQueue(1, 1)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	c.download = func(r store.Release) (string, error) {
+		<-unblock
+		return r.Chart + ".tgz", nil
+	}
+
+	applyAsync(t, c, "queued0")
+	// The worker may not have taken the first job yet, so fill the queue
+	for _, r := range releases[1:] {
+		body, _ := json.Marshal(applyRequest{UUID: r.UniqueID, Async: true})
+		w := httptest.NewRecorder()
+		c.ApplyChart(w, httptest.NewRequest(http.MethodPost, "/apply", bytes.NewReader(body)))
+		if w.Code == http.StatusServiceUnavailable {
+			// A job that wasn't queued doesn't keep its release locked
+			lease, err := c.releaseStore.Lock(context.Background(), r.UniqueID, "test", time.Minute)
+			if err != nil {
+				t.Errorf("Expected a job that wasn't queued to release its lease, got %s", err)
+			} else {
+				c.releaseStore.Unlock(context.Background(), *lease)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected a full queue to return 503")
+}
+
+func TestAsyncApplyLocked(t *testing.T) {
+	c := newTestController(t, jobReleases, deploy.NewFake())
+	started := make(chan struct{}, len(jobReleases))
+	unblock := make(chan struct{})
+	c.download = func(r store.Release) (string, error) {
+		started <- struct{}{}
+		<-unblock
+		return r.Chart + ".tgz", nil
+	}
+
+	id := applyAsync(t, c, "prom")
+	// The job holds its leases once it has started
+	<-started
+	for _, uuid := range []string{"prom", "am"} {
+		body, _ := json.Marshal(applyRequest{UUID: uuid, Async: true})
+		w := httptest.NewRecorder()
+		c.ApplyChart(w, httptest.NewRequest(http.MethodPost, "/apply", bytes.NewReader(body)))
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected applying %s while it is being applied to return 409, got %d", uuid, w.Code)
+		}
+	}
+
+	close(unblock)
+	waitForJob(t, c, id)
+	applyAsync(t, c, "am")
+}
+
+func TestAsyncApplyLocksWhenStarted(t *testing.T) {
+	releases := store.Releases{
+		{UniqueID: "first", Name: "first", Chart: "stable/first"},
+		{UniqueID: "second", Name: "second", Chart: "stable/second"},
+	}
+	c := newTestController(t, releases, deploy.NewFake())
+	c.jobs = newJobQueue(1, 10)
+	started := make(chan string, len(releases))
+	unblock := make(chan struct{})
+	c.download = func(r store.Release) (string, error) {
+		started <- r.UniqueID
+		<-unblock
+		return r.Chart + ".tgz", nil
+	}
+
+	first := applyAsync(t, c, "first")
+	<-started
+	second := applyAsync(t, c, "second")
+
+	// The second job is waiting for the only worker, and holds no lease yet
+	lease, err := c.releaseStore.Lock(context.Background(), "second", "test", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected a queued job not to hold a lease, got %s", err)
+	}
+	c.releaseStore.Unlock(context.Background(), *lease)
+
+	close(unblock)
+	for _, id := range []string{first, second} {
+		if j := waitForJob(t, c, id); j.Status != jobSucceeded {
+			t.Errorf("Expected job %s to succeed, got %v", id, j)
+		}
+	}
+}
+
+func TestJobQueueWorkers(t *testing.T) {
+	for _, workers := range []int{-1, 0, 1} {
+		if q := newJobQueue(workers, 10); q.workers != 1 {
+			t.Errorf("Expected %d workers to run jobs on 1 worker, got %d", workers, q.workers)
+		}
+	}
+}
+
+func TestAsyncApplyDeadline(t *testing.T) {
+	releases := store.Releases{{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Values: "password: ref+deadline://password\n"}}
+	c := newTestController(t, releases, deploy.NewFake())
+	deadlines := make(chan time.Time, 1)
+	c.resolver = refs.NewRegistry()
+	c.resolver.Register("deadline", refs.ResolverFunc(func(ctx context.Context, ref refs.Ref) (string, error) {
+		deadline, _ := ctx.Deadline()
+		deadlines <- deadline
+		return "secret", nil
+	}))
+
+	waitForJob(t, c, applyAsync(t, c, "prom"))
+	deadline := <-deadlines
+	if want := time.Now().Add(c.applyTimeout(releases)); deadline.IsZero() || deadline.After(want) {
+		t.Errorf("Expected the job to have a deadline of at most %s, got %s", want, deadline)
+	}
+}
+
+func TestJobsOtherReplica(t *testing.T) {
+	c := newTestController(t, jobReleases, deploy.NewFake())
+	c.jobs.replica = "replica-1"
+
+	id := applyAsync(t, c, "am")
+	if replicaOf(id) != "replica-1" {
+		t.Errorf("Expected the job ID to name its replica, got %s", id)
+	}
+	waitForJob(t, c, id)
+
+	other := strings.TrimSuffix(id, "replica-1") + "replica-2.example.com"
+	for _, path := range []string{"/jobs/" + other, "/jobs/" + other + "/events"} {
+		if w := getJob(c, path, nil); w.Code != statusMisdirectedRequest || !strings.Contains(w.Body.String(), "replica-2.example.com") {
+			t.Errorf("Expected %s to be misdirected, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	releases := store.Releases{
+		{UniqueID: "first", Name: "first", Chart: "stable/first"},
+		{UniqueID: "second", Name: "second", Chart: "stable/second"},
+	}
+	d := deploy.NewFake()
+	c := newTestController(t, releases, d)
+	c.jobs = newJobQueue(1, 10)
+	started := make(chan struct{}, len(releases))
+	unblock := make(chan struct{})
+	c.download = func(r store.Release) (string, error) {
+		started <- struct{}{}
+		<-unblock
+		return r.Chart + ".tgz", nil
+	}
+
+	first := applyAsync(t, c, "first")
+	<-started
+	second := applyAsync(t, c, "second")
+
+	shutdown := make(chan error)
+	go func() { shutdown <- c.Shutdown(context.Background()) }()
+	for closed := false; !closed; {
+		c.jobs.mu.Lock()
+		closed = c.jobs.closed
+		c.jobs.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected shutdown to wait for the running job, got %v", err)
+	default:
+	}
+
+	close(unblock)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected the running job to finish, got %s", err)
+	}
+	if j := waitForJob(t, c, first); j.Status != jobSucceeded {
+		t.Errorf("Expected the running job to succeed, got %v", j)
+	}
+	if j := waitForJob(t, c, second); j.Status != jobFailed || !strings.Contains(j.Message, "shut down") {
+		t.Errorf("Expected the queued job to fail, got %v", j)
+	}
+	if calls := d.Calls(); len(calls) != 1 {
+		t.Errorf("Expected only the running job to install its release, got %v", calls)
+	}
+
+	body, _ := json.Marshal(applyRequest{UUID: "first", Async: true})
+	w := httptest.NewRecorder()
+	c.ApplyChart(w, httptest.NewRequest(http.MethodPost, "/apply", bytes.NewReader(body)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected an async apply after shutdown to return 503, got %d", w.Code)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	c := newTestController(t, jobReleases, deploy.NewFake())
+	started := make(chan struct{}, len(jobReleases))
+	unblock := make(chan struct{})
+	defer close(unblock)
+	c.download = func(r store.Release) (string, error) {
+		started <- struct{}{}
+		<-unblock
+		return r.Chart + ".tgz", nil
+	}
+
+	applyAsync(t, c, "am")
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Shutdown(ctx); err != context.Canceled {
+		t.Errorf("Expected the shutdown to time out, got %v", err)
+	}
+	if c.jobs.ctx.Err() == nil {
+		t.Errorf("Expected running jobs to be canceled")
+	}
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/spec"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// maxReleaseBody is the largest request body accepted for a release
+const maxReleaseBody = 1 << 20
+
+// releasePatch holds the fields of a release to change. Fields that are nil
+// are left as they are.
+type releasePatch struct {
+	Name         *string             `json:"name"`
+	Namespace    *string             `json:"namespace"`
+	Chart        *string             `json:"chart"`
+	Version      *string             `json:"version"`
+	Values       *string             `json:"values"`
+	Labels       *map[string]string  `json:"labels"`
+	Dependencies *[]store.Dependency `json:"dependencies"`
+	// Set sets values like "--set" on the command line, after Values
+	Set []string `json:"set"`
+	// Revision, if set, must match the stored release's Revision
+	Revision int64 `json:"revision"`
+}
+
+// apply applies the patch to a release
+func (p releasePatch) apply(r *store.Release) error {
+	if p.Name != nil {
+		r.Name = *p.Name
+	}
+	if p.Namespace != nil {
+		r.Namespace = *p.Namespace
+	}
+	if p.Chart != nil {
+		r.Chart = *p.Chart
+	}
+	if p.Version != nil {
+		r.Version = *p.Version
+	}
+	if p.Values != nil {
+		r.Values = *p.Values
+	}
+	if p.Labels != nil {
+		r.Labels = *p.Labels
+	}
+	if p.Dependencies != nil {
+		r.Dependencies = *p.Dependencies
+	}
+	if len(p.Set) > 0 {
+		if err := r.MergeValues(p.Set); err != nil {
+			return store.NewError("patch", r.UniqueID, store.ErrInvalidRelease, err)
+		}
+	}
+	if p.Revision > 0 {
+		r.Revision = p.Revision
+	}
+	return nil
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		zap.L().Error("Error marshaling response", zap.Error(err))
+	}
+}
+
+// writeError writes a JSON error response, with the status for a release
+// store error
+func writeError(w http.ResponseWriter, err error, message string) {
+	status := statusForError(err)
+	if status == http.StatusInternalServerError {
+		zap.L().Error(message, zap.Error(err))
+	} else {
+		message = fmt.Sprintf("%s: %s", message, err)
+	}
+	writeJSON(w, status, applyResponse{Status: "error", Message: message})
+}
+
+// decodeRelease decodes a request body into v
+func decodeRelease(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReleaseBody)).Decode(v); err != nil {
+		return store.NewError("decode", "", store.ErrInvalidRelease, err)
+	}
+	return nil
+}
+
+// Releases serves the releases in the store:
+//
+//	GET    /releases?label=k=v,...&name=n  lists releases
+//	POST   /releases                       creates a release
+//	GET    /releases/{uuid}                gets a release
+//	PUT    /releases/{uuid}                replaces a release
+//	PATCH  /releases/{uuid}                changes some fields of a release
+//	DELETE /releases/{uuid}                deletes a release
+//
+// Writes fail with 409 if the request has a revision that isn't the stored
+// release's. With a policy, releases the user may not read are left out of
+// lists, and are not found by other requests, the same as releases that don't
+// exist. Writes fail with 403 unless the user may write the release both
+// before and after it is written. Errors are returned as
+// JSON, like /apply.
+func (c ApiController) Releases(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/releases"), "/")
+	if strings.Contains(id, "/") {
+		writeJSON(w, http.StatusNotFound, applyResponse{Status: "error", Message: "Not found"})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if len(id) == 0 {
+			c.listReleases(w, r)
+		} else {
+			c.getRelease(w, r, id)
+		}
+		return
+	}
+
+	// Fields for the audit log
+	var auditFields []zapcore.Field
+	for _, a := range c.authorizers {
+		auditFields = append(auditFields, a.LoggingClosure(r)...)
+	}
+	auditFields = append(auditFields,
+		zap.String("controller", "releases"),
+		zap.String("method", r.Method),
+	)
+	acc := c.access(r, policy.Write)
+
+	var (
+		release *store.Release
+		err     error
+	)
+	switch {
+	case r.Method == http.MethodPost && len(id) == 0:
+		release, err = c.createRelease(w, r, acc)
+	case r.Method == http.MethodPut && len(id) > 0:
+		release, err = c.replaceRelease(w, r, acc, id)
+	case r.Method == http.MethodPatch && len(id) > 0:
+		release, err = c.patchRelease(w, r, acc, id)
+	case r.Method == http.MethodDelete && len(id) > 0:
+		release, err = c.deleteRelease(w, r, acc, id)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, PATCH, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, applyResponse{Status: "error", Message: "Method not allowed"})
+		return
+	}
+
+	if release != nil {
+		auditFields = append(auditFields,
+			zap.String("uuid", release.UniqueID),
+			zap.String("release", release.Name),
+			zap.Int64("revision", release.Revision),
+		)
+	} else {
+		auditFields = append(auditFields, zap.String("uuid", id))
+	}
+	auditFields = append(auditFields, acc.auditFields()...)
+	auditFields = append(auditFields, zap.Bool("successful", err == nil))
+	zap.L().Info("Audit Log", auditFields...)
+}
+
+func (c ApiController) listReleases(w http.ResponseWriter, r *http.Request) {
+	selector := spec.SelectorSet{}
+	for _, label := range r.URL.Query()["label"] {
+		if err := selector.Set(label); err != nil {
+			writeJSON(w, http.StatusBadRequest, applyResponse{Status: "error", Message: fmt.Sprintf("Invalid label %q", label)})
+			return
+		}
+	}
+
+	releases, err := c.releaseStore.List(r.Context(), selector.ToMap())
+	if err != nil {
+		writeError(w, err, "Error listing releases")
+		return
+	}
+	// Releases the user may not read are left out
+	acc := c.access(r, policy.Read)
+	name := r.URL.Query().Get("name")
+	matching := store.Releases{}
+	for _, release := range releases {
+		if (len(name) == 0 || release.Name == name) && acc.allowed(release) {
+			matching = append(matching, release)
+		}
+	}
+	c.auditRead(r, "releases", "", acc, true)
+	writeJSON(w, http.StatusOK, matching)
+}
+
+func (c ApiController) getRelease(w http.ResponseWriter, r *http.Request, id string) {
+	acc := c.access(r, policy.Read)
+	release, err := c.readableRelease(w, r, acc, id)
+	c.auditRead(r, "releases", id, acc, err == nil)
+	if err != nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, release)
+}
+
+// writeReleaseNotFound writes the response for a release that doesn't exist,
+// or that the user may not read
+func writeReleaseNotFound(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotFound, applyResponse{Status: "error", Message: "Release not found"})
+}
+
+// readableRelease gets a stored release that read allows. Releases that don't
+// exist and releases the user may not read get the same 404, so that the
+// response doesn't reveal which releases exist.
+func (c ApiController) readableRelease(w http.ResponseWriter, r *http.Request, read *access, id string) (*store.Release, error) {
+	release, err := c.releaseStore.Get(r.Context(), id)
+	switch {
+	case store.IsNotFound(err):
+		writeReleaseNotFound(w)
+		return nil, err
+	case err != nil:
+		writeError(w, err, "Error getting release")
+		return nil, err
+	case !read.allowed(*release):
+		writeReleaseNotFound(w)
+		return nil, errForbidden
+	}
+	return release, nil
+}
+
+// putRelease writes a release that must still have its Revision in the
+// store, and responds with the stored release
+func (c ApiController) putRelease(w http.ResponseWriter, r *http.Request, release store.Release, status int) (*store.Release, error) {
+	if err := c.releaseStore.ConditionalPut(r.Context(), release); err != nil {
+		writeError(w, err, "Error storing release")
+		return &release, err
+	}
+	stored, err := c.releaseStore.Get(r.Context(), release.UniqueID)
+	if err != nil {
+		writeError(w, err, "Error getting stored release")
+		return &release, err
+	}
+	writeJSON(w, status, stored)
+	return stored, nil
+}
+
+func (c ApiController) createRelease(w http.ResponseWriter, r *http.Request, acc *access) (*store.Release, error) {
+	release := store.Release{}
+	if err := decodeRelease(w, r, &release); err != nil {
+		writeError(w, err, "Error decoding release")
+		return nil, err
+	}
+	if len(release.UniqueID) == 0 {
+		release.UniqueID = uuid.New().String()
+	}
+	if len(release.Chart) == 0 {
+		err := store.NewError("create", release.UniqueID, store.ErrInvalidRelease, errors.New("missing chart"))
+		writeError(w, err, "Error creating release")
+		return &release, err
+	}
+	if !acc.allowed(release) {
+		writeForbidden(w, acc)
+		return &release, errForbidden
+	}
+	// A Revision of 0 makes the write fail if the release already exists
+	release.Revision = 0
+	return c.putRelease(w, r, release, http.StatusCreated)
+}
+
+func (c ApiController) replaceRelease(w http.ResponseWriter, r *http.Request, acc *access, id string) (*store.Release, error) {
+	release := store.Release{}
+	if err := decodeRelease(w, r, &release); err != nil {
+		writeError(w, err, "Error decoding release")
+		return nil, err
+	}
+	release.UniqueID = id
+
+	// The user must be allowed to write the release both before and after
+	// it is replaced
+	current, err := c.releaseStore.Get(r.Context(), id)
+	switch {
+	case err == nil && !c.access(r, policy.Read).allowed(*current):
+		writeReleaseNotFound(w)
+		return &release, errForbidden
+	case err == nil:
+		if !acc.allowed(*current) {
+			writeForbidden(w, acc)
+			return &release, errForbidden
+		}
+		if release.Revision == 0 {
+			release.Revision = current.Revision
+		}
+	case store.IsNotFound(err) && release.Revision == 0:
+		writeReleaseNotFound(w)
+		return &release, err
+	case !store.IsNotFound(err):
+		writeError(w, err, "Error getting release")
+		return &release, err
+	}
+	if !acc.allowed(release) {
+		writeForbidden(w, acc)
+		return &release, errForbidden
+	}
+	return c.putRelease(w, r, release, http.StatusOK)
+}
+
+func (c ApiController) patchRelease(w http.ResponseWriter, r *http.Request, acc *access, id string) (*store.Release, error) {
+	patch := releasePatch{}
+	if err := decodeRelease(w, r, &patch); err != nil {
+		writeError(w, err, "Error decoding patch")
+		return nil, err
+	}
+
+	release, err := c.readableRelease(w, r, c.access(r, policy.Read), id)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.allowed(*release) {
+		writeForbidden(w, acc)
+		return release, errForbidden
+	}
+	if err := patch.apply(release); err != nil {
+		writeError(w, err, "Error patching release")
+		return release, err
+	}
+	if !acc.allowed(*release) {
+		writeForbidden(w, acc)
+		return release, errForbidden
+	}
+	return c.putRelease(w, r, *release, http.StatusOK)
+}
+
+func (c ApiController) deleteRelease(w http.ResponseWriter, r *http.Request, acc *access, id string) (*store.Release, error) {
+	release, err := c.readableRelease(w, r, c.access(r, policy.Read), id)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.allowed(*release) {
+		writeForbidden(w, acc)
+		return release, errForbidden
+	}
+	if err := c.releaseStore.Delete(r.Context(), id); err != nil {
+		writeError(w, err, "Error deleting release")
+		return release, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return release, nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/store"
+)
+
+var restReleases = store.Releases{
+	{UniqueID: "prom", Name: "prometheus", Chart: "stable/prometheus", Labels: map[string]string{"environment": "prod"}, Values: "replicas: 1\n"},
+	{UniqueID: "prom-test", Name: "prometheus", Chart: "stable/prometheus", Labels: map[string]string{"environment": "test"}},
+	{UniqueID: "am", Name: "alertmanager", Chart: "stable/alertmanager", Labels: map[string]string{"environment": "prod"}},
+}
+
+func request(c *ApiController, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.Releases(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+	return w
+}
+
+func TestListReleases(t *testing.T) {
+	c := newTestController(t, restReleases, deploy.NewFake())
+
+	cases := []struct {
+		name    string
+		path    string
+		wantIDs []string
+	}{
+		{"all", "/releases", []string{"am", "prom", "prom-test"}},
+		{"label", "/releases?label=environment=prod", []string{"am", "prom"}},
+		{"name", "/releases?name=prometheus", []string{"prom", "prom-test"}},
+		{"label and name", "/releases?label=environment=test&name=prometheus", []string{"prom-test"}},
+		{"no match", "/releases?label=environment=dev", []string{}},
+	}
+
+	for _, tc := range cases {
+		w := request(c, http.MethodGet, tc.path, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("Test '%s': Expected status 200, got %d", tc.name, w.Code)
+			continue
+		}
+		releases := store.Releases{}
+		if err := json.NewDecoder(w.Body).Decode(&releases); err != nil {
+			t.Errorf("Test '%s': Error decoding response: %s", tc.name, err)
+			continue
+		}
+		ids := []string{}
+		for _, r := range releases {
+			ids = append(ids, r.UniqueID)
+		}
+		if !reflect.DeepEqual(ids, tc.wantIDs) {
+			t.Errorf("Test '%s': Expected releases %v, got %v", tc.name, tc.wantIDs, ids)
+		}
+	}
+}
+
+func TestReleaseCRUD(t *testing.T) {
+	c := newTestController(t, restReleases, deploy.NewFake())
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		// wantValues, if set, are the values the stored release must have
+		wantValues string
+	}{
+		{"get", http.MethodGet, "/releases/prom", "", http.StatusOK, "replicas: 1\n"},
+		{"get missing", http.MethodGet, "/releases/missing", "", http.StatusNotFound, ""},
+		{"create", http.MethodPost, "/releases", `{"unique_id": "grafana", "name": "grafana", "chart": "stable/grafana", "values": "a: 1\n"}`, http.StatusCreated, ""},
+		{"create existing", http.MethodPost, "/releases", `{"unique_id": "prom", "name": "prometheus", "chart": "stable/prometheus"}`, http.StatusConflict, ""},
+		{"create without chart", http.MethodPost, "/releases", `{"name": "grafana"}`, http.StatusBadRequest, ""},
+		{"create bad json", http.MethodPost, "/releases", `{"name": `, http.StatusBadRequest, ""},
+		{"replace", http.MethodPut, "/releases/prom", `{"name": "prometheus", "chart": "stable/prometheus", "values": "replicas: 2\n"}`, http.StatusOK, "replicas: 2\n"},
+		{"replace stale", http.MethodPut, "/releases/prom", `{"name": "prometheus", "chart": "stable/prometheus", "revision": 1}`, http.StatusConflict, ""},
+		{"replace missing", http.MethodPut, "/releases/missing", `{"name": "missing", "chart": "stable/missing"}`, http.StatusNotFound, ""},
+		{"patch", http.MethodPatch, "/releases/prom", `{"version": "5.0.0", "set": ["replicas=3"]}`, http.StatusOK, "replicas: 3\n"},
+		{"patch stale", http.MethodPatch, "/releases/prom", `{"version": "5.0.1", "revision": 2}`, http.StatusConflict, ""},
+		{"patch bad set", http.MethodPatch, "/releases/prom", `{"set": ["replicas"]}`, http.StatusBadRequest, ""},
+		{"delete", http.MethodDelete, "/releases/am", "", http.StatusNoContent, ""},
+		{"delete missing", http.MethodDelete, "/releases/am", "", http.StatusNotFound, ""},
+		{"method not allowed", http.MethodDelete, "/releases", "", http.StatusMethodNotAllowed, ""},
+		{"nested path", http.MethodGet, "/releases/prom/history", "", http.StatusNotFound, ""},
+	}
+
+	for _, tc := range cases {
+		w := request(c, tc.method, tc.path, tc.body)
+		if w.Code != tc.wantStatus {
+			t.Errorf("Test '%s': Expected status %d, got %d: %s", tc.name, tc.wantStatus, w.Code, w.Body.String())
+			continue
+		}
+		if w.Code >= 400 {
+			resp := applyResponse{}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Status != "error" || len(resp.Message) == 0 {
+				t.Errorf("Test '%s': Expected a JSON error, got %v, %v", tc.name, resp, err)
+			}
+			continue
+		}
+		if len(tc.wantValues) > 0 {
+			release := store.Release{}
+			json.NewDecoder(w.Body).Decode(&release)
+			if release.Values != tc.wantValues {
+				t.Errorf("Test '%s': Expected values %q, got %q", tc.name, tc.wantValues, release.Values)
+			}
+		}
+	}
+
+	stored, err := c.releaseStore.Get(context.Background(), "prom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != "5.0.0" || stored.Values != "replicas: 3\n" || stored.Revision != 3 {
+		t.Errorf("Expected the replaced and patched release at revision 3, got %v", stored)
+	}
+	if _, err := c.releaseStore.Get(context.Background(), "grafana"); err != nil {
+		t.Errorf("Expected the created release to be stored, got %v", err)
+	}
+	if _, err := c.releaseStore.Get(context.Background(), "am"); !store.IsNotFound(err) {
+		t.Errorf("Expected the deleted release to be gone, got %v", err)
+	}
+}
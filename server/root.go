@@ -1,15 +1,35 @@
 package server
 
 import (
+	"context"
+	"net/http"
+	"os"
+
 	"github.com/skuid/go-middlewares"
+	"github.com/skuid/helm-value-store/deploy"
+	"github.com/skuid/helm-value-store/policy"
+	"github.com/skuid/helm-value-store/refs"
 	"github.com/skuid/helm-value-store/store"
+	"github.com/skuid/spec/middlewares"
 )
 
 // ApiController stores metadata for the API
 type ApiController struct {
 	releaseStore store.ReleaseStore
 	authorizers  []go_middlewares.Authorizer
+	resolver     *refs.Registry
+	deployer     deploy.Deployer
 	timeout      int64
+	jobs         *jobQueue
+	// policy decides what each user may do. Everything is allowed if it is
+	// nil.
+	policy *policy.Policy
+	// lockOwner is who the leases taken on releases being applied are held
+	// by
+	lockOwner string
+
+	// download fetches a release's chart, and returns its location
+	download func(store.Release) (string, error)
 }
 
 // ControllerOpt is a func that modifies an ApiController
@@ -29,15 +49,83 @@ func WithTimeout(timeout int64) ControllerOpt {
 	}
 }
 
-// NewApiController returns a new API controller with a default timeout of 300 seconds
+// WithResolver sets the registry used to resolve secret references in
+// release values on an ApiController
+func WithResolver(reg *refs.Registry) ControllerOpt {
+	return func(a *ApiController) {
+		a.resolver = reg
+	}
+}
+
+// WithDeployer sets the Deployer releases are installed with on an
+// ApiController
+func WithDeployer(d deploy.Deployer) ControllerOpt {
+	return func(a *ApiController) {
+		a.deployer = d
+	}
+}
+
+// WithPolicy sets the policy deciding which releases each user may read,
+// write and apply on an ApiController
+func WithPolicy(p *policy.Policy) ControllerOpt {
+	return func(a *ApiController) {
+		a.policy = p
+	}
+}
+
+// WithJobs sets the number of workers applying releases in the background,
+// and the number of jobs whose status is kept, on an ApiController. There is
+// always at least one worker.
+func WithJobs(workers, maxJobs int) ControllerOpt {
+	return func(a *ApiController) {
+		a.jobs = newJobQueue(workers, maxJobs)
+	}
+}
+
+// ServerSchemes are the reference schemes a server resolves by default, which
+// is none. Anyone who can write a release could otherwise read the server's
+// files and environment, or any Vault secret the server's token can read, by
+// applying it.
+var ServerSchemes = []string{}
+
+// NewApiController returns a new API controller with a default timeout of 300
+// seconds, that resolves references with the ServerSchemes of
+// refs.DefaultRegistry(), installs releases with the Tiller at $TILLER_HOST,
+// and runs background jobs on 4 workers, keeping the last 1000
 func NewApiController(s store.ReleaseStore, opts ...ControllerOpt) *ApiController {
 	response := &ApiController{
 		releaseStore: s,
+		resolver:     refs.DefaultRegistry().Restrict(ServerSchemes...),
 		timeout:      300,
+		download:     store.Release.Download,
+		jobs:         newJobQueue(4, 1000),
+		lockOwner:    store.LockOwner(),
 	}
 	for _, opt := range opts {
 		opt(response)
 	}
+	if response.deployer == nil {
+		response.deployer = deploy.NewTillerHost(os.Getenv("TILLER_HOST"))
+	}
 
 	return response
 }
+
+// Shutdown stops accepting async applies, fails the queued jobs that haven't
+// started, and waits for the running jobs to finish. If ctx is done first, the
+// running jobs are canceled and ctx's error is returned.
+func (a *ApiController) Shutdown(ctx context.Context) error {
+	return a.jobs.shutdown(ctx)
+}
+
+// Handler returns the API's routes wrapped in mws, the first innermost, as
+// with middlewares.Apply. Job events can still be streamed when the writers of
+// mws don't implement http.Flusher.
+func (a *ApiController) Handler(mws ...middlewares.Middleware) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apply", a.ApplyChart)
+	mux.HandleFunc("/releases", a.Releases)
+	mux.HandleFunc("/releases/", a.Releases)
+	mux.HandleFunc("/jobs/", a.Jobs)
+	return flushing(middlewares.Apply(mux, mws...))
+}
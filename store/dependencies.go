@@ -0,0 +1,257 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Dependency is a release that must be installed before the release that
+// declares it. It refers to a release either by UniqueID, or by Name and an
+// optional label Selector.
+type Dependency struct {
+	UniqueID string            `json:"unique_id,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+func (d Dependency) String() string {
+	if len(d.UniqueID) > 0 {
+		return d.UniqueID
+	}
+	if len(d.Selector) > 0 {
+		return fmt.Sprintf("%s %v", d.Name, d.Selector)
+	}
+	return d.Name
+}
+
+// ParseDependency parses a dependency of the form "uuid=<id>" or
+// "name=<name>[,<label>=<value>...]"
+func ParseDependency(s string) (Dependency, error) {
+	d := Dependency{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return d, fmt.Errorf("Invalid dependency %q, must be uuid=<id> or name=<name>[,<label>=<value>...]", s)
+		}
+		switch kv[0] {
+		case "uuid":
+			d.UniqueID = kv[1]
+		case "name":
+			d.Name = kv[1]
+		default:
+			if d.Selector == nil {
+				d.Selector = map[string]string{}
+			}
+			d.Selector[kv[0]] = kv[1]
+		}
+	}
+	if len(d.UniqueID) > 0 && (len(d.Name) > 0 || len(d.Selector) > 0) {
+		return d, fmt.Errorf("Invalid dependency %q, a uuid can't be combined with a name or labels", s)
+	}
+	if len(d.UniqueID) == 0 && len(d.Name) == 0 {
+		return d, fmt.Errorf("Invalid dependency %q, must have a uuid or a name", s)
+	}
+	return d, nil
+}
+
+// ParseDependencies parses each of deps with ParseDependency
+func ParseDependencies(deps []string) ([]Dependency, error) {
+	response := []Dependency{}
+	for _, s := range deps {
+		d, err := ParseDependency(s)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, d)
+	}
+	return response, nil
+}
+
+// Matches reports whether r is the release d refers to
+func (d Dependency) Matches(r Release) bool {
+	if len(d.UniqueID) > 0 {
+		return d.UniqueID == r.UniqueID
+	}
+	return d.Name == r.Name && r.MatchesSelector(d.Selector)
+}
+
+// ScopeLabels are the labels that a dependency by name without a selector
+// is scoped to. Such a dependency refers to the release of that name with the
+// same values of these labels as the dependent release, so that it is the
+// release in the same environment, region or cluster rather than in all of
+// them. The dependent release's other labels, like its app, aren't required.
+var ScopeLabels = []string{"environment", "env", "region", "cluster"}
+
+// dependencies returns r's dependencies, with those by name and without a
+// selector scoped to r's ScopeLabels
+func (r Release) dependencies() []Dependency {
+	response := []Dependency{}
+	for _, d := range r.Dependencies {
+		if len(d.UniqueID) == 0 && len(d.Selector) == 0 {
+			for _, k := range ScopeLabels {
+				if v, ok := r.Labels[k]; ok {
+					if d.Selector == nil {
+						d.Selector = map[string]string{}
+					}
+					d.Selector[k] = v
+				}
+			}
+		}
+		response = append(response, d)
+	}
+	return response
+}
+
+// DependsOn reports whether r declares a dependency on upstream. A dependency
+// by name without a selector is scoped to r's ScopeLabels.
+func (r Release) DependsOn(upstream Release) bool {
+	if r.UniqueID == upstream.UniqueID {
+		return false
+	}
+	for _, d := range r.dependencies() {
+		if d.Matches(upstream) {
+			return true
+		}
+	}
+	return false
+}
+
+// A MissingDependencyError is returned when dependencies match no release
+type MissingDependencyError struct {
+	// Missing are the dependencies that match no release, by the name of the
+	// release that declares them
+	Missing map[string][]Dependency
+}
+
+func (e *MissingDependencyError) Error() string {
+	names := []string{}
+	for name := range e.Missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	missing := []string{}
+	for _, name := range names {
+		for _, d := range e.Missing[name] {
+			missing = append(missing, fmt.Sprintf("%s (of %s)", d, name))
+		}
+	}
+	return fmt.Sprintf("No release matches the dependencies %s", strings.Join(missing, ", "))
+}
+
+// CheckDependencies returns a *MissingDependencyError if any dependency of
+// releases matches no release in all
+func CheckDependencies(all, releases Releases) error {
+	missing := map[string][]Dependency{}
+	for _, r := range releases {
+		for _, d := range r.dependencies() {
+			found := false
+			for _, candidate := range all {
+				if candidate.UniqueID != r.UniqueID && d.Matches(candidate) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing[r.Name] = append(missing[r.Name], d)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingDependencyError{Missing: missing}
+	}
+	return nil
+}
+
+// A CycleError is returned when releases depend on each other in a cycle
+type CycleError struct {
+	// Releases are the releases that could not be ordered, which includes
+	// every release in a cycle
+	Releases Releases
+}
+
+func (e *CycleError) Error() string {
+	names := []string{}
+	for _, r := range e.Releases {
+		names = append(names, fmt.Sprintf("%s (%s)", r.Name, r.UniqueID))
+	}
+	return fmt.Sprintf("Dependency cycle between releases %s", strings.Join(names, ", "))
+}
+
+// Upstream returns every release in releases that r depends on, directly or
+// indirectly, in the same order as releases
+func Upstream(releases Releases, r Release) Releases {
+	seen := map[string]bool{r.UniqueID: true}
+	queue := Releases{r}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, candidate := range releases {
+			if !seen[candidate.UniqueID] && next.DependsOn(candidate) {
+				seen[candidate.UniqueID] = true
+				queue = append(queue, candidate)
+			}
+		}
+	}
+
+	response := Releases{}
+	for _, candidate := range releases {
+		if candidate.UniqueID != r.UniqueID && seen[candidate.UniqueID] {
+			response = append(response, candidate)
+		}
+	}
+	return response
+}
+
+// Levels orders releases by their dependencies. Releases in each level only
+// depend on releases in earlier levels, so the releases within a level can be
+// installed in parallel once every earlier level is installed. Dependencies
+// on releases that aren't in releases are ignored. Within a level, releases
+// keep the order they had in releases. If releases depend on each other in a
+// cycle, a *CycleError is returned.
+func Levels(releases Releases) ([]Releases, error) {
+	// upstream[i] counts the releases that release i is still waiting on
+	upstream := make([]int, len(releases))
+	downstream := make([][]int, len(releases))
+	for i, r := range releases {
+		for j, candidate := range releases {
+			if r.DependsOn(candidate) {
+				upstream[i]++
+				downstream[j] = append(downstream[j], i)
+			}
+		}
+	}
+
+	levels := []Releases{}
+	done := make([]bool, len(releases))
+	remaining := len(releases)
+	for remaining > 0 {
+		ready := []int{}
+		for i := range releases {
+			if !done[i] && upstream[i] == 0 {
+				ready = append(ready, i)
+			}
+		}
+		if len(ready) == 0 {
+			cycle := Releases{}
+			for i, r := range releases {
+				if !done[i] {
+					cycle = append(cycle, r)
+				}
+			}
+			return nil, &CycleError{Releases: cycle}
+		}
+
+		level := Releases{}
+		for _, i := range ready {
+			done[i] = true
+			remaining--
+			level = append(level, releases[i])
+			for _, j := range downstream[i] {
+				upstream[j]--
+			}
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func dependent(uniqueID, name string, labels map[string]string, dependencies ...Dependency) Release {
+	return Release{UniqueID: uniqueID, Name: name, Labels: labels, Dependencies: dependencies}
+}
+
+func levelIDs(levels []Releases) [][]string {
+	ids := [][]string{}
+	for _, level := range levels {
+		levelIDs := []string{}
+		for _, r := range level {
+			levelIDs = append(levelIDs, r.UniqueID)
+		}
+		ids = append(ids, levelIDs)
+	}
+	return ids
+}
+
+func TestParseDependency(t *testing.T) {
+	cases := []struct {
+		s       string
+		want    Dependency
+		wantErr bool
+	}{
+		{"uuid=abc123", Dependency{UniqueID: "abc123"}, false},
+		{"name=alertmanager", Dependency{Name: "alertmanager"}, false},
+		{"name=alertmanager,region=us", Dependency{Name: "alertmanager", Selector: map[string]string{"region": "us"}}, false},
+		{"uuid=abc123,name=alertmanager", Dependency{}, true},
+		{"region=us", Dependency{}, true},
+		{"alertmanager", Dependency{}, true},
+	}
+
+	for _, c := range cases {
+		got, err := ParseDependency(c.s)
+		if (err != nil) != c.wantErr {
+			t.Errorf("Failed ParseDependency(%q): Expected error %t, got %v", c.s, c.wantErr, err)
+			continue
+		}
+		if !c.wantErr && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Failed ParseDependency(%q): Expected %#v, got %#v", c.s, c.want, got)
+		}
+	}
+}
+
+func TestDependencyMatches(t *testing.T) {
+	r := Release{UniqueID: "abc123", Name: "alertmanager", Labels: map[string]string{"region": "us"}}
+	cases := []struct {
+		dependency Dependency
+		want       bool
+	}{
+		{Dependency{UniqueID: "abc123"}, true},
+		{Dependency{UniqueID: "def456", Name: "alertmanager"}, false},
+		{Dependency{Name: "alertmanager"}, true},
+		{Dependency{Name: "alertmanager", Selector: map[string]string{"region": "us"}}, true},
+		{Dependency{Name: "alertmanager", Selector: map[string]string{"region": "eu"}}, false},
+		{Dependency{Name: "exporter"}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.dependency.Matches(r); got != c.want {
+			t.Errorf("Failed %v.Matches(): Expected %t, got %t", c.dependency, c.want, got)
+		}
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	prodUS := map[string]string{"environment": "prod", "region": "us"}
+	// Only the dependent release's scope labels are required, not its app
+	r := dependent("prom", "prometheus", map[string]string{"app": "prometheus", "environment": "prod", "region": "us"}, Dependency{Name: "alertmanager"}, Dependency{Name: "exporter", Selector: map[string]string{"region": "eu"}})
+	cases := []struct {
+		upstream Release
+		want     bool
+	}{
+		{dependent("am", "alertmanager", prodUS), true},
+		{dependent("am", "alertmanager", map[string]string{"environment": "prod", "region": "us", "team": "sre"}), true},
+		{dependent("am", "alertmanager", map[string]string{"environment": "prod", "region": "eu"}), false},
+		{dependent("am", "alertmanager", map[string]string{"environment": "test", "region": "us"}), false},
+		{dependent("am", "alertmanager", nil), false},
+		{dependent("exp", "exporter", map[string]string{"region": "eu"}), true},
+		{dependent("prom", "alertmanager", prodUS), false},
+	}
+
+	for _, c := range cases {
+		if got := r.DependsOn(c.upstream); got != c.want {
+			t.Errorf("Failed DependsOn(%s %v): Expected %t, got %t", c.upstream.Name, c.upstream.Labels, c.want, got)
+		}
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	prod := map[string]string{"app": "prometheus", "env": "prod"}
+	all := Releases{
+		dependent("am", "alertmanager", map[string]string{"app": "alertmanager", "env": "prod"}),
+		dependent("exp", "exporter", map[string]string{"env": "test"}),
+	}
+
+	cases := []struct {
+		name        string
+		release     Release
+		wantMissing []string
+	}{
+		{"by name in the same environment", dependent("prom", "prometheus", prod, Dependency{Name: "alertmanager"}), nil},
+		{"by uuid", dependent("prom", "prometheus", prod, Dependency{UniqueID: "exp"}), nil},
+		{"by name with a selector", dependent("prom", "prometheus", prod, Dependency{Name: "exporter", Selector: map[string]string{"env": "test"}}), nil},
+		{"in another environment", dependent("prom", "prometheus", prod, Dependency{Name: "exporter"}), []string{"exporter map[env:prod]"}},
+		{"missing uuid", dependent("prom", "prometheus", prod, Dependency{UniqueID: "missing"}, Dependency{Name: "alertmanager"}), []string{"missing"}},
+		{"itself", dependent("am", "alertmanager", prod, Dependency{UniqueID: "am"}), []string{"am"}},
+	}
+
+	for _, c := range cases {
+		err := CheckDependencies(all, Releases{c.release})
+		if c.wantMissing == nil {
+			if err != nil {
+				t.Errorf("Test '%s': Expected no error, got %s", c.name, err)
+			}
+			continue
+		}
+		missingErr, ok := err.(*MissingDependencyError)
+		if !ok {
+			t.Errorf("Test '%s': Expected a *MissingDependencyError, got %v", c.name, err)
+			continue
+		}
+		got := []string{}
+		for _, d := range missingErr.Missing[c.release.Name] {
+			got = append(got, d.String())
+		}
+		if !reflect.DeepEqual(got, c.wantMissing) {
+			t.Errorf("Test '%s': Expected missing %v, got %v", c.name, c.wantMissing, got)
+		}
+		if !strings.Contains(err.Error(), c.wantMissing[0]+" (of "+c.release.Name+")") {
+			t.Errorf("Test '%s': Expected the error to name the dependency, got %s", c.name, err)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	us := map[string]string{"region": "us"}
+	eu := map[string]string{"region": "eu"}
+
+	cases := []struct {
+		name      string
+		releases  Releases
+		want      [][]string
+		wantCycle []string
+	}{
+		{
+			"no dependencies",
+			Releases{dependent("a", "a", nil), dependent("b", "b", nil)},
+			[][]string{{"a", "b"}},
+			nil,
+		},
+		{
+			"prometheus after exporter and alertmanager",
+			Releases{
+				dependent("prom", "prometheus", us, Dependency{Name: "alertmanager", Selector: us}, Dependency{UniqueID: "exp"}),
+				dependent("am-us", "alertmanager", us),
+				dependent("am-eu", "alertmanager", eu, Dependency{UniqueID: "exp"}),
+				dependent("exp", "exporter", us),
+			},
+			[][]string{{"am-us", "exp"}, {"prom", "am-eu"}},
+			nil,
+		},
+		{
+			"chain",
+			Releases{
+				dependent("c", "c", nil, Dependency{Name: "b"}),
+				dependent("b", "b", nil, Dependency{Name: "a"}),
+				dependent("a", "a", nil),
+			},
+			[][]string{{"a"}, {"b"}, {"c"}},
+			nil,
+		},
+		{
+			"missing dependencies are ignored",
+			Releases{dependent("a", "a", nil, Dependency{UniqueID: "elsewhere"})},
+			[][]string{{"a"}},
+			nil,
+		},
+		{
+			"self dependencies are ignored",
+			Releases{dependent("a", "a", nil, Dependency{Name: "a"})},
+			[][]string{{"a"}},
+			nil,
+		},
+		{
+			"cycle",
+			Releases{
+				dependent("a", "a", nil),
+				dependent("b", "b", nil, Dependency{Name: "c"}, Dependency{Name: "a"}),
+				dependent("c", "c", nil, Dependency{Name: "b"}),
+			},
+			nil,
+			[]string{"b", "c"},
+		},
+	}
+
+	for _, c := range cases {
+		levels, err := Levels(c.releases)
+		if c.wantCycle != nil {
+			cycleErr, ok := err.(*CycleError)
+			if !ok {
+				t.Errorf("Test '%s': Expected a *CycleError, got %v", c.name, err)
+				continue
+			}
+			if got := levelIDs([]Releases{cycleErr.Releases})[0]; !reflect.DeepEqual(got, c.wantCycle) {
+				t.Errorf("Test '%s': Expected cycle %v, got %v", c.name, c.wantCycle, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%s': unexpected error %s", c.name, err)
+			continue
+		}
+		if got := levelIDs(levels); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Test '%s': Expected levels %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	releases := Releases{
+		dependent("prom", "prometheus", nil, Dependency{Name: "alertmanager"}),
+		dependent("am", "alertmanager", nil, Dependency{UniqueID: "exp"}),
+		dependent("exp", "exporter", nil, Dependency{UniqueID: "prom"}),
+		dependent("other", "other", nil),
+	}
+
+	got := levelIDs([]Releases{Upstream(releases, releases[0])})[0]
+	if want := []string{"am", "exp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected upstream releases %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Backend-independent error kinds. ReleaseStore implementations map their SDK
+// errors onto one of these so callers can check for them with the Is*
+// functions regardless of the configured backend.
+var (
+	ErrNotFound         = errors.New("release not found")
+	ErrAlreadyExists    = errors.New("release already exists")
+	ErrConflict         = errors.New("release was modified concurrently")
+	ErrInvalidRelease   = errors.New("invalid release")
+	ErrUnavailable      = errors.New("release store unavailable")
+	ErrLocked           = errors.New("release is locked")
+	ErrPermissionDenied = errors.New("release store denied access")
+)
+
+// kinds are the Err* values in this package
+var kinds = []error{ErrNotFound, ErrAlreadyExists, ErrConflict, ErrInvalidRelease, ErrUnavailable, ErrLocked, ErrPermissionDenied}
+
+// An Error records a failed operation on a release
+type Error struct {
+	// Op is the operation that failed, such as "get" or "put"
+	Op string
+	// UniqueID is the release the operation was performed on, if any
+	UniqueID string
+	// Kind is one of the Err* values in this package
+	Kind error
+	// Err is the underlying error, if any
+	Err error
+}
+
+// NewError returns an *Error of the given kind
+func NewError(op, uniqueID string, kind, err error) error {
+	return &Error{Op: op, UniqueID: uniqueID, Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	msg := e.Op
+	if len(e.UniqueID) > 0 {
+		msg = fmt.Sprintf("%s %s", msg, e.UniqueID)
+	}
+	msg = fmt.Sprintf("%s: %s", msg, e.Kind)
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %s", msg, e.Err)
+	}
+	return msg
+}
+
+// Is reports whether target is the kind of e
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the Err* kind of err, or nil if err is nil or not a store
+// error. Errors that wrap a store error, with an Unwrap method, have the kind
+// of the error they wrap.
+func KindOf(err error) error {
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e.Kind
+		}
+		for _, kind := range kinds {
+			if err == kind {
+				return kind
+			}
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+	return nil
+}
+
+// IsNotFound reports whether err means the release does not exist
+func IsNotFound(err error) bool { return KindOf(err) == ErrNotFound }
+
+// IsAlreadyExists reports whether err means the release already exists
+func IsAlreadyExists(err error) bool { return KindOf(err) == ErrAlreadyExists }
+
+// IsConflict reports whether err means the release was changed by someone else
+func IsConflict(err error) bool { return KindOf(err) == ErrConflict }
+
+// IsInvalidRelease reports whether err means the release was rejected as invalid
+func IsInvalidRelease(err error) bool { return KindOf(err) == ErrInvalidRelease }
+
+// IsUnavailable reports whether err means the backend could not be reached
+func IsUnavailable(err error) bool { return KindOf(err) == ErrUnavailable }
+
+// IsPermissionDenied reports whether err means the backend rejected the store's
+// credentials
+func IsPermissionDenied(err error) bool { return KindOf(err) == ErrPermissionDenied }
+
+// IsLocked reports whether err means someone else holds the release's lease
+func IsLocked(err error) bool { return KindOf(err) == ErrLocked }
@@ -0,0 +1,51 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+)
+
+// wrapped wraps an error the way fmt.Errorf's %w verb does
+type wrapped struct{ err error }
+
+func (w wrapped) Error() string { return "wrapped: " + w.err.Error() }
+func (w wrapped) Unwrap() error { return w.err }
+
+func TestErrorKinds(t *testing.T) {
+	cause := errors.New("boom")
+	cases := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"nil", nil, nil},
+		{"plain error", cause, nil},
+		{"sentinel", store.ErrConflict, store.ErrConflict},
+		{"not found", store.NewError("get", "abc123", store.ErrNotFound, nil), store.ErrNotFound},
+		{"unavailable", store.NewError("list", "", store.ErrUnavailable, cause), store.ErrUnavailable},
+		{"locked", store.NewLockedError(store.Lease{UniqueID: "abc123", Owner: "replica-1"}), store.ErrLocked},
+		{"permission denied", store.NewError("put", "abc123", store.ErrPermissionDenied, cause), store.ErrPermissionDenied},
+		{"wrapped sentinel", wrapped{store.ErrNotFound}, store.ErrNotFound},
+		{"wrapped store error", wrapped{wrapped{store.NewError("put", "abc123", store.ErrConflict, nil)}}, store.ErrConflict},
+		{"wrapped plain error", wrapped{cause}, nil},
+	}
+
+	for _, c := range cases {
+		if got := store.KindOf(c.err); got != c.want {
+			t.Errorf("Test '%s': Expected kind %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	err := store.NewError("get", "abc123", store.ErrNotFound, cause)
+	if !store.IsNotFound(err) || store.IsConflict(err) {
+		t.Errorf("Expected %q to only be a not found error", err)
+	}
+	if want := "get abc123: release not found: boom"; err.Error() != want {
+		t.Errorf("Expected message %q, got %q", want, err.Error())
+	}
+	if !store.IsNotFound(wrapped{err}) {
+		t.Errorf("Expected a wrapped not found error to be not found")
+	}
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// A LoadResult is the outcome of writing one release during a bulk load
+type LoadResult struct {
+	Release Release
+	Err     error
+}
+
+// A LoadProgressFunc is called once for each release in a bulk load, as soon
+// as that release has been written or has failed
+type LoadProgressFunc func(LoadResult)
+
+// A ProgressLoader is a ReleaseStore that can report the outcome of each
+// release during a bulk load
+type ProgressLoader interface {
+	LoadWithProgress(ctx context.Context, releases Releases, progress LoadProgressFunc) error
+}
+
+// A LoadError is returned from a bulk load when some releases could not be
+// written. Releases not listed in Failed were written successfully.
+type LoadError struct {
+	Failed []LoadResult
+}
+
+func (e *LoadError) Error() string {
+	if len(e.Failed) == 1 {
+		return fmt.Sprintf("failed to load release %s: %s", e.Failed[0].Release.UniqueID, e.Failed[0].Err)
+	}
+	return fmt.Sprintf("failed to load %d releases, first error: %s", len(e.Failed), e.Failed[0].Err)
+}
+
+// LoadWithProgress bulk-writes releases to rs, calling progress with the
+// outcome of each release. If rs is not a ProgressLoader, all releases are
+// written with a single call to Load and progress is reported once it returns.
+func LoadWithProgress(ctx context.Context, rs ReleaseStore, releases Releases, progress LoadProgressFunc) error {
+	if pl, ok := rs.(ProgressLoader); ok {
+		return pl.LoadWithProgress(ctx, releases, progress)
+	}
+
+	err := rs.Load(ctx, releases)
+	if progress != nil {
+		for _, r := range releases {
+			progress(LoadResult{Release: r, Err: err})
+		}
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/skuid/helm-value-store/memory"
+	"github.com/skuid/helm-value-store/store"
+)
+
+func TestLoadWithProgressFallback(t *testing.T) {
+	cases := []struct {
+		name     string
+		releases store.Releases
+		wantErr  bool
+	}{
+		{
+			"all valid",
+			store.Releases{{UniqueID: "1"}, {UniqueID: "2"}},
+			false,
+		},
+		{
+			"invalid release",
+			store.Releases{{UniqueID: "1"}, {Name: "missing-id"}},
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		results := []store.LoadResult{}
+		err := store.LoadWithProgress(context.Background(), memory.NewReleaseStore(), c.releases, func(result store.LoadResult) {
+			results = append(results, result)
+		})
+		if (err != nil) != c.wantErr {
+			t.Errorf("Test '%s' got unexpected result: err = %v, expected error: %t", c.name, err, c.wantErr)
+		}
+		if len(results) != len(c.releases) {
+			t.Errorf("Test '%s': Expected %d progress reports, got %d", c.name, len(c.releases), len(results))
+		}
+		for _, result := range results {
+			if result.Err != err {
+				t.Errorf("Test '%s': Expected progress error %v, got %v", c.name, err, result.Err)
+			}
+		}
+	}
+}
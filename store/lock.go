@@ -0,0 +1,56 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A Lease is a lock on a release, held by Owner until it is unlocked or it
+// Expires. Only the holder of the lease knows its Token, which is used to
+// unlock it.
+type Lease struct {
+	UniqueID string    `json:"unique_id" datastore:"uniqueID,noindex"`
+	Owner    string    `json:"owner" datastore:"owner,noindex"`
+	Token    string    `json:"token" datastore:"token,noindex"`
+	Expires  time.Time `json:"expires" datastore:"expires,noindex"`
+}
+
+// LockMargin is how long a lease on a release is held on top of the time its
+// install may take, to allow for resolving its values and downloading its
+// chart
+const LockMargin = 5 * time.Minute
+
+// NewLease returns a lease on a release with a new Token, that expires after
+// ttl
+func NewLease(uniqueID, owner string, ttl time.Duration) Lease {
+	return Lease{
+		UniqueID: uniqueID,
+		Owner:    owner,
+		Token:    uuid.New().String(),
+		Expires:  time.Now().Add(ttl),
+	}
+}
+
+// Expired reports whether the lease has expired at now
+func (l Lease) Expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+// NewLockedError returns an error satisfying IsLocked, describing the lease
+// that is held
+func NewLockedError(held Lease) error {
+	return NewError("lock", held.UniqueID, ErrLocked, fmt.Errorf("held by %s until %s", held.Owner, held.Expires.Format(time.RFC3339)))
+}
+
+// LockOwner returns the owner this process takes leases as, made of the host
+// name and process ID
+func LockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
@@ -0,0 +1,592 @@
+// Package storetest provides a conformance suite for store.ReleaseStore
+// implementations.
+//
+// A backend's tests should call Run with a function that returns a new, empty
+// ReleaseStore:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) (store.ReleaseStore, func()) {
+//			return NewReleaseStore(), func() {}
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/skuid/helm-value-store/store"
+)
+
+// A Factory returns a new, empty ReleaseStore and a function that releases any
+// resources it holds. It is called once per test.
+type Factory func(t *testing.T) (store.ReleaseStore, func())
+
+// Run runs the full conformance suite against the ReleaseStore returned by
+// newStore
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, store.ReleaseStore)
+	}{
+		{"Setup", testSetup},
+		{"PutGet", testPutGet},
+		{"PutOverwrites", testPutOverwrites},
+		{"GetNotFound", testGetNotFound},
+		{"PutInvalid", testPutInvalid},
+		{"Revisions", testRevisions},
+		{"StaleRevision", testStaleRevision},
+		{"ConditionalPut", testConditionalPut},
+		{"History", testHistory},
+		{"HistoryRecreated", testHistoryRecreated},
+		{"Delete", testDelete},
+		{"DeleteNotFound", testDeleteNotFound},
+		{"Labels", testLabels},
+		{"Dependencies", testDependencies},
+		{"List", testList},
+		{"Load", testLoad},
+		{"Lock", testLock},
+		{"LockExpired", testLockExpired},
+		{"UnlockStale", testUnlockStale},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rs, cleanup := newStore(t)
+			defer cleanup()
+			if err := rs.Setup(context.Background()); err != nil {
+				t.Fatalf("Error setting up release store: %s", err)
+			}
+			tc.test(t, rs)
+		})
+	}
+}
+
+func testRelease(uniqueID, name string, labels map[string]string) store.Release {
+	return store.Release{
+		UniqueID:  uniqueID,
+		Labels:    labels,
+		Name:      name,
+		Chart:     "skuid/" + name,
+		Namespace: "default",
+		Version:   "0.1.0",
+		Values:    "image: " + name + "\ntag: latest\n",
+	}
+}
+
+// equalReleases compares releases, treating nil and empty label maps as equal
+// since not every backend can tell them apart. Revisions are checked by their
+// own tests.
+func equalReleases(a, b store.Release) bool {
+	if len(a.Labels) == 0 && len(b.Labels) == 0 {
+		a.Labels, b.Labels = nil, nil
+	}
+	if len(a.Dependencies) == 0 && len(b.Dependencies) == 0 {
+		a.Dependencies, b.Dependencies = nil, nil
+	}
+	a.ReleaseLabels, b.ReleaseLabels = nil, nil
+	a.Revision, b.Revision = 0, 0
+	return reflect.DeepEqual(a, b)
+}
+
+func uniqueIDs(releases store.Releases) []string {
+	ids := []string{}
+	for _, r := range releases {
+		ids = append(ids, r.UniqueID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func mustPut(t *testing.T, rs store.ReleaseStore, r store.Release) {
+	if err := rs.Put(context.Background(), r); err != nil {
+		t.Fatalf("Error putting release %s: %s", r.UniqueID, err)
+	}
+}
+
+func testSetup(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	mustPut(t, rs, testRelease("setup1", "prom1", nil))
+
+	if err := rs.Setup(ctx); err != nil {
+		t.Fatalf("Calling Setup on an existing store errored: %s", err)
+	}
+	if _, err := rs.Get(ctx, "setup1"); err != nil {
+		t.Errorf("Setup on an existing store removed a release: %s", err)
+	}
+}
+
+func testPutGet(t *testing.T, rs store.ReleaseStore) {
+	want := testRelease("putget1", "prom1", map[string]string{"region": "us", "environment": "test"})
+	mustPut(t, rs, want)
+
+	got, err := rs.Get(context.Background(), want.UniqueID)
+	if err != nil {
+		t.Fatalf("Error getting release: %s", err)
+	}
+	if !equalReleases(*got, want) {
+		t.Errorf("Failed getting release: Expected \n\t%#v\ngot: \n\t%#v", want, *got)
+	}
+}
+
+func testPutOverwrites(t *testing.T, rs store.ReleaseStore) {
+	original := testRelease("overwrite1", "prom1", map[string]string{"region": "us"})
+	mustPut(t, rs, original)
+
+	want := original
+	want.Labels = map[string]string{"region": "eu"}
+	want.Version = "0.2.0"
+	want.Values = "image: prometheus\n"
+	mustPut(t, rs, want)
+
+	got, err := rs.Get(context.Background(), want.UniqueID)
+	if err != nil {
+		t.Fatalf("Error getting release: %s", err)
+	}
+	if !equalReleases(*got, want) {
+		t.Errorf("Put did not overwrite release: Expected \n\t%#v\ngot: \n\t%#v", want, *got)
+	}
+}
+
+func testGetNotFound(t *testing.T, rs store.ReleaseStore) {
+	got, err := rs.Get(context.Background(), "does-not-exist")
+	if err == nil {
+		t.Fatalf("Expected an error getting a missing release, got %#v", got)
+	}
+	if !store.IsNotFound(err) {
+		t.Errorf("Expected a not found error getting a missing release, got %s", err)
+	}
+	if got != nil {
+		t.Errorf("Expected no release when getting a missing release, got %#v", got)
+	}
+}
+
+func testPutInvalid(t *testing.T, rs store.ReleaseStore) {
+	r := testRelease("", "prom1", nil)
+	if err := rs.Put(context.Background(), r); !store.IsInvalidRelease(err) {
+		t.Errorf("Expected an invalid release error putting a release without a UniqueID, got %v", err)
+	}
+	if err := rs.Load(context.Background(), store.Releases{r}); !store.IsInvalidRelease(err) {
+		t.Errorf("Expected an invalid release error loading a release without a UniqueID, got %v", err)
+	}
+}
+
+func mustGet(t *testing.T, rs store.ReleaseStore, uniqueID string) *store.Release {
+	r, err := rs.Get(context.Background(), uniqueID)
+	if err != nil {
+		t.Fatalf("Error getting release %s: %s", uniqueID, err)
+	}
+	return r
+}
+
+func testRevisions(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	mustPut(t, rs, testRelease("revision1", "prom1", nil))
+	if got := mustGet(t, rs, "revision1"); got.Revision != 1 {
+		t.Errorf("Expected a new release to have revision 1, got %d", got.Revision)
+	}
+
+	mustPut(t, rs, *mustGet(t, rs, "revision1"))
+	if got := mustGet(t, rs, "revision1"); got.Revision != 2 {
+		t.Errorf("Expected Put to increment the revision to 2, got %d", got.Revision)
+	}
+
+	if err := rs.Load(ctx, store.Releases{*mustGet(t, rs, "revision1")}); err != nil {
+		t.Fatalf("Error loading releases: %s", err)
+	}
+	if got := mustGet(t, rs, "revision1"); got.Revision != 3 {
+		t.Errorf("Expected Load to increment the revision to 3, got %d", got.Revision)
+	}
+}
+
+func testStaleRevision(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	stale := testRelease("stale1", "prom1", nil)
+	mustPut(t, rs, stale)
+	mustPut(t, rs, *mustGet(t, rs, "stale1"))
+
+	// Writing an old copy, like an old dump, must not reuse a revision
+	mustPut(t, rs, stale)
+	if got := mustGet(t, rs, "stale1"); got.Revision != 3 {
+		t.Errorf("Expected Put of a stale release to write revision 3, got %d", got.Revision)
+	}
+	stale.Revision = 1
+	if err := rs.Load(ctx, store.Releases{stale}); err != nil {
+		t.Fatalf("Error loading releases: %s", err)
+	}
+	if got := mustGet(t, rs, "stale1"); got.Revision != 4 {
+		t.Errorf("Expected Load of a stale release to write revision 4, got %d", got.Revision)
+	}
+	stale.Revision = 100
+	mustPut(t, rs, stale)
+	if got := mustGet(t, rs, "stale1"); got.Revision != 5 {
+		t.Errorf("Expected Put to ignore the written revision and write revision 5, got %d", got.Revision)
+	}
+
+	history, err := rs.History(ctx, "stale1")
+	if err != nil {
+		t.Fatalf("Error getting history: %s", err)
+	}
+	revisions := []int64{}
+	for _, r := range history {
+		revisions = append(revisions, r.Revision)
+	}
+	if want := []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(revisions, want) {
+		t.Errorf("Expected revisions %v in the history, got %v", want, revisions)
+	}
+}
+
+func testConditionalPut(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+
+	created := testRelease("conditional1", "prom1", nil)
+	if err := rs.ConditionalPut(ctx, created); err != nil {
+		t.Fatalf("Expected ConditionalPut to create a missing release, got %s", err)
+	}
+	if err := rs.ConditionalPut(ctx, created); !store.IsConflict(err) {
+		t.Errorf("Expected a conflict creating an existing release, got %v", err)
+	}
+
+	first := mustGet(t, rs, "conditional1")
+	second := mustGet(t, rs, "conditional1")
+
+	first.Version = "0.2.0"
+	if err := rs.ConditionalPut(ctx, *first); err != nil {
+		t.Fatalf("Expected ConditionalPut with the current revision to succeed, got %s", err)
+	}
+
+	second.Version = "0.3.0"
+	if err := rs.ConditionalPut(ctx, *second); !store.IsConflict(err) {
+		t.Errorf("Expected a conflict writing a stale revision, got %v", err)
+	}
+
+	got := mustGet(t, rs, "conditional1")
+	if got.Version != "0.2.0" {
+		t.Errorf("Expected the stale write to be rejected, got version %s", got.Version)
+	}
+	if got.Revision != first.Revision+1 {
+		t.Errorf("Expected revision %d, got %d", first.Revision+1, got.Revision)
+	}
+
+	missing := testRelease("conditional2", "prom2", nil)
+	missing.Revision = 4
+	if err := rs.ConditionalPut(ctx, missing); !store.IsConflict(err) {
+		t.Errorf("Expected a conflict updating a missing release, got %v", err)
+	}
+}
+
+func testHistory(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+
+	history, err := rs.History(ctx, "history1")
+	if err != nil {
+		t.Fatalf("Error getting the history of a missing release: %s", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("Expected no history for a missing release, got %d revisions", len(history))
+	}
+
+	r := testRelease("history1", "prom1", map[string]string{"region": "us"})
+	mustPut(t, rs, r)
+
+	r = *mustGet(t, rs, "history1")
+	r.Values = "image: prometheus\ntag: v2\n"
+	if err := rs.ConditionalPut(ctx, r); err != nil {
+		t.Fatalf("Error updating release: %s", err)
+	}
+
+	r = *mustGet(t, rs, "history1")
+	r.Version = "0.2.0"
+	r.Labels = map[string]string{"region": "eu"}
+	if err := rs.Load(ctx, store.Releases{r}); err != nil {
+		t.Fatalf("Error loading release: %s", err)
+	}
+	mustPut(t, rs, testRelease("history2", "prom2", nil))
+
+	if err := rs.Delete(ctx, "history1"); err != nil {
+		t.Fatalf("Error deleting release: %s", err)
+	}
+
+	history, err = rs.History(ctx, "history1")
+	if err != nil {
+		t.Fatalf("Error getting history: %s", err)
+	}
+	want := []struct {
+		revision int64
+		values   string
+		version  string
+		region   string
+	}{
+		{1, "image: prom1\ntag: latest\n", "0.1.0", "us"},
+		{2, "image: prometheus\ntag: v2\n", "0.1.0", "us"},
+		{3, "image: prometheus\ntag: v2\n", "0.2.0", "eu"},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("Expected %d revisions, got %d: %v", len(want), len(history), history)
+	}
+	for i, w := range want {
+		got := history[i]
+		if got.UniqueID != "history1" || got.Revision != w.revision || got.Values != w.values || got.Version != w.version || got.Labels["region"] != w.region {
+			t.Errorf("Revision %d differs: Expected %+v, got %#v", i+1, w, got)
+		}
+	}
+}
+
+func testDelete(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	mustPut(t, rs, testRelease("delete1", "prom1", nil))
+	mustPut(t, rs, testRelease("delete2", "prom2", nil))
+
+	if err := rs.Delete(ctx, "delete1"); err != nil {
+		t.Fatalf("Error deleting release: %s", err)
+	}
+	if _, err := rs.Get(ctx, "delete1"); !store.IsNotFound(err) {
+		t.Errorf("Expected a not found error getting a deleted release, got %v", err)
+	}
+	if _, err := rs.Get(ctx, "delete2"); err != nil {
+		t.Errorf("Deleting a release removed another release: %s", err)
+	}
+}
+
+func testDeleteNotFound(t *testing.T, rs store.ReleaseStore) {
+	if err := rs.Delete(context.Background(), "does-not-exist"); err != nil {
+		t.Errorf("Expected deleting a missing release to succeed, got %s", err)
+	}
+}
+
+func testLabels(t *testing.T, rs store.ReleaseStore) {
+	cases := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{"nil labels", nil},
+		{"empty labels", map[string]string{}},
+		{"single label", map[string]string{"region": "us-west-2"}},
+		{"many labels", map[string]string{"region": "us-west-2", "environment": "prod", "team": "platform"}},
+	}
+
+	for i, c := range cases {
+		want := testRelease(fmt.Sprintf("labels%d", i), "prom1", c.labels)
+		mustPut(t, rs, want)
+
+		got, err := rs.Get(context.Background(), want.UniqueID)
+		if err != nil {
+			t.Errorf("Test '%s': error getting release: %s", c.name, err)
+			continue
+		}
+		if !equalReleases(*got, want) {
+			t.Errorf("Test '%s': labels did not round-trip. Expected %v, got %v", c.name, want.Labels, got.Labels)
+		}
+	}
+}
+
+func testDependencies(t *testing.T, rs store.ReleaseStore) {
+	cases := []struct {
+		name         string
+		dependencies []store.Dependency
+	}{
+		{"no dependencies", nil},
+		{"by unique ID", []store.Dependency{{UniqueID: "exporter"}}},
+		{"by name and selector", []store.Dependency{
+			{Name: "alertmanager", Selector: map[string]string{"region": "us"}},
+			{Name: "exporter"},
+		}},
+	}
+
+	for i, c := range cases {
+		want := testRelease(fmt.Sprintf("dependencies%d", i), "prom1", nil)
+		want.Dependencies = c.dependencies
+		mustPut(t, rs, want)
+
+		got, err := rs.Get(context.Background(), want.UniqueID)
+		if err != nil {
+			t.Errorf("Test '%s': error getting release: %s", c.name, err)
+			continue
+		}
+		if !equalReleases(*got, want) {
+			t.Errorf("Test '%s': dependencies did not round-trip. Expected %v, got %v", c.name, want.Dependencies, got.Dependencies)
+		}
+	}
+
+	invalid := testRelease("dependencies-invalid", "prom1", nil)
+	invalid.Dependencies = []store.Dependency{{Selector: map[string]string{"region": "us"}}}
+	if err := rs.Put(context.Background(), invalid); !store.IsInvalidRelease(err) {
+		t.Errorf("Expected a dependency without a unique ID or name to be invalid, got %v", err)
+	}
+}
+
+func testList(t *testing.T, rs store.ReleaseStore) {
+	releases := store.Releases{
+		testRelease("list1", "prom1", map[string]string{"region": "us", "environment": "test"}),
+		testRelease("list2", "prom2", map[string]string{"region": "us", "environment": "prod"}),
+		testRelease("list3", "prom3", map[string]string{"region": "eu", "environment": "prod"}),
+		testRelease("list4", "prom4", nil),
+	}
+	for _, r := range releases {
+		mustPut(t, rs, r)
+	}
+
+	cases := []struct {
+		selector map[string]string
+		want     []string
+	}{
+		{nil, []string{"list1", "list2", "list3", "list4"}},
+		{map[string]string{}, []string{"list1", "list2", "list3", "list4"}},
+		{map[string]string{"region": "us"}, []string{"list1", "list2"}},
+		{map[string]string{"region": "eu", "environment": "prod"}, []string{"list3"}},
+		{map[string]string{"environment": ""}, []string{"list1", "list2", "list3"}},
+		{map[string]string{"region": "ap"}, []string{}},
+		{map[string]string{"team": ""}, []string{}},
+	}
+
+	for _, c := range cases {
+		got, err := rs.List(context.Background(), c.selector)
+		if err != nil {
+			t.Errorf("Error listing releases for %v: %s", c.selector, err)
+			continue
+		}
+		if ids := uniqueIDs(got); !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("Failed List(%v): Expected %v, got %v", c.selector, c.want, ids)
+		}
+		for _, r := range got {
+			for _, want := range releases {
+				if r.UniqueID == want.UniqueID && !equalReleases(r, want) {
+					t.Errorf("Listed release differs: Expected \n\t%#v\ngot: \n\t%#v", want, r)
+				}
+			}
+		}
+	}
+}
+
+func testLoad(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	if err := rs.Load(ctx, store.Releases{}); err != nil {
+		t.Fatalf("Error loading no releases: %s", err)
+	}
+
+	mustPut(t, rs, testRelease("load1", "old", nil))
+
+	// Load more than a single DynamoDB batch worth of releases
+	releases := store.Releases{}
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("load%02d", i+2)
+		releases = append(releases, testRelease(id, "prom", map[string]string{"batch": "load"}))
+	}
+	releases = append(releases, testRelease("load1", "new", map[string]string{"batch": "load"}))
+
+	if err := rs.Load(ctx, releases); err != nil {
+		t.Fatalf("Error loading releases: %s", err)
+	}
+
+	got, err := rs.List(ctx, map[string]string{"batch": "load"})
+	if err != nil {
+		t.Fatalf("Error listing releases: %s", err)
+	}
+	if ids, want := uniqueIDs(got), uniqueIDs(releases); !reflect.DeepEqual(ids, want) {
+		t.Errorf("Failed loading releases: Expected %v, got %v", want, ids)
+	}
+
+	r, err := rs.Get(ctx, "load1")
+	if err != nil {
+		t.Fatalf("Error getting release: %s", err)
+	}
+	if r.Name != "new" {
+		t.Errorf("Load did not overwrite existing release: Expected name %q, got %q", "new", r.Name)
+	}
+}
+
+func testLock(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	lease, err := rs.Lock(ctx, "lock1", "replica-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Error locking release: %s", err)
+	}
+	if lease.UniqueID != "lock1" || lease.Owner != "replica-1" || len(lease.Token) == 0 {
+		t.Errorf("Expected a lease on lock1 owned by replica-1, got %+v", lease)
+	}
+
+	if _, err := rs.Lock(ctx, "lock1", "replica-2", time.Minute); !store.IsLocked(err) {
+		t.Errorf("Expected a locked error taking a held lease, got %v", err)
+	}
+	if _, err := rs.Lock(ctx, "lock2", "replica-2", time.Minute); err != nil {
+		t.Errorf("Locking a release blocked another release: %s", err)
+	}
+
+	if err := rs.Unlock(ctx, *lease); err != nil {
+		t.Fatalf("Error unlocking release: %s", err)
+	}
+	if _, err := rs.Lock(ctx, "lock1", "replica-2", time.Minute); err != nil {
+		t.Errorf("Expected to take a released lease, got %s", err)
+	}
+}
+
+func testLockExpired(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	if _, err := rs.Lock(ctx, "expired1", "replica-1", 0); err != nil {
+		t.Fatalf("Error locking release: %s", err)
+	}
+	if _, err := rs.Lock(ctx, "expired1", "replica-2", time.Minute); err != nil {
+		t.Errorf("Expected to take an expired lease, got %s", err)
+	}
+}
+
+func testUnlockStale(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	stale, err := rs.Lock(ctx, "stale1", "replica-1", 0)
+	if err != nil {
+		t.Fatalf("Error locking release: %s", err)
+	}
+	if _, err := rs.Lock(ctx, "stale1", "replica-2", time.Minute); err != nil {
+		t.Fatalf("Error taking an expired lease: %s", err)
+	}
+
+	// The first holder's lease expired, so releasing it must not release
+	// the lease taken since
+	if err := rs.Unlock(ctx, *stale); err != nil {
+		t.Errorf("Expected unlocking an expired lease to succeed, got %s", err)
+	}
+	if _, err := rs.Lock(ctx, "stale1", "replica-3", time.Minute); !store.IsLocked(err) {
+		t.Errorf("Expected unlocking an expired lease to keep the current lease, got %v", err)
+	}
+	if err := rs.Unlock(ctx, store.Lease{UniqueID: "does-not-exist", Token: "abc"}); err != nil {
+		t.Errorf("Expected unlocking a release that isn't locked to succeed, got %s", err)
+	}
+}
+
+func testHistoryRecreated(t *testing.T, rs store.ReleaseStore) {
+	ctx := context.Background()
+	mustPut(t, rs, testRelease("recreated1", "prom1", nil))
+	mustPut(t, rs, testRelease("recreated1", "prom2", nil))
+	if err := rs.Delete(ctx, "recreated1"); err != nil {
+		t.Fatalf("Error deleting release: %s", err)
+	}
+
+	// Creating the release again continues its history
+	if err := rs.ConditionalPut(ctx, testRelease("recreated1", "prom3", nil)); err != nil {
+		t.Fatalf("Expected ConditionalPut to create a deleted release, got %s", err)
+	}
+	if got := mustGet(t, rs, "recreated1"); got.Revision != 3 {
+		t.Errorf("Expected a recreated release to have revision 3, got %d", got.Revision)
+	}
+	if err := rs.Delete(ctx, "recreated1"); err != nil {
+		t.Fatalf("Error deleting release: %s", err)
+	}
+	mustPut(t, rs, testRelease("recreated1", "prom4", nil))
+
+	history, err := rs.History(ctx, "recreated1")
+	if err != nil {
+		t.Fatalf("Error getting history: %s", err)
+	}
+	got := []string{}
+	for _, r := range history {
+		got = append(got, fmt.Sprintf("%d:%s", r.Revision, r.Name))
+	}
+	if want := []string{"1:prom1", "2:prom2", "3:prom3", "4:prom4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected history %v, got %v", want, got)
+	}
+}
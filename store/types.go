@@ -3,32 +3,43 @@ package store
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/ghodss/yaml"
 	"k8s.io/helm/pkg/downloader"
 	"k8s.io/helm/pkg/getter"
-	"k8s.io/helm/pkg/helm"
 	"k8s.io/helm/pkg/helm/environment"
 	"k8s.io/helm/pkg/helm/helmpath"
-	rls "k8s.io/helm/pkg/proto/hapi/services"
 	"k8s.io/helm/pkg/strvals"
 )
 
-var client *helm.Client
-
-func init() {
-	client = helm.NewClient(helm.Host(os.Getenv("TILLER_HOST")))
-}
+// dependenciesProperty is the datastore property dependencies are stored in,
+// as JSON
+const dependenciesProperty = "dependencies"
 
 // Load satisfies the datastore.PropertyLoadSaver interface
 func (r *Release) Load(p []datastore.Property) error {
-	if err := datastore.LoadStruct(r, p); err != nil {
+	props := []datastore.Property{}
+	for _, prop := range p {
+		if prop.Name == dependenciesProperty {
+			if data, ok := prop.Value.([]byte); ok {
+				if err := json.Unmarshal(data, &r.Dependencies); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		props = append(props, prop)
+	}
+	if err := datastore.LoadStruct(r, props); err != nil {
 		return err
 	}
 	labels := map[string]string{}
@@ -64,6 +75,17 @@ func (r *Release) Save() ([]datastore.Property, error) {
 		Value:   labelBytes,
 		NoIndex: true,
 	})
+	if len(r.Dependencies) > 0 {
+		dependencyBytes, err := json.Marshal(r.Dependencies)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, datastore.Property{
+			Name:    dependenciesProperty,
+			Value:   dependencyBytes,
+			NoIndex: true,
+		})
+	}
 	return response, nil
 }
 
@@ -77,6 +99,11 @@ type Release struct {
 	Namespace     string            `json:"namespace" datastore:"namespace,noindex"`
 	Version       string            `json:"version" datastore:"version,noindex"`
 	Values        string            `json:"values" datastore:"values,noindex"`
+	// Revision is set by the ReleaseStore every time the release is
+	// written, and is used to detect concurrent changes
+	Revision int64 `json:"revision" datastore:"revision,noindex"`
+	// Dependencies are releases that must be installed before this one
+	Dependencies []Dependency `json:"dependencies,omitempty" datastore:"-"`
 }
 
 func (r Release) String() string {
@@ -97,6 +124,19 @@ func (r Release) MatchesSelector(selector map[string]string) bool {
 	return true
 }
 
+// Validate checks that a release can be written to a ReleaseStore
+func (r Release) Validate() error {
+	if len(r.UniqueID) == 0 {
+		return NewError("validate", "", ErrInvalidRelease, errors.New("missing unique ID"))
+	}
+	for _, d := range r.Dependencies {
+		if len(d.UniqueID) == 0 && len(d.Name) == 0 {
+			return NewError("validate", r.UniqueID, ErrInvalidRelease, errors.New("dependencies must have a unique ID or a name"))
+		}
+	}
+	return nil
+}
+
 // ReleaseUnmarshaler is an interface for unmarshaling a release
 type ReleaseUnmarshaler interface {
 	UnmarshalRelease(Release) error
@@ -107,33 +147,16 @@ type ReleaseMarshaler interface {
 	MarshalRelease() (*Release, error)
 }
 
-// Upgrade sends an update to an existing release in a cluster
-func (r Release) Upgrade(chartLocation string, dryRun bool, timeout int64) (*rls.UpdateReleaseResponse, error) {
-	return client.UpdateRelease(
-		r.Name,
-		chartLocation,
-		helm.UpdateValueOverrides([]byte(r.Values)),
-		helm.UpgradeDryRun(dryRun),
-		helm.UpgradeTimeout(timeout),
-	)
-}
-
-// Install creates an new release in a cluster
-func (r Release) Install(chartLocation string, dryRun bool, timeout int64) (*rls.InstallReleaseResponse, error) {
-	return client.InstallRelease(
-		chartLocation,
-		r.Namespace,
-		helm.ValueOverrides([]byte(r.Values)),
-		helm.ReleaseName(r.Name),
-		helm.InstallDryRun(dryRun),
-		helm.InstallTimeout(timeout),
-	)
-}
-
 // Download gets the release from an index server
 func (r Release) Download() (string, error) {
+	return r.DownloadWithOutput(os.Stdout)
+}
+
+// DownloadWithOutput downloads the release's chart like Download, writing any
+// messages about the download to out
+func (r Release) DownloadWithOutput(out io.Writer) (string, error) {
 	dl := downloader.ChartDownloader{
-		Out:      os.Stdout,
+		Out:      out,
 		HelmHome: helmpath.Home(os.Getenv("HELM_HOME")),
 		Getters:  getter.All(environment.EnvSettings{}),
 	}
@@ -155,11 +178,6 @@ func (r Release) Download() (string, error) {
 	return filename, fmt.Errorf("file %q not found: %s", r.Chart, err.Error())
 }
 
-// Get the release content from Tiller
-func (r Release) Get() (*rls.GetReleaseContentResponse, error) {
-	return client.ReleaseContent(r.Name)
-}
-
 // MergeValues parses string values and then merges them into the
 // existing Values for a release.
 // Adopted from kubernetes/helm/cmd/helm/install.go
@@ -198,11 +216,33 @@ type ReleasesMarshaler interface {
 	MarshalReleases() (Releases, error)
 }
 
-// A ReleaseStore is a backend that stores releases
+// A ReleaseStore is a backend that stores releases.
+//
+// Every write stores the release with a Revision one higher than the highest
+// it has had, so revisions only ever increase, even when a release is deleted
+// and created again. The Revision of the release being written is only used
+// by ConditionalPut, which only writes if the stored release still has that
+// Revision (or doesn't exist, for a Revision of 0), and otherwise returns an
+// error satisfying IsConflict. Put and Load write unconditionally.
+//
+// Every revision written is also kept in the release's history, which
+// History returns oldest first. Deleting a release does not delete its
+// history, and no revision in it is ever overwritten.
+//
+// Lock takes a lease on a release, which is held until it is unlocked or it
+// expires. Locking a release whose lease is held by someone else returns an
+// error satisfying IsLocked. Unlocking a lease that has expired, or has been
+// taken by someone else since, does nothing. Leases are independent of the
+// release itself, which doesn't need to exist to be locked.
 type ReleaseStore interface {
 	Get(ctx context.Context, uniqueID string) (*Release, error)
 	Put(context.Context, Release) error
+	ConditionalPut(context.Context, Release) error
 	Delete(ctx context.Context, uniqueID string) error
+	History(ctx context.Context, uniqueID string) (Releases, error)
+
+	Lock(ctx context.Context, uniqueID, owner string, ttl time.Duration) (*Lease, error)
+	Unlock(context.Context, Lease) error
 
 	List(ctx context.Context, selector map[string]string) (Releases, error)
 	Load(context.Context, Releases) error
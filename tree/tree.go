@@ -0,0 +1,330 @@
+// Package tree maps releases to a directory tree that can be reviewed in Git.
+//
+// Each release is a directory named after it, under a path made of its
+// labels, holding a release.yaml with everything but the values, and a
+// values.yaml with the values as they are stored:
+//
+//	environment=prod/region=us-west-2/prometheus/release.yaml
+//	environment=prod/region=us-west-2/prometheus/values.yaml
+//
+// The path is only for browsing: reading a tree takes every field, including
+// labels, from the files.
+package tree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/skuid/helm-value-store/store"
+)
+
+const (
+	// ReleaseFile holds a release's metadata
+	ReleaseFile = "release.yaml"
+	// ValuesFile holds a release's values
+	ValuesFile = "values.yaml"
+)
+
+// releaseFile is the content of a release.yaml
+type releaseFile struct {
+	UniqueID     string             `json:"unique_id"`
+	Name         string             `json:"name"`
+	Namespace    string             `json:"namespace"`
+	Chart        string             `json:"chart"`
+	Version      string             `json:"version"`
+	Labels       map[string]string  `json:"labels,omitempty"`
+	Dependencies []store.Dependency `json:"dependencies,omitempty"`
+}
+
+// Path returns the directory of a release, relative to the root of the tree.
+// Release names that would leave their directory, such as "..", are rejected.
+func Path(r store.Release) (string, error) {
+	if r.Name == "" || r.Name == "." || r.Name == ".." {
+		return "", fmt.Errorf("Release %s can't be written to a directory named %q", r.UniqueID, r.Name)
+	}
+
+	keys := []string{}
+	for k := range r.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	segments := []string{}
+	for _, k := range keys {
+		segments = append(segments, url.PathEscape(k+"="+r.Labels[k]))
+	}
+	return filepath.Join(append(segments, url.PathEscape(r.Name))...), nil
+}
+
+// paths returns the directory of each release. Releases with the same name
+// and labels have their unique ID added to their directory.
+func paths(releases store.Releases) (map[string]string, error) {
+	counts := map[string]int{}
+	for _, r := range releases {
+		path, err := Path(r)
+		if err != nil {
+			return nil, err
+		}
+		counts[path]++
+	}
+	response := map[string]string{}
+	for _, r := range releases {
+		path, _ := Path(r)
+		if counts[path] > 1 {
+			path += "-" + r.UniqueID
+		}
+		response[r.UniqueID] = path
+	}
+	return response, nil
+}
+
+// Write writes releases to the tree at dir. Releases already in the tree that
+// match selector but aren't in releases are removed, so the tree mirrors the
+// releases matching selector. A release whose labels changed is moved, and
+// its old directory removed, even if the old labels don't match selector.
+func Write(dir string, releases store.Releases, selector map[string]string) error {
+	releasePaths, err := paths(releases)
+	if err != nil {
+		return err
+	}
+
+	// A new tree is created, but an existing one must be readable
+	existing := map[string]store.Release{}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		if existing, err = readDirs(dir); err != nil {
+			return err
+		}
+	}
+
+	written := map[string]bool{}
+	writtenIDs := map[string]bool{}
+	for _, r := range releases {
+		releaseDir := filepath.Join(dir, releasePaths[r.UniqueID])
+		if err := writeRelease(releaseDir, r); err != nil {
+			return err
+		}
+		written[releaseDir] = true
+		writtenIDs[r.UniqueID] = true
+	}
+
+	for releaseDir, r := range existing {
+		if written[releaseDir] || !(writtenIDs[r.UniqueID] || r.MatchesSelector(selector)) {
+			continue
+		}
+		if err := removeRelease(dir, releaseDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRelease(releaseDir string, r store.Release) error {
+	data, err := yaml.Marshal(releaseFile{
+		UniqueID:     r.UniqueID,
+		Name:         r.Name,
+		Namespace:    r.Namespace,
+		Chart:        r.Chart,
+		Version:      r.Version,
+		Labels:       r.Labels,
+		Dependencies: r.Dependencies,
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding release %s: %q", r.UniqueID, err)
+	}
+
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		return fmt.Errorf("Error creating directory for release %s: %q", r.UniqueID, err)
+	}
+	if err := writeFile(filepath.Join(releaseDir, ReleaseFile), data); err != nil {
+		return fmt.Errorf("Error writing release %s: %q", r.UniqueID, err)
+	}
+	if err := writeFile(filepath.Join(releaseDir, ValuesFile), []byte(r.Values)); err != nil {
+		return fmt.Errorf("Error writing values of release %s: %q", r.UniqueID, err)
+	}
+	return nil
+}
+
+// writeFile writes data to a temporary file next to path and renames it into
+// place, so an interrupted write never leaves a truncated file behind
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removeRelease removes a release's files, and any directories between it
+// and the root left empty
+func removeRelease(root, releaseDir string) error {
+	for _, name := range []string{ReleaseFile, ValuesFile} {
+		if err := os.Remove(filepath.Join(releaseDir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing %s: %q", releaseDir, err)
+		}
+	}
+	for d := releaseDir; d != filepath.Clean(root); d = filepath.Dir(d) {
+		// Fails, and stops, at the first directory that isn't empty
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Read reads every release in the tree at dir. A missing directory, or one
+// with no releases, is an error rather than an empty tree, since importing an
+// empty tree would delete every stored release.
+func Read(dir string) (store.Releases, error) {
+	dirs, err := readDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("No releases found in %s", dir)
+	}
+
+	releases := store.Releases{}
+	seen := map[string]string{}
+	for releaseDir, r := range dirs {
+		if other, ok := seen[r.UniqueID]; ok {
+			return nil, fmt.Errorf("Releases in %s and %s have the same unique_id %s", other, releaseDir, r.UniqueID)
+		}
+		seen[r.UniqueID] = releaseDir
+		releases = append(releases, r)
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].UniqueID < releases[j].UniqueID })
+	return releases, nil
+}
+
+// readDirs reads the releases in the tree at dir, by their directory
+func readDirs(dir string) (map[string]store.Release, error) {
+	releases := map[string]store.Release{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != ReleaseFile {
+			return nil
+		}
+		r, err := readRelease(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		releases[filepath.Dir(path)] = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+func readRelease(releaseDir string) (store.Release, error) {
+	data, err := ioutil.ReadFile(filepath.Join(releaseDir, ReleaseFile))
+	if err != nil {
+		return store.Release{}, fmt.Errorf("Error reading release in %s: %q", releaseDir, err)
+	}
+	file := releaseFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return store.Release{}, fmt.Errorf("Error parsing release in %s: %q", releaseDir, err)
+	}
+
+	values, err := ioutil.ReadFile(filepath.Join(releaseDir, ValuesFile))
+	if err != nil && !os.IsNotExist(err) {
+		return store.Release{}, fmt.Errorf("Error reading values in %s: %q", releaseDir, err)
+	}
+
+	r := store.Release{
+		UniqueID:     file.UniqueID,
+		Name:         file.Name,
+		Namespace:    file.Namespace,
+		Chart:        file.Chart,
+		Version:      file.Version,
+		Labels:       file.Labels,
+		Values:       string(values),
+		Dependencies: file.Dependencies,
+	}
+	if err := r.Validate(); err != nil {
+		return store.Release{}, fmt.Errorf("Invalid release in %s: %s", releaseDir, err)
+	}
+	return r, nil
+}
+
+// A Plan is the changes that make the store match a tree
+type Plan struct {
+	Create store.Releases
+	// Update has the releases from the tree, with the stored Revision
+	Update store.Releases
+	Delete store.Releases
+}
+
+// Empty returns true if there are no changes
+func (p Plan) Empty() bool {
+	return len(p.Create) == 0 && len(p.Update) == 0 && len(p.Delete) == 0
+}
+
+// NewPlan compares the stored releases with the ones in a tree. Releases are
+// matched by UniqueID across the whole store and tree, and only those that
+// match selector in the store or in the tree are changed, so a release whose
+// labels are edited to leave the selector is updated rather than deleted.
+// Delete has the stored releases matching selector that aren't in the tree.
+func NewPlan(stored, desired store.Releases, selector map[string]string) Plan {
+	plan := Plan{}
+	byID := map[string]store.Release{}
+	for _, r := range stored {
+		byID[r.UniqueID] = r
+	}
+
+	inTree := map[string]bool{}
+	for _, r := range desired {
+		inTree[r.UniqueID] = true
+		current, ok := byID[r.UniqueID]
+		if !ok {
+			if r.MatchesSelector(selector) {
+				plan.Create = append(plan.Create, r)
+			}
+			continue
+		}
+		if (current.MatchesSelector(selector) || r.MatchesSelector(selector)) && !equal(current, r) {
+			r.Revision = current.Revision
+			plan.Update = append(plan.Update, r)
+		}
+	}
+
+	for _, r := range stored {
+		if !inTree[r.UniqueID] && r.MatchesSelector(selector) {
+			plan.Delete = append(plan.Delete, r)
+		}
+	}
+	return plan
+}
+
+// equal compares everything a tree holds about two releases
+func equal(a, b store.Release) bool {
+	return a.Name == b.Name &&
+		a.Namespace == b.Namespace &&
+		a.Chart == b.Chart &&
+		a.Version == b.Version &&
+		a.Values == b.Values &&
+		(len(a.Labels) == 0 && len(b.Labels) == 0 || reflect.DeepEqual(a.Labels, b.Labels)) &&
+		(len(a.Dependencies) == 0 && len(b.Dependencies) == 0 || reflect.DeepEqual(a.Dependencies, b.Dependencies))
+}
@@ -0,0 +1,267 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/skuid/helm-value-store/store"
+)
+
+var testReleases = store.Releases{
+	{
+		UniqueID:  "1",
+		Name:      "prometheus",
+		Namespace: "monitoring",
+		Chart:     "stable/prometheus",
+		Version:   "5.0.1",
+		Labels:    map[string]string{"environment": "prod", "region": "us-west-2"},
+		Values:    "replicas: 2\n",
+	},
+	{
+		UniqueID:     "2",
+		Name:         "alertmanager",
+		Namespace:    "monitoring",
+		Chart:        "stable/alertmanager",
+		Version:      "0.1.0",
+		Labels:       map[string]string{"environment": "test"},
+		Dependencies: []store.Dependency{{UniqueID: "1"}},
+	},
+	{
+		UniqueID:  "3",
+		Name:      "alertmanager",
+		Namespace: "monitoring",
+		Chart:     "stable/alertmanager",
+		Version:   "0.1.1",
+		Labels:    map[string]string{"environment": "test"},
+	},
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestPath(t *testing.T) {
+	cases := []struct {
+		name    string
+		release store.Release
+		want    string
+	}{
+		{"no labels", store.Release{Name: "prom"}, "prom"},
+		{"sorted labels", store.Release{Name: "prom", Labels: map[string]string{"region": "us", "environment": "prod"}}, "environment=prod/region=us/prom"},
+		{"escaped", store.Release{Name: "prom", Labels: map[string]string{"example.com/team": "a b"}}, "example.com%2Fteam=a%20b/prom"},
+		{"escaped separator", store.Release{Name: "../prom"}, "..%2Fprom"},
+		{"parent", store.Release{Name: ".."}, ""},
+		{"current", store.Release{Name: ".", Labels: map[string]string{"environment": "prod"}}, ""},
+		{"empty", store.Release{}, ""},
+	}
+	for _, c := range cases {
+		got, err := Path(c.release)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("Test '%s': Expected an error, got %s", c.name, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(c.want) {
+			t.Errorf("Test '%s': Expected %s, got %s, %v", c.name, c.want, got, err)
+		}
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := Write(dir, testReleases, nil); err != nil {
+		t.Fatalf("Error writing tree: %s", err)
+	}
+
+	for _, path := range []string{
+		"environment=prod/region=us-west-2/prometheus/release.yaml",
+		"environment=prod/region=us-west-2/prometheus/values.yaml",
+		"environment=test/alertmanager-2/release.yaml",
+		"environment=test/alertmanager-3/release.yaml",
+	} {
+		if !exists(filepath.Join(dir, filepath.FromSlash(path))) {
+			t.Errorf("Expected %s to be written", path)
+		}
+	}
+
+	got, err := Read(dir)
+	if err != nil {
+		t.Fatalf("Error reading tree: %s", err)
+	}
+	if !reflect.DeepEqual(got, testReleases) {
+		t.Errorf("Expected to read back\n%v\ngot\n%v", testReleases, got)
+	}
+
+	// Files are written through temporary files, which are renamed away
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() != ReleaseFile && info.Name() != ValuesFile {
+			t.Errorf("Expected no other files in the tree, found %s", path)
+		}
+		return nil
+	})
+}
+
+func TestWriteInvalidName(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	releases := store.Releases{{UniqueID: "1", Name: ".."}}
+	if err := Write(filepath.Join(dir, "tree"), releases, nil); err == nil {
+		t.Errorf("Expected an error writing a release named ..")
+	}
+	if exists(filepath.Join(dir, ReleaseFile)) {
+		t.Errorf("Expected nothing to be written outside the tree")
+	}
+}
+
+func TestWriteRemovesStale(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := Write(dir, testReleases, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the test releases are rewritten, and release 3 is gone
+	if err := Write(dir, testReleases[1:2], map[string]string{"environment": "test"}); err != nil {
+		t.Fatalf("Error rewriting tree: %s", err)
+	}
+
+	if exists(filepath.Join(dir, "environment=test", "alertmanager-3")) {
+		t.Errorf("Expected the removed release's directory to be removed")
+	}
+	if !exists(filepath.Join(dir, "environment=test", "alertmanager", "release.yaml")) {
+		t.Errorf("Expected the remaining release to be written without its unique ID")
+	}
+	if !exists(filepath.Join(dir, "environment=prod", "region=us-west-2", "prometheus", "release.yaml")) {
+		t.Errorf("Expected releases outside the selector to be kept")
+	}
+
+	// Release 1 moves into the selector, and its old directory is removed
+	moved := testReleases[0]
+	moved.Labels = map[string]string{"environment": "test"}
+	if err := Write(dir, store.Releases{testReleases[1], moved}, map[string]string{"environment": "test"}); err != nil {
+		t.Fatalf("Error rewriting tree: %s", err)
+	}
+	if exists(filepath.Join(dir, "environment=prod")) {
+		t.Errorf("Expected the moved release's old directory to be removed")
+	}
+	if _, err := Read(dir); err != nil {
+		t.Errorf("Expected the moved release to be read once, got %s", err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"missing unique ID", map[string]string{"prom/release.yaml": "name: prom\n"}},
+		{"duplicate unique ID", map[string]string{"a/release.yaml": "unique_id: 1\n", "b/release.yaml": "unique_id: 1\n"}},
+		{"bad yaml", map[string]string{"prom/release.yaml": "unique_id: [\n"}},
+	}
+	for _, c := range cases {
+		dir := tempDir(t)
+		for path, content := range c.files {
+			path = filepath.Join(dir, filepath.FromSlash(path))
+			os.MkdirAll(filepath.Dir(path), 0755)
+			ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if _, err := Read(dir); err == nil {
+			t.Errorf("Test '%s': Expected an error, got nil", c.name)
+		}
+		os.RemoveAll(dir)
+	}
+
+	if _, err := Read(filepath.Join(os.TempDir(), "missing-tree")); err == nil {
+		t.Errorf("Expected an error reading a missing tree")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if _, err := Read(dir); err == nil {
+		t.Errorf("Expected an error reading an empty tree")
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	stored := store.Releases{
+		{UniqueID: "1", Name: "prometheus", Values: "replicas: 1\n", Revision: 4},
+		{UniqueID: "2", Name: "alertmanager", Labels: map[string]string{}, Revision: 2},
+		{UniqueID: "3", Name: "grafana", Revision: 1},
+	}
+	desired := store.Releases{
+		{UniqueID: "1", Name: "prometheus", Values: "replicas: 2\n"},
+		{UniqueID: "2", Name: "alertmanager"},
+		{UniqueID: "4", Name: "loki"},
+	}
+
+	plan := NewPlan(stored, desired, nil)
+	if got := ids(plan.Create); !reflect.DeepEqual(got, []string{"4"}) {
+		t.Errorf("Expected to create [4], got %v", got)
+	}
+	if got := ids(plan.Update); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("Expected to update [1], got %v", got)
+	}
+	if got := ids(plan.Delete); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("Expected to delete [3], got %v", got)
+	}
+	if plan.Update[0].Revision != 4 || plan.Update[0].Values != "replicas: 2\n" {
+		t.Errorf("Expected the update to have the new values and the stored revision, got %v", plan.Update[0])
+	}
+	if NewPlan(stored, stored, nil).Empty() != true {
+		t.Errorf("Expected no changes comparing the store with itself")
+	}
+}
+
+func ids(releases store.Releases) []string {
+	response := []string{}
+	for _, r := range releases {
+		response = append(response, r.UniqueID)
+	}
+	return response
+}
+
+func TestNewPlanSelector(t *testing.T) {
+	prod := map[string]string{"environment": "prod"}
+	test := map[string]string{"environment": "test"}
+	stored := store.Releases{
+		{UniqueID: "leaving", Name: "a", Labels: prod},
+		{UniqueID: "joining", Name: "b", Labels: test},
+		{UniqueID: "outside", Name: "c", Labels: test},
+		{UniqueID: "gone", Name: "d", Labels: prod},
+		{UniqueID: "gone-outside", Name: "e", Labels: test},
+	}
+	desired := store.Releases{
+		{UniqueID: "leaving", Name: "a", Labels: test},
+		{UniqueID: "joining", Name: "b", Labels: prod},
+		{UniqueID: "outside", Name: "c", Labels: test, Values: "changed"},
+		{UniqueID: "new", Name: "f", Labels: prod},
+		{UniqueID: "new-outside", Name: "g", Labels: test},
+	}
+
+	plan := NewPlan(stored, desired, prod)
+	if got := ids(plan.Create); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("Expected to create [new], got %v", got)
+	}
+	if got := ids(plan.Update); !reflect.DeepEqual(got, []string{"leaving", "joining"}) {
+		t.Errorf("Expected releases moving in or out of the selector to be updated, got %v", got)
+	}
+	if got := ids(plan.Delete); !reflect.DeepEqual(got, []string{"gone"}) {
+		t.Errorf("Expected to delete [gone], got %v", got)
+	}
+}